@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"users/config"
 	server "users/internal"
 )
@@ -8,6 +9,12 @@ import (
 func main() {
 
 	config.LoadConfig()
+
+	// go run main.go verify-audit checks the audit log instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(server.VerifyAudit())
+	}
+
 	server.Run()
 
 }
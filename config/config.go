@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -14,20 +15,153 @@ type AppConfig struct {
 	Token struct {
 		Secret string `yaml:"secret"`
 		Salt   string `yaml:"salt"`
+		// access tokens are signed with HMACKey, else a key derived from
+		// Secret, unless Ed25519Key, a base64 seed, is set; Ed25519PublicKeys
+		// are accepted besides, e.g. the previous key during a rotation;
+		// HS256 tokens are refused then, unless AcceptHMAC is set for the
+		// switch
+		HMACKey           string        `yaml:"hmacKey" env:"TOKEN_HMAC_KEY" env-description:"Hex HS256 key of the access tokens"`
+		Issuer            string        `yaml:"issuer" env:"TOKEN_ISSUER" env-description:"iss claim of the access tokens" env-default:"users"`
+		AccessTTL         time.Duration `yaml:"accessTTL" env:"TOKEN_ACCESS_TTL" env-description:"Lifetime of the access tokens" env-default:"15m"`
+		RefreshTTL        time.Duration `yaml:"refreshTTL" env:"TOKEN_REFRESH_TTL" env-description:"Lifetime of the refresh tokens" env-default:"720h"`
+		Ed25519Key        string        `yaml:"ed25519Key" env:"TOKEN_ED25519_KEY" env-description:"Base64 Ed25519 seed to sign the access tokens with"`
+		Ed25519PublicKeys []string      `yaml:"ed25519PublicKeys" env:"TOKEN_ED25519_PUBLIC_KEYS" env-description:"Base64 Ed25519 public keys accepted besides"`
+		AcceptHMAC        bool          `yaml:"acceptHMAC" env:"TOKEN_ACCEPT_HMAC" env-description:"Keep accepting HS256 access tokens while switching to Ed25519"`
 	} `yaml:"token"`
+	// Cookie holds the hex AES keys cookies are encrypted with by key id:
+	// Primary encrypts the new cookies, the other keys only decrypt the ones
+	// written before a rotation. They are required outside Bootstrap.DevMode,
+	// where one is derived from Token.Secret without them.
+	Cookie struct {
+		Primary string            `yaml:"primary" env:"COOKIE_PRIMARY_KEY" env-description:"Id of the key new cookies are encrypted with"`
+		Keys    map[string]string `yaml:"keys" env:"COOKIE_KEYS" env-description:"Hex AES keys by id, as id:key,id:key"`
+	} `yaml:"cookie"`
+	// Password is how new passwords are hashed, older hashes are redone as
+	// their users log in. Token.Salt is appended to the passwords all the same.
+	Password struct {
+		Algorithm  string `yaml:"algorithm" env:"PASSWORD_ALGORITHM" env-description:"Hash of the new passwords: argon2id or bcrypt" env-default:"argon2id"`
+		BcryptCost int    `yaml:"bcryptCost" env:"PASSWORD_BCRYPT_COST" env-description:"Cost of the bcrypt hashes" env-default:"10"`
+		Argon2     struct {
+			Time    uint32 `yaml:"time" env:"PASSWORD_ARGON2_TIME" env-description:"Passes of the argon2id hashes" env-default:"2"`
+			Memory  uint32 `yaml:"memory" env:"PASSWORD_ARGON2_MEMORY" env-description:"Memory of the argon2id hashes in KiB" env-default:"19456"`
+			Threads uint32 `yaml:"threads" env:"PASSWORD_ARGON2_THREADS" env-description:"Parallelism of the argon2id hashes, 1 to 255" env-default:"1"`
+		} `yaml:"argon2"`
+		// MaxConcurrent caps the hashes computed at once, each argon2id one
+		// taking Argon2.Memory, so a burst of logins can't exhaust the memory
+		MaxConcurrent int `yaml:"maxConcurrent" env:"PASSWORD_MAX_CONCURRENT" env-description:"Password hashes computed at once, 0 for the number of CPUs" env-default:"0"`
+		// the rules new passwords must follow
+		MinLength      int     `yaml:"minLength" env:"PASSWORD_MIN_LENGTH" env-description:"Least length of the passwords" env-default:"10"`
+		MaxLength      int     `yaml:"maxLength" env:"PASSWORD_MAX_LENGTH" env-description:"Greatest length of the passwords" env-default:"128"`
+		MinClasses     int     `yaml:"minClasses" env:"PASSWORD_MIN_CLASSES" env-description:"Least number of lowercase, uppercase, digit and symbol classes" env-default:"3"`
+		MinEntropy     float64 `yaml:"minEntropy" env:"PASSWORD_MIN_ENTROPY" env-description:"Least estimated entropy of the passwords in bits" env-default:"50"`
+		ForbidPersonal bool    `yaml:"forbidPersonal" env:"PASSWORD_FORBID_PERSONAL" env-description:"Refuse passwords containing the username or email" env-default:"true"`
+		Blocklist      string  `yaml:"blocklist" env:"PASSWORD_BLOCKLIST" env-description:"File of breached passwords to refuse, one per line"`
+	} `yaml:"password"`
+	// Lockout is when failed logins lock a username or an IP out for a while,
+	// doubling with every further failure.
+	Lockout struct {
+		Threshold   int           `yaml:"threshold" env:"LOCKOUT_THRESHOLD" env-description:"Failed logins in a row locking a username out, 0 for never" env-default:"5"`
+		IPThreshold int           `yaml:"ipThreshold" env:"LOCKOUT_IP_THRESHOLD" env-description:"Failed logins locking an IP out, 0 for never" env-default:"20"`
+		BaseDelay   time.Duration `yaml:"baseDelay" env:"LOCKOUT_BASE_DELAY" env-description:"First lockout" env-default:"30s"`
+		MaxDelay    time.Duration `yaml:"maxDelay" env:"LOCKOUT_MAX_DELAY" env-description:"Longest lockout" env-default:"1h"`
+		Window      time.Duration `yaml:"window" env:"LOCKOUT_WINDOW" env-description:"How long failed logins are remembered" env-default:"15m"`
+	} `yaml:"lockout"`
+	// TOTP is the two-factor authentication, see the /user/me/2fa endpoints.
+	TOTP struct {
+		Issuer           string `yaml:"issuer" env:"TOTP_ISSUER" env-description:"Account provider shown by the authenticator apps" env-default:"users"`
+		RequireForAdmins bool   `yaml:"requireForAdmins" env:"TOTP_REQUIRE_FOR_ADMINS" env-description:"Refuse the admins who didn't log in with a one-time code" env-default:"false"`
+	} `yaml:"totp"`
+	// APIKey is how long the keys of the /user/me/keys endpoints are valid.
+	APIKey struct {
+		DefaultTTL time.Duration `yaml:"defaultTTL" env:"API_KEY_DEFAULT_TTL" env-description:"Validity of the keys created without an expiry" env-default:"2160h"`
+		MaxTTL     time.Duration `yaml:"maxTTL" env:"API_KEY_MAX_TTL" env-description:"Longest validity of a key" env-default:"8760h"`
+	} `yaml:"apiKey"`
+	// PasswordReset is how the /auth/password-reset endpoints mail the reset
+	// tokens.
+	PasswordReset struct {
+		TTL time.Duration `yaml:"ttl" env:"PASSWORD_RESET_TTL" env-description:"Validity of the reset tokens" env-default:"30m"`
+		URL string        `yaml:"url" env:"PASSWORD_RESET_URL" env-description:"Page the reset mails link to, with the token in the token query parameter"`
+		// EmailLimit and IPLimit cap the reset requests per LimitWindow.
+		EmailLimit  int           `yaml:"emailLimit" env:"PASSWORD_RESET_EMAIL_LIMIT" env-description:"Reset requests mailed per email and window, 0 for no limit" env-default:"3"`
+		IPLimit     int           `yaml:"ipLimit" env:"PASSWORD_RESET_IP_LIMIT" env-description:"Reset requests per IP and window, 0 for no limit" env-default:"20"`
+		LimitWindow time.Duration `yaml:"limitWindow" env:"PASSWORD_RESET_LIMIT_WINDOW" env-description:"Window of the reset request limits" env-default:"1h"`
+	} `yaml:"passwordReset"`
+	// Mail is how the mails are sent: through an SMTP server, or kept in
+	// memory or written to Dir for local testing.
+	Mail struct {
+		Driver string `yaml:"driver" env:"MAIL_DRIVER" env-description:"Mailer: memory, file or smtp" env-default:"memory"`
+		From   string `yaml:"from" env:"MAIL_FROM" env-description:"Sender of the mails" env-default:"users@localhost"`
+		Dir    string `yaml:"dir" env:"MAIL_DIR" env-description:"Outbox directory of the file mailer" env-default:"../data/outbox"`
+		SMTP   struct {
+			Host     string `yaml:"host" env:"SMTP_HOST" env-description:"SMTP server host" env-default:"localhost"`
+			Port     int    `yaml:"port" env:"SMTP_PORT" env-description:"SMTP server port" env-default:"587"`
+			Username string `yaml:"username" env:"SMTP_USERNAME" env-description:"SMTP username, none for no authentication"`
+			Password string `yaml:"password" env:"SMTP_PASSWORD" env-description:"SMTP password"`
+		} `yaml:"smtp"`
+	} `yaml:"mail"`
+	// Bootstrap are the accounts created at startup when there are no users
+	// yet. Outside DevMode their passwords must follow the password rules.
+	Bootstrap struct {
+		DevMode bool            `yaml:"devMode" env:"BOOTSTRAP_DEV_MODE" env-description:"Accept weak bootstrap passwords" env-default:"false"`
+		Users   []BootstrapUser `yaml:"users"`
+	} `yaml:"bootstrap"`
+	Storage struct {
+		Engine           string        `yaml:"engine" env:"STORAGE_ENGINE" env-description:"Storage engine: memory, file or sqlite" env-default:"memory"`
+		Dir              string        `yaml:"dir" env:"STORAGE_DIR" env-description:"Data directory of the file engine" env-default:"../data"`
+		SnapshotInterval time.Duration `yaml:"snapshotInterval" env:"STORAGE_SNAPSHOT_INTERVAL" env-description:"Period of the file engine snapshots" env-default:"5m"`
+		Path             string        `yaml:"path" env:"STORAGE_PATH" env-description:"Database file of the sqlite engine" env-default:"../data/users.db"`
+	} `yaml:"storage"`
+	Session struct {
+		TTL           time.Duration `yaml:"ttl" env:"SESSION_TTL" env-description:"How long a session lasts since its last use" env-default:"12h"`
+		PurgeInterval time.Duration `yaml:"purgeInterval" env:"SESSION_PURGE_INTERVAL" env-description:"Period of the expired sessions purges" env-default:"1h"`
+	} `yaml:"session"`
+	Trash struct {
+		Retention     time.Duration `yaml:"retention" env:"TRASH_RETENTION" env-description:"How long deleted users are kept in the trash" env-default:"720h"`
+		PurgeInterval time.Duration `yaml:"purgeInterval" env:"TRASH_PURGE_INTERVAL" env-description:"Period of the trash purges" env-default:"1h"`
+	} `yaml:"trash"`
 	Swagger struct {
 		HtmlPath   string `yaml:"htmlPath" env:"htmlPath" env-description:"Path to swagger html" env-default:"../internal/static/redoc.html"`
 		StaticPath string `yaml:"staticPath" env:"staticPath" env-description:"Path to static folder" env-default:"../internal/static/"`
 	}
 }
 
+// BootstrapUser is an account of the bootstrap section. Its password is read
+// from the PasswordEnv variable, else from PasswordFile, e.g. a mounted
+// secret, else from Password.
+type BootstrapUser struct {
+	Username           string `yaml:"username"`
+	Email              string `yaml:"email"`
+	Password           string `yaml:"password"`
+	PasswordFile       string `yaml:"passwordFile"`
+	PasswordEnv        string `yaml:"passwordEnv"`
+	Admin              bool   `yaml:"admin"`
+	MustChangePassword bool   `yaml:"mustChangePassword"`
+}
+
 var Cfg AppConfig
 
 func LoadConfig() {
 
 	err := cleanenv.ReadConfig("../config/config.yaml", &Cfg)
+	if err == nil {
+		err = Cfg.Validate()
+	}
 	if err != nil {
 		fmt.Println(err)
 		panic("Can't load config data")
 	}
 }
+
+// Validate checks the values the types of the fields don't rule out.
+func (c *AppConfig) Validate() error {
+	if threads := c.Password.Argon2.Threads; threads < 1 || threads > 255 {
+		return fmt.Errorf("password.argon2.threads must be between 1 and 255, not %d", threads)
+	}
+	if c.Password.MaxConcurrent < 0 {
+		return fmt.Errorf("password.maxConcurrent must not be negative, not %d", c.Password.MaxConcurrent)
+	}
+	if len(c.Cookie.Keys) == 0 && !c.Bootstrap.DevMode {
+		return fmt.Errorf("cookie.keys must be set, e.g. through COOKIE_KEYS, outside bootstrap.devMode")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"users/internal/rbac"
+
+	"github.com/google/uuid"
+)
+
+// Prefix starts every key, so keys tell apart from access tokens and stand
+// out in leaked files.
+const Prefix = "uk_"
+
+// touchInterval is how stale LastUsedAt may get, so a busy key isn't written
+// on every request.
+const touchInterval = time.Minute
+
+var (
+	ErrNotFound   = errors.New("api key not found")
+	ErrInvalidKey = errors.New("invalid api key")
+)
+
+// Key is the server side of an API key, the key itself is only known by its
+// Hash, see Hash.
+type Key struct {
+	Id     string `json:"id"`
+	UserId string `json:"user_id"`
+	Name   string `json:"name"`
+	// Hint is the start of the key, to tell keys apart.
+	Hint   string            `json:"hint"`
+	Hash   string            `json:"-"`
+	Scopes []rbac.Permission `json:"scopes"`
+	// SecondFactor is set when the key was created by a user who gave a
+	// one-time code at login.
+	SecondFactor bool       `json:"second_factor,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Store keeps the keys by id, and finds them by hash.
+type Store interface {
+	Create(k Key) error
+	// GetByHash returns ErrNotFound when no key has the hash.
+	GetByHash(hash string) (Key, error)
+	// List returns the keys of the user, oldest first.
+	List(userId string) ([]Key, error)
+	// Delete removes the key of the user, ErrNotFound when it has none with
+	// the id.
+	Delete(userId, id string) error
+	// DeleteUser removes all the keys of the user.
+	DeleteUser(userId string) error
+	// Touch sets when the key was last used.
+	Touch(id string, at time.Time) error
+}
+
+// Hash is how a key is stored, keys are random enough not to need a slow
+// hash.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Manager creates the keys and checks them.
+type Manager struct {
+	store Store
+}
+
+func NewManager(store Store) *Manager {
+	return &Manager{store: store}
+}
+
+// Create makes a new key for the user and returns it along with what is
+// stored of it. The key is only known this once.
+func (m *Manager) Create(k Key, now time.Time) (string, Key, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Key{}, err
+	}
+	key := Prefix + base64.RawURLEncoding.EncodeToString(b)
+
+	k.Id = uuid.New().String()
+	k.Hint = key[:len(Prefix)+6]
+	k.Hash = Hash(key)
+	k.CreatedAt = now.UTC()
+	k.ExpiresAt = k.ExpiresAt.UTC()
+	k.LastUsedAt = nil
+
+	return key, k, m.store.Create(k)
+}
+
+// Authenticate returns the key, ErrInvalidKey when it's unknown or expired at
+// now, and records it was used.
+func (m *Manager) Authenticate(key string, now time.Time) (Key, error) {
+	if !strings.HasPrefix(key, Prefix) {
+		return Key{}, ErrInvalidKey
+	}
+
+	k, err := m.store.GetByHash(Hash(key))
+	if errors.Is(err, ErrNotFound) {
+		return Key{}, ErrInvalidKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	if !now.Before(k.ExpiresAt) {
+		return Key{}, ErrInvalidKey
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= touchInterval {
+		if err := m.store.Touch(k.Id, now.UTC()); err != nil {
+			return Key{}, err
+		}
+	}
+	return k, nil
+}
+
+func (m *Manager) List(userId string) ([]Key, error) {
+	return m.store.List(userId)
+}
+
+// Revoke deletes the key of the user, it stops working at once.
+func (m *Manager) Revoke(userId, id string) error {
+	return m.store.Delete(userId, id)
+}
+
+// RevokeAll deletes all the keys of the user, e.g. once its password is reset.
+func (m *Manager) RevokeAll(userId string) error {
+	return m.store.DeleteUser(userId)
+}
+
+// Allows tells whether the key is scoped for the permission.
+func (k Key) Allows(p rbac.Permission) bool {
+	for _, s := range k.Scopes {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package apikey
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+	storage "users/internal/db"
+)
+
+const (
+	keyPrefix  = "key/"
+	hashPrefix = "hash/"
+)
+
+// KVStore keeps the keys in a storage.Store, under "key/{id}", and their ids
+// under "hash/{hash}".
+type KVStore struct {
+	store storage.Store
+}
+
+func NewKVStore(store storage.Store) *KVStore {
+	return &KVStore{store: store}
+}
+
+func (k *KVStore) Create(key Key) error {
+	b, _ := json.Marshal(stored(key))
+
+	return k.store.Update(func(tx storage.Tx) error {
+		tx.Set(keyPrefix+key.Id, b)
+		tx.Set(hashPrefix+key.Hash, []byte(key.Id))
+		return nil
+	})
+}
+
+func (k *KVStore) GetByHash(hash string) (Key, error) {
+	id, ok := k.store.Get(hashPrefix + hash)
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	return k.get(string(id))
+}
+
+func (k *KVStore) get(id string) (Key, error) {
+	b, ok := k.store.Get(keyPrefix + id)
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+
+	var s storedKey
+	err := json.Unmarshal(b, &s)
+	return s.key(), err
+}
+
+func (k *KVStore) List(userId string) ([]Key, error) {
+	res := []Key{}
+	var err error
+
+	k.store.Scan(func(key string, v []byte) bool {
+		if !strings.HasPrefix(key, keyPrefix) {
+			return true
+		}
+		var s storedKey
+		if err = json.Unmarshal(v, &s); err != nil {
+			return false
+		}
+		if s.UserId == userId {
+			res = append(res, s.key())
+		}
+		return true
+	})
+	slices.SortFunc(res, func(a, b Key) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return res, err
+}
+
+func (k *KVStore) Delete(userId, id string) error {
+	return k.store.Update(func(tx storage.Tx) error {
+		b, ok := tx.Get(keyPrefix + id)
+		if !ok {
+			return ErrNotFound
+		}
+		var s storedKey
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		if s.UserId != userId {
+			return ErrNotFound
+		}
+
+		tx.Delete(keyPrefix + id)
+		tx.Delete(hashPrefix + s.Hash)
+		return nil
+	})
+}
+
+func (k *KVStore) DeleteUser(userId string) error {
+	keys, err := k.List(userId)
+	if err != nil {
+		return err
+	}
+
+	return k.store.Update(func(tx storage.Tx) error {
+		for _, key := range keys {
+			tx.Delete(keyPrefix + key.Id)
+			tx.Delete(hashPrefix + key.Hash)
+		}
+		return nil
+	})
+}
+
+// Store is the store the keys are kept in, see UserKeys.
+func (k *KVStore) Store() storage.Store {
+	return k.store
+}
+
+// UserKeys returns the storage keys of the API keys of the user and of their
+// hashes, for deleting them in a transaction spanning other stores.
+func (k *KVStore) UserKeys(userId string) []string {
+	keys, _ := k.List(userId)
+
+	var res []string
+	for _, key := range keys {
+		res = append(res, keyPrefix+key.Id, hashPrefix+key.Hash)
+	}
+	return res
+}
+
+func (k *KVStore) Touch(id string, at time.Time) error {
+	return k.store.Update(func(tx storage.Tx) error {
+		b, ok := tx.Get(keyPrefix + id)
+		if !ok {
+			return ErrNotFound
+		}
+		var s storedKey
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+
+		s.LastUsedAt = &at
+		b, _ = json.Marshal(s)
+		tx.Set(keyPrefix+id, b)
+		return nil
+	})
+}
+
+// storedKey is a Key along with its hash, which Key leaves out of its JSON.
+type storedKey struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+func stored(k Key) storedKey {
+	return storedKey{Key: k, Hash: k.Hash}
+}
+
+func (s storedKey) key() Key {
+	k := s.Key
+	k.Hash = s.Hash
+	return k
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Redacted stands for the values that are never written to the log, like
+// passwords.
+const Redacted = "[redacted]"
+
+// Entry is a mutation recorded in the log. Every entry is chained to the
+// previous one by its hash, so changing, removing or reordering entries breaks
+// the chain from that entry on.
+type Entry struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Actor    string            `json:"actor"`
+	Action   string            `json:"action"`
+	Target   string            `json:"target"`
+	Changes  map[string]Change `json:"changes,omitempty"`
+	IP       string            `json:"ip"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// Change of a field, From is empty for created fields and To for deleted ones.
+type Change struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// Log is an append-only audit log.
+type Log interface {
+	// Append chains the entry to the last one, numbers and hashes it.
+	Append(e Entry) (Entry, error)
+	// Scan calls fn for every entry in order until fn returns false.
+	Scan(fn func(e Entry) bool) error
+}
+
+// Filter selects entries of the log, zero fields match everything.
+type Filter struct {
+	Actor  string
+	Target string
+	Action string
+	From   time.Time // inclusive
+	To     time.Time // exclusive
+	After  uint64    // entries with a greater Seq only
+	Limit  int
+}
+
+func (f Filter) Match(e Entry) bool {
+	return e.Seq > f.After &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || e.Time.Before(f.To))
+}
+
+// List returns the entries of the log matching the filter, in order.
+func List(log Log, f Filter) ([]Entry, error) {
+	res := []Entry{}
+
+	err := log.Scan(func(e Entry) bool {
+		if f.Match(e) {
+			res = append(res, e)
+		}
+		return f.Limit == 0 || len(res) < f.Limit
+	})
+
+	return res, err
+}
+
+// Seal chains the entry to prev, the last entry of the log or the zero Entry
+// for the first one, and hashes it.
+func Seal(e Entry, prev Entry) Entry {
+	e.Seq = prev.Seq + 1
+	e.PrevHash = prev.Hash
+	e.Time = e.Time.UTC()
+	e.Hash = e.ComputeHash()
+	return e
+}
+
+// ComputeHash is the hash of the entry, the previous hash included, as it
+// should be stored in Hash.
+func (e Entry) ComputeHash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// TamperError points at the first entry where the chain is broken.
+type TamperError struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *TamperError) Error() string {
+	return fmt.Sprintf("audit log tampered at entry %d: %s", e.Seq, e.Reason)
+}
+
+// Verify walks the whole chain and returns the number of entries checked. A
+// broken chain is reported as a TamperError.
+func Verify(log Log) (int, error) {
+	var (
+		prev Entry
+		n    int
+		err  error
+	)
+
+	scanErr := log.Scan(func(e Entry) bool {
+		switch {
+		case e.Seq != prev.Seq+1:
+			err = &TamperError{Seq: e.Seq, Reason: fmt.Sprintf("follows entry %d", prev.Seq)}
+		case e.PrevHash != prev.Hash:
+			err = &TamperError{Seq: e.Seq, Reason: "previous hash doesn't match"}
+		case e.Hash != e.ComputeHash():
+			err = &TamperError{Seq: e.Seq, Reason: "hash doesn't match the content"}
+		}
+		if err != nil {
+			return false
+		}
+
+		prev = e
+		n++
+		return true
+	})
+	if scanErr != nil {
+		return n, scanErr
+	}
+
+	return n, err
+}
+
+// Diff lists the fields that differ between before and after, either of them
+// nil for a created or deleted target.
+func Diff(before, after map[string]string) map[string]Change {
+	changes := make(map[string]Change)
+
+	for field, from := range before {
+		if to := after[field]; to != from {
+			changes[field] = Change{From: from, To: to}
+		}
+	}
+	for field, to := range after {
+		if _, ok := before[field]; !ok && to != "" {
+			changes[field] = Change{To: to}
+		}
+	}
+
+	return changes
+}
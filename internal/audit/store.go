@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	storage "users/internal/db"
+)
+
+// StoreLog keeps the log in a storage.Store, one pair per entry keyed by its
+// zero-padded Seq. Appends are serialized by the lock of the store.
+type StoreLog struct {
+	store storage.Store
+
+	mu   sync.Mutex
+	last uint64 // Seq of the last entry appended, a hint for lastIn
+}
+
+func NewStoreLog(store storage.Store) *StoreLog {
+	l := &StoreLog{store: store}
+
+	store.ScanFrom(0, func(_ uint64, _ string, v []byte) bool {
+		var e Entry
+		if json.Unmarshal(v, &e) == nil && e.Seq > l.last {
+			l.last = e.Seq
+		}
+		return true
+	})
+
+	return l
+}
+
+func storeKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func (l *StoreLog) Append(e Entry) (Entry, error) {
+	err := l.store.Update(func(tx storage.Tx) error {
+		var err error
+		e, err = l.AppendTx(tx, e)
+		return err
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return e, nil
+}
+
+// AppendTx is Append inside a transaction over the store of the log, so the
+// entry is committed or discarded along with the change it records.
+func (l *StoreLog) AppendTx(tx storage.Tx, e Entry) (Entry, error) {
+	prev, err := l.lastIn(tx)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e = Seal(e, prev)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	tx.Set(storeKey(e.Seq), b)
+
+	l.mu.Lock()
+	l.last = e.Seq
+	l.mu.Unlock()
+
+	return e, nil
+}
+
+// lastIn reads the last entry in the transaction. The hint may be behind a
+// commit made meanwhile or ahead of a rolled back append, so it's only where
+// the search starts.
+func (l *StoreLog) lastIn(tx storage.Tx) (Entry, error) {
+	l.mu.Lock()
+	seq := l.last
+	l.mu.Unlock()
+
+	for seq > 0 {
+		if _, ok := tx.Get(storeKey(seq)); ok {
+			break
+		}
+		seq--
+	}
+	for {
+		if _, ok := tx.Get(storeKey(seq + 1)); !ok {
+			break
+		}
+		seq++
+	}
+	if seq == 0 {
+		return Entry{}, nil
+	}
+
+	b, _ := tx.Get(storeKey(seq))
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Entry{}, fmt.Errorf("audit entry %d: %w", seq, err)
+	}
+	return e, nil
+}
+
+// Store is the store the log is kept in, for the transactions of AppendTx.
+func (l *StoreLog) Store() storage.Store {
+	return l.store
+}
+
+func (l *StoreLog) Scan(fn func(e Entry) bool) error {
+	var err error
+
+	l.store.ScanFrom(0, func(_ uint64, key string, v []byte) bool {
+		var e Entry
+		if err = json.Unmarshal(v, &e); err != nil {
+			err = fmt.Errorf("audit entry %s: %w", key, err)
+			return false
+		}
+		return fn(e)
+	})
+
+	return err
+}
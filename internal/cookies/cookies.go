@@ -30,7 +30,17 @@ func WriteSigned(w http.ResponseWriter, r *http.Request, cookie *http.Cookie, se
 func ReadSigned(r *http.Request, name string, secretKey []byte) (string, error) {
 	// Read in the signed value from the cookie. This should be in the format
 	// "{signature}{original value}".
-	signedValue, err := Read(r, name)
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+
+	return verify(name, cookie.Value, secretKey)
+}
+
+// verify decodes the raw value of a signed cookie and checks its signature.
+func verify(name, raw string, secretKey []byte) (string, error) {
+	signedValue, err := decode(raw)
 	if err != nil {
 		return "", err
 	}
@@ -65,6 +75,15 @@ func ReadSigned(r *http.Request, name string, secretKey []byte) (string, error)
 	return value, nil
 }
 
+// decode decodes the raw value of a cookie written by Write.
+func decode(raw string) (string, error) {
+	value, err := base64.URLEncoding.DecodeString(raw)
+	if err != nil {
+		return "", ErrInvalidValue
+	}
+	return string(value), nil
+}
+
 func Write(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) error {
 	// Encode the cookie value using base64.
 	cookie.Value = base64.URLEncoding.EncodeToString([]byte(cookie.Value))
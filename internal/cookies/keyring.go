@@ -0,0 +1,102 @@
+package cookies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Keyring holds the AES keys cookies are encrypted with, by key id. The
+// Primary key encrypts the new cookies, the other ones only decrypt the
+// cookies written before the primary key was rotated.
+type Keyring struct {
+	Primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring builds a keyring from hex AES-128, AES-192 or AES-256 keys by id.
+func NewKeyring(primary string, keys map[string]string) (*Keyring, error) {
+	k := &Keyring{Primary: primary, aeads: make(map[string]cipher.AEAD)}
+
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid cookie key id %q", id)
+		}
+
+		b, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(b)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %q: %w", id, err)
+		}
+		k.aeads[id] = aead
+	}
+
+	if _, ok := k.aeads[primary]; !ok {
+		return nil, fmt.Errorf("no cookie key %q for the primary key", primary)
+	}
+
+	return k, nil
+}
+
+// WriteEncrypted encrypts the cookie value with the primary key, so the
+// client can neither read nor change it. The value is stored as
+// "{key id}:{nonce}{ciphertext}", the name is authenticated along.
+func WriteEncrypted(w http.ResponseWriter, r *http.Request, cookie *http.Cookie, keyring *Keyring) error {
+	aead := keyring.aeads[keyring.Primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(cookie.Value), []byte(cookie.Name))
+	cookie.Value = keyring.Primary + ":" + string(sealed)
+
+	return Write(w, r, cookie)
+}
+
+// ReadEncrypted decrypts the value of a cookie written by WriteEncrypted with
+// any key of the keyring.
+func ReadEncrypted(r *http.Request, name string, keyring *Keyring) (string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+
+	return decrypt(name, cookie.Value, keyring)
+}
+
+func decrypt(name, raw string, keyring *Keyring) (string, error) {
+	value, err := decode(raw)
+	if err != nil {
+		return "", err
+	}
+
+	id, sealed, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", ErrInvalidValue
+	}
+	aead, ok := keyring.aeads[id]
+	if !ok || len(sealed) < aead.NonceSize() {
+		return "", ErrInvalidValue
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, []byte(nonce), []byte(ciphertext), []byte(name))
+	if err != nil {
+		return "", ErrInvalidValue
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrNoIndex = errors.New("no such index")
+
+// IndexFunc extracts the term a value is indexed by. Values for which ok is
+// false are left out of the index. Terms are compared as strings, so they
+// have to be encoded to sort in the wanted order.
+type IndexFunc func(key string, value []byte) (term string, ok bool)
+
+// IndexPos is a position in an index. Entries with equal terms are ordered by
+// the sequence numbers of their keys.
+type IndexPos struct {
+	Term string
+	Seq  uint64
+}
+
+func (p IndexPos) Less(o IndexPos) bool {
+	if p.Term != o.Term {
+		return p.Term < o.Term
+	}
+	return p.Seq < o.Seq
+}
+
+// IndexRange bounds a scan of an index. Zero values leave the scan unbounded.
+type IndexRange struct {
+	Prefix string    // only terms with the prefix
+	From   string    // terms >= From
+	To     string    // terms < To
+	After  *IndexPos // resume strictly after the position, in scan order
+	Desc   bool
+}
+
+type index struct {
+	fn      IndexFunc
+	entries []indexEntry // sorted by position
+	terms   map[string]string
+}
+
+type indexEntry struct {
+	pos IndexPos
+	key string
+}
+
+// CreateIndex builds a secondary index over the current contents of the store
+// and keeps it up to date with every commit. Indexes live in memory only, so
+// they are created again at every start.
+func (i *InMemoryStorage) CreateIndex(name string, fn IndexFunc) {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.indexes == nil {
+		i.indexes = make(map[string]*index)
+	}
+	i.indexes[name] = i.buildIndex(fn)
+}
+
+// rebuildIndexes indexes the whole store again after its contents were
+// replaced. The caller holds the lock.
+func (i *InMemoryStorage) rebuildIndexes() {
+	for name, idx := range i.indexes {
+		i.indexes[name] = i.buildIndex(idx.fn)
+	}
+}
+
+func (i *InMemoryStorage) buildIndex(fn IndexFunc) *index {
+	idx := &index{fn: fn, terms: make(map[string]string)}
+	for _, item := range i.order {
+		idx.add(item.key, item.seq, i.Storage[item.key])
+	}
+	return idx
+}
+
+func (i *InMemoryStorage) ScanIndex(name string, r IndexRange, fn func(pos IndexPos, key string, value []byte) bool) error {
+	i.RLock()
+	defer i.RUnlock()
+
+	idx, ok := i.indexes[name]
+	if !ok {
+		return ErrNoIndex
+	}
+	entries := idx.entries
+
+	// The range is narrowed down to entries[lo:hi] by binary searches, all the
+	// bounds are monotonic over the sorted entries.
+	from := max(r.From, r.Prefix)
+	lo := sort.Search(len(entries), func(n int) bool { return entries[n].pos.Term >= from })
+	hi := len(entries)
+
+	if r.To != "" {
+		hi = min(hi, sort.Search(len(entries), func(n int) bool { return entries[n].pos.Term >= r.To }))
+	}
+	if r.Prefix != "" {
+		hi = min(hi, sort.Search(len(entries), func(n int) bool {
+			term := entries[n].pos.Term
+			return term > r.Prefix && !strings.HasPrefix(term, r.Prefix)
+		}))
+	}
+	if r.After != nil {
+		if r.Desc {
+			hi = min(hi, sort.Search(len(entries), func(n int) bool { return !entries[n].pos.Less(*r.After) }))
+		} else {
+			lo = max(lo, sort.Search(len(entries), func(n int) bool { return r.After.Less(entries[n].pos) }))
+		}
+	}
+
+	if r.Desc {
+		for n := hi - 1; n >= lo; n-- {
+			if !fn(entries[n].pos, entries[n].key, i.Storage[entries[n].key]) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	for n := lo; n < hi; n++ {
+		if !fn(entries[n].pos, entries[n].key, i.Storage[entries[n].key]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// updateIndexes reindexes key after its value changed. The caller holds the
+// lock.
+func (i *InMemoryStorage) updateIndexes(key string, value []byte, deleted bool) {
+	for _, idx := range i.indexes {
+		idx.remove(key, i.seq[key])
+		if !deleted {
+			idx.add(key, i.seq[key], value)
+		}
+	}
+}
+
+func (idx *index) add(key string, seq uint64, value []byte) {
+	term, ok := idx.fn(key, value)
+	if !ok {
+		return
+	}
+
+	e := indexEntry{pos: IndexPos{Term: term, Seq: seq}, key: key}
+	n := sort.Search(len(idx.entries), func(n int) bool { return e.pos.Less(idx.entries[n].pos) })
+	idx.entries = append(idx.entries, indexEntry{})
+	copy(idx.entries[n+1:], idx.entries[n:])
+	idx.entries[n] = e
+
+	idx.terms[key] = term
+}
+
+func (idx *index) remove(key string, seq uint64) {
+	term, ok := idx.terms[key]
+	if !ok {
+		return
+	}
+	delete(idx.terms, key)
+
+	pos := IndexPos{Term: term, Seq: seq}
+	n := sort.Search(len(idx.entries), func(n int) bool { return !idx.entries[n].pos.Less(pos) })
+	if n < len(idx.entries) && idx.entries[n].key == key {
+		idx.entries = append(idx.entries[:n], idx.entries[n+1:]...)
+	}
+}
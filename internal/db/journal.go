@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	slogger "users/pkg/logger"
+)
+
+const (
+	logFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+var ErrJournalClosed = errors.New("journal is closed")
+
+// Journal is an append-only write-ahead log shared by the stores attached to
+// it. Every mutation is written and fsynced to the log before it is applied in
+// memory, and the whole state is periodically dumped into a snapshot so the
+// log doesn't grow forever. On open the snapshot is loaded and the log is
+// replayed on top of it.
+type Journal struct {
+	mu  sync.Mutex
+	dir string
+	log *os.File
+
+	stores    []*InMemoryStorage
+	recovered map[string]*InMemoryStorage
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// journalOp is a single mutation of one of the attached stores.
+type journalOp struct {
+	Store string `json:"store"`
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Seq   uint64 `json:"seq,omitempty"` // sequence number of a newly inserted key
+}
+
+// snapshotStore is the state of a store in the snapshot. Items are kept in
+// insertion order along with their sequence numbers.
+type snapshotStore struct {
+	LastSeq uint64         `json:"last_seq"`
+	Items   []snapshotItem `json:"items"`
+}
+
+type snapshotItem struct {
+	Seq   uint64 `json:"seq"`
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// journalEntry is one line of the log. All operations of an entry are
+// applied on replay or none of them are.
+type journalEntry struct {
+	Ops []journalOp `json:"ops"`
+}
+
+// OpenJournal recovers the state kept in dir and opens the log for appending.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{dir: dir, recovered: make(map[string]*InMemoryStorage)}
+
+	if err := j.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := j.replay(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.log = f
+
+	return j, nil
+}
+
+// Attach fills the store with the recovered state for name and makes every
+// following mutation of the store go through the journal. Stores must be
+// attached before the journal is used.
+func (j *Journal) Attach(name string, s *InMemoryStorage) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rec := j.recovered[name]
+	if rec == nil {
+		rec = NewInMemoryStorage()
+	}
+	delete(j.recovered, name)
+
+	s.Lock()
+	s.Storage, s.seq, s.order, s.lastSeq = rec.Storage, rec.seq, rec.order, rec.lastSeq
+	s.rebuildIndexes()
+	s.name = name
+	s.journal = j
+	s.Unlock()
+
+	j.stores = append(j.stores, s)
+}
+
+// SnapshotEvery starts a background loop that snapshots the journal every
+// interval until Close is called.
+func (j *Journal) SnapshotEvery(interval time.Duration) {
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+
+	go func() {
+		defer close(j.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.Snapshot(); err != nil {
+					slogger.Logger.Error("error while storage snapshot", "err", err)
+				}
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Snapshot writes the state of all attached stores to disk and truncates the
+// log.
+func (j *Journal) Snapshot() error {
+	// Stores are always locked before the journal, the same order as in Set
+	// and Delete.
+	for _, s := range j.stores {
+		s.RLock()
+		defer s.RUnlock()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.log == nil {
+		return ErrJournalClosed
+	}
+
+	state := make(map[string]snapshotStore, len(j.stores))
+	for _, s := range j.stores {
+		items := make([]snapshotItem, 0, len(s.order))
+		for _, item := range s.order {
+			items = append(items, snapshotItem{Seq: item.seq, Key: item.key, Value: s.Storage[item.key]})
+		}
+		state[s.name] = snapshotStore{LastSeq: s.lastSeq, Items: items}
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(j.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(j.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(j.dir); err != nil {
+		return err
+	}
+
+	// A crash before the truncation is harmless: replaying the log over the
+	// new snapshot ends up in the same state, sequence numbers included as
+	// they are logged.
+	if err := j.log.Truncate(0); err != nil {
+		return err
+	}
+	_, err = j.log.Seek(0, io.SeekStart)
+	return err
+}
+
+// Close stops the snapshot loop, takes a final snapshot and closes the log,
+// even when the snapshot fails.
+func (j *Journal) Close() error {
+	if j.stop != nil {
+		close(j.stop)
+		<-j.done
+		j.stop = nil
+	}
+
+	snapshotErr := j.Snapshot()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.log == nil {
+		return snapshotErr
+	}
+	err := j.log.Close()
+	j.log = nil
+	return errors.Join(snapshotErr, err)
+}
+
+// append durably writes the entry to the log. Callers hold the locks of the
+// stores the entry touches.
+func (j *Journal) append(entry journalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.log == nil {
+		return ErrJournalClosed
+	}
+	if _, err := j.log.Write(b); err != nil {
+		return err
+	}
+	return j.log.Sync()
+}
+
+func (j *Journal) loadSnapshot() error {
+	b, err := os.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state map[string]snapshotStore
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
+	for name, st := range state {
+		rec := NewInMemoryStorage()
+		for _, item := range st.Items {
+			rec.Storage[item.Key] = item.Value
+			rec.insert(item.Key, item.Seq)
+		}
+		rec.lastSeq = st.LastSeq
+		j.recovered[name] = rec
+	}
+
+	return nil
+}
+
+// replay applies the log on top of the snapshot. A torn last line, left by a
+// crash in the middle of a write, is cut off.
+func (j *Journal) replay(f *os.File) error {
+	reader := bufio.NewReader(f)
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			break
+		}
+		j.apply(entry)
+		offset += int64(len(line))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (j *Journal) apply(entry journalEntry) {
+	for _, op := range entry.Ops {
+		rec, ok := j.recovered[op.Store]
+		if !ok {
+			rec = NewInMemoryStorage()
+			j.recovered[op.Store] = rec
+		}
+		rec.apply([]journalOp{op})
+	}
+}
+
+func writeFileSync(name string, b []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -1,10 +1,33 @@
 package storage
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 type InMemoryStorage struct {
 	sync.RWMutex
 	Storage map[string][]byte
+
+	// Every key gets a sequence number when it's first set. order keeps the
+	// keys sorted by it, which is the insertion order ScanFrom walks.
+	seq     map[string]uint64
+	order   []orderItem
+	lastSeq uint64
+
+	indexes map[string]*index
+
+	name    string   // store name inside the journal
+	journal *Journal // nil for a purely in-memory store
+}
+
+type orderItem struct {
+	seq uint64
+	key string
+}
+
+func NewInMemoryStorage() *InMemoryStorage {
+	return &InMemoryStorage{Storage: make(map[string][]byte)}
 }
 
 func (i *InMemoryStorage) Get(key string) (value []byte, ok bool) {
@@ -15,24 +38,214 @@ func (i *InMemoryStorage) Get(key string) (value []byte, ok bool) {
 	return value, ok
 }
 
-func (i *InMemoryStorage) Set(key string, value []byte) {
-	i.Lock()
-	i.Storage[key] = value
-	i.Unlock()
+func (i *InMemoryStorage) Set(key string, value []byte) error {
+	return i.Update(func(tx Tx) error {
+		tx.Set(key, value)
+		return nil
+	})
 }
 
-func (i *InMemoryStorage) GetUsers() (users [][]byte) {
+func (i *InMemoryStorage) Delete(key string) error {
+	return i.Update(func(tx Tx) error {
+		tx.Delete(key)
+		return nil
+	})
+}
+
+func (i *InMemoryStorage) Scan(fn func(key string, value []byte) bool) {
 	i.RLock()
-	for _, v := range i.Storage {
-		users = append(users, v)
+	defer i.RUnlock()
+
+	for k, v := range i.Storage {
+		if !fn(k, v) {
+			return
+		}
 	}
-	i.RUnlock()
+}
+
+func (i *InMemoryStorage) ScanFrom(after uint64, fn func(seq uint64, key string, value []byte) bool) {
+	i.RLock()
+	defer i.RUnlock()
+
+	start := sort.Search(len(i.order), func(n int) bool { return i.order[n].seq > after })
+	for _, item := range i.order[start:] {
+		if !fn(item.seq, item.key, i.Storage[item.key]) {
+			return
+		}
+	}
+}
+
+func (i *InMemoryStorage) Update(fn func(tx Tx) error) error {
+	tx := i.Begin()
+	// releases the lock when fn fails or panics, no-op after Commit
+	defer tx.Rollback()
 
-	return users
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (i *InMemoryStorage) Delete(key string) {
+func (i *InMemoryStorage) Begin() Transaction {
 	i.Lock()
-	delete(i.Storage, key)
-	i.Unlock()
+	return &memoryTx{store: i, writes: make(map[string]int)}
+}
+
+// apply writes the operations to the map. The caller holds the lock.
+func (i *InMemoryStorage) apply(ops []journalOp) {
+	for _, op := range ops {
+		switch op.Op {
+		case opSet:
+			if _, ok := i.Storage[op.Key]; !ok {
+				seq := op.Seq
+				if seq == 0 {
+					seq = i.lastSeq + 1
+				}
+				i.insert(op.Key, seq)
+			}
+			i.Storage[op.Key] = op.Value
+			i.updateIndexes(op.Key, op.Value, false)
+		case opDelete:
+			if _, ok := i.Storage[op.Key]; ok {
+				i.updateIndexes(op.Key, nil, true)
+				i.remove(op.Key)
+			}
+			delete(i.Storage, op.Key)
+		}
+	}
+}
+
+// insert puts key at the end of the insertion order. seq must be greater than
+// any sequence number in use.
+func (i *InMemoryStorage) insert(key string, seq uint64) {
+	if i.seq == nil {
+		i.seq = make(map[string]uint64)
+	}
+	i.seq[key] = seq
+	i.order = append(i.order, orderItem{seq: seq, key: key})
+	i.lastSeq = max(i.lastSeq, seq)
+}
+
+// assignSeq numbers the keys the operations insert, so that the numbers are
+// logged and replay gives them back. The caller holds the lock.
+func (i *InMemoryStorage) assignSeq(ops []journalOp) {
+	next := i.lastSeq
+	for n, op := range ops {
+		if _, ok := i.Storage[op.Key]; op.Op == opSet && !ok {
+			next++
+			ops[n].Seq = next
+		}
+	}
+}
+
+func (i *InMemoryStorage) remove(key string) {
+	seq, ok := i.seq[key]
+	if !ok {
+		return
+	}
+	delete(i.seq, key)
+
+	n := sort.Search(len(i.order), func(n int) bool { return i.order[n].seq >= seq })
+	i.order = append(i.order[:n], i.order[n+1:]...)
+}
+
+// memoryTx buffers the writes of a transaction until commit. Only the last
+// write of each key is kept.
+type memoryTx struct {
+	store  *InMemoryStorage
+	ops    []journalOp
+	writes map[string]int // key -> index in ops
+	done   bool           // committed or rolled back, the lock is released
+}
+
+func (t *memoryTx) Get(key string) (value []byte, ok bool) {
+	if idx, ok := t.writes[key]; ok {
+		op := t.ops[idx]
+		return op.Value, op.Op == opSet
+	}
+	value, ok = t.store.Storage[key]
+	return value, ok
+}
+
+func (t *memoryTx) Set(key string, value []byte) {
+	t.write(journalOp{Store: t.store.name, Op: opSet, Key: key, Value: value})
+}
+
+func (t *memoryTx) Delete(key string) {
+	t.write(journalOp{Store: t.store.name, Op: opDelete, Key: key})
+}
+
+func (t *memoryTx) Commit() error {
+	return commitAll([]*memoryTx{t})
+}
+
+// Rollback discards the writes, it does nothing once the transaction is
+// committed or rolled back, as sql.Tx.
+func (t *memoryTx) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.store.Unlock()
+}
+
+func (t *memoryTx) write(op journalOp) {
+	if idx, ok := t.writes[op.Key]; ok {
+		t.ops[idx] = op
+		return
+	}
+	t.writes[op.Key] = len(t.ops)
+	t.ops = append(t.ops, op)
+}
+
+// sameJournal reports whether all the transactions are memoryTx whose stores
+// log to the same journal (or to none), so they can be committed as one entry.
+func sameJournal(transactions []Transaction) ([]*memoryTx, bool) {
+	memoryTxs := make([]*memoryTx, 0, len(transactions))
+
+	for _, t := range transactions {
+		mt, ok := t.(*memoryTx)
+		if !ok {
+			return nil, false
+		}
+		if len(memoryTxs) > 0 && mt.store.journal != memoryTxs[0].store.journal {
+			return nil, false
+		}
+		memoryTxs = append(memoryTxs, mt)
+	}
+
+	return memoryTxs, true
+}
+
+// commitAll logs the writes of all the transactions as a single journal entry,
+// applies them and releases the stores.
+func commitAll(txs []*memoryTx) error {
+	defer func() {
+		for _, t := range txs {
+			t.done = true
+			t.store.Unlock()
+		}
+	}()
+
+	var ops []journalOp
+	for _, t := range txs {
+		t.store.assignSeq(t.ops)
+		ops = append(ops, t.ops...)
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if journal := txs[0].store.journal; journal != nil {
+		if err := journal.append(journalEntry{Ops: ops}); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range txs {
+		t.store.apply(t.ops)
+	}
+
+	return nil
 }
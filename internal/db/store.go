@@ -0,0 +1,86 @@
+package storage
+
+// Store is the key-value store repositories are built on. InMemoryStorage is
+// the reference implementation, optionally made durable by a Journal.
+type Store interface {
+	Get(key string) (value []byte, ok bool)
+	Set(key string, value []byte) error
+	Delete(key string) error
+
+	// Scan calls fn for every pair of the store until fn returns false. The
+	// store is read-locked meanwhile, so fn must not write to it.
+	Scan(fn func(key string, value []byte) bool)
+
+	// ScanFrom calls fn in insertion order for the pairs inserted after the
+	// one with sequence number after, until fn returns false. Sequence numbers
+	// start at 1 and are never reused, so they can be handed out as cursors.
+	ScanFrom(after uint64, fn func(seq uint64, key string, value []byte) bool)
+
+	// CreateIndex builds a secondary index named name over the store, see
+	// IndexFunc. ScanIndex calls fn in index order for the entries of the
+	// index in range r until fn returns false.
+	CreateIndex(name string, fn IndexFunc)
+	ScanIndex(name string, r IndexRange, fn func(pos IndexPos, key string, value []byte) bool) error
+
+	// Update runs fn in a read-write transaction. The writes made through tx
+	// are applied all at once when fn returns nil and discarded otherwise.
+	Update(fn func(tx Tx) error) error
+
+	// Begin starts a transaction that keeps the store write-locked until it
+	// is committed or rolled back. Prefer Update and UpdateAll.
+	Begin() Transaction
+}
+
+// Tx is the view of a store inside a transaction. Reads see the writes made
+// earlier in the same transaction.
+type Tx interface {
+	Get(key string) (value []byte, ok bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+type Transaction interface {
+	Tx
+	Commit() error
+	Rollback()
+}
+
+// UpdateAll runs fn in a transaction spanning several stores: fn gets one Tx
+// per store, in the same order, and the writes to all the stores are applied
+// together when fn returns nil and discarded otherwise.
+//
+// The stores are locked in the given order, so every caller must pass them in
+// the same order. The commit is atomic on disk too when the stores share a
+// Journal.
+func UpdateAll(stores []Store, fn func(txs []Tx) error) error {
+	transactions := make([]Transaction, 0, len(stores))
+	txs := make([]Tx, 0, len(stores))
+
+	// releases the locks when fn fails or panics, no-op after Commit
+	defer func() {
+		for _, t := range transactions {
+			t.Rollback()
+		}
+	}()
+
+	for _, s := range stores {
+		t := s.Begin()
+		transactions = append(transactions, t)
+		txs = append(txs, t)
+	}
+
+	if err := fn(txs); err != nil {
+		return err
+	}
+
+	if memoryTxs, ok := sameJournal(transactions); ok {
+		return commitAll(memoryTxs)
+	}
+
+	for _, t := range transactions {
+		if err := t.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
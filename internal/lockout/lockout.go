@@ -0,0 +1,280 @@
+package lockout
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"users/internal/user/infrastructure/repository"
+	slogger "users/pkg/logger"
+	"users/pkg/purge"
+)
+
+const (
+	userPrefix = "user:"
+	ipPrefix   = "ip:"
+)
+
+// UserKey is the key the failed attempts for a username are tracked under,
+// the spellings of the same user share it, see repository.UsernameKey.
+func UserKey(username string) string {
+	return userPrefix + repository.UsernameKey(username)
+}
+
+// IPKey is the key the failed attempts from an IP are tracked under.
+func IPKey(ip string) string {
+	return ipPrefix + ip
+}
+
+// Policy is when failed attempts lock a username or an IP out, zero
+// thresholds turn their lockouts off.
+type Policy struct {
+	// Threshold is how many failures in a row lock a username out.
+	Threshold int
+	// IPThreshold is how many failures lock an IP out, whatever the usernames.
+	IPThreshold int
+	// BaseDelay is the first lockout, every further failure doubles it up to
+	// MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Window is how long the failures are remembered after the last one,
+	// once the lockout is over.
+	Window time.Duration
+}
+
+// Lockout is what is known of the failures of a username or an IP.
+type Lockout struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Guard tracks the failed attempts in memory, so they are forgotten on
+// restart and not shared between instances.
+type Guard struct {
+	policy  Policy
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func NewGuard(p Policy) *Guard {
+	return &Guard{policy: p, entries: make(map[string]*entry)}
+}
+
+// Locked returns how long the username or the IP is still locked out at now,
+// the longest of both, 0 when neither is.
+func (g *Guard) Locked(username, ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return max(g.remaining(UserKey(username), now), g.remaining(IPKey(ip), now))
+}
+
+// Begin lets an attempt of the username from the IP through unless either is
+// locked out at now, retryAfter is how long then. The attempt counts as failed
+// from the start, under the same lock as the check, so attempts made in
+// parallel can't get past the thresholds; Succeed or Release takes it back.
+func (g *Guard) Begin(username, ip string, now time.Time) (a *Attempt, retryAfter time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if retryAfter := max(g.remaining(UserKey(username), now), g.remaining(IPKey(ip), now)); retryAfter > 0 {
+		return nil, retryAfter
+	}
+
+	a = &Attempt{g: g, username: username, thresholds: make(map[string]int)}
+	for key, threshold := range map[string]int{UserKey(username): g.policy.Threshold, IPKey(ip): g.policy.IPThreshold} {
+		if threshold <= 0 {
+			continue
+		}
+		a.thresholds[key] = threshold
+		a.lockout = max(a.lockout, g.fail(key, threshold, now))
+	}
+	return a, 0
+}
+
+// Attempt is an attempt Begin let through. It isn't safe for concurrent use.
+type Attempt struct {
+	g          *Guard
+	username   string
+	thresholds map[string]int // of the keys the attempt counts under
+	lockout    time.Duration  // the lockout the attempt starts if it fails
+	done       bool
+}
+
+// Fail settles the attempt as failed and returns the lockout it starts, 0 when
+// none.
+func (a *Attempt) Fail() time.Duration {
+	a.done = true
+	return a.lockout
+}
+
+// Succeed takes the attempt back and forgets the failures of the username,
+// see Guard.Succeed.
+func (a *Attempt) Succeed() {
+	a.g.mu.Lock()
+	defer a.g.mu.Unlock()
+
+	a.release()
+	delete(a.g.entries, UserKey(a.username))
+}
+
+// Release takes the attempt back as if it wasn't made, e.g. when the password
+// was right but the one-time code is missing. It does nothing once the attempt
+// is settled, so it may be deferred.
+func (a *Attempt) Release() {
+	a.g.mu.Lock()
+	defer a.g.mu.Unlock()
+
+	a.release()
+}
+
+func (a *Attempt) release() {
+	if a.done {
+		return
+	}
+	a.done = true
+
+	for key, threshold := range a.thresholds {
+		e, ok := a.g.entries[key]
+		if !ok {
+			continue
+		}
+		e.failures--
+		// a lockout the other failures don't earn was the attempt's doing
+		if e.failures < threshold {
+			e.lockedUntil = time.Time{}
+		}
+		if e.failures <= 0 {
+			delete(a.g.entries, key)
+		}
+	}
+}
+
+// Fail records a failed attempt of the username from the IP and returns the
+// lockout it starts, 0 when none.
+func (g *Guard) Fail(username, ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	locked := g.fail(UserKey(username), g.policy.Threshold, now)
+	return max(locked, g.fail(IPKey(ip), g.policy.IPThreshold, now))
+}
+
+// Succeed forgets the failures of the username. The ones of the IP are kept,
+// or one valid account would let an IP try any number of others.
+func (g *Guard) Succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.entries, UserKey(username))
+}
+
+// List returns the usernames and IPs with failures remembered at now, by key.
+func (g *Guard) List(now time.Time) []Lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	res := []Lockout{}
+	for key, e := range g.entries {
+		if g.expired(e, now) {
+			continue
+		}
+		l := Lockout{Key: key, Failures: e.failures, LastFailure: e.lastFailure}
+		if now.Before(e.lockedUntil) {
+			until := e.lockedUntil
+			l.LockedUntil = &until
+		}
+		res = append(res, l)
+	}
+	slices.SortFunc(res, func(a, b Lockout) int { return strings.Compare(a.Key, b.Key) })
+
+	return res
+}
+
+// Clear forgets the failures under the key, see UserKey and IPKey, and tells
+// whether there were any.
+func (g *Guard) Clear(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.entries[key]
+	delete(g.entries, key)
+	return ok
+}
+
+// Purge forgets the failures expired at now and returns how many keys it
+// dropped.
+func (g *Guard) Purge(now time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := 0
+	for key, e := range g.entries {
+		if g.expired(e, now) {
+			delete(g.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (g *Guard) remaining(key string, now time.Time) time.Duration {
+	e, ok := g.entries[key]
+	if !ok || !now.Before(e.lockedUntil) {
+		return 0
+	}
+	return e.lockedUntil.Sub(now)
+}
+
+func (g *Guard) fail(key string, threshold int, now time.Time) time.Duration {
+	if threshold <= 0 {
+		return 0
+	}
+
+	e, ok := g.entries[key]
+	if !ok || g.expired(e, now) {
+		e = &entry{}
+		g.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	if e.failures < threshold {
+		return 0
+	}
+
+	delay := g.policy.BaseDelay
+	for i := threshold; i < e.failures && delay < g.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if g.policy.MaxDelay > 0 {
+		delay = min(delay, g.policy.MaxDelay)
+	}
+	e.lockedUntil = now.Add(delay)
+
+	slogger.Logger.Warn("locked out", "key", key, "failures", e.failures, "until", e.lockedUntil)
+	return delay
+}
+
+// expired tells whether the failures are over with at now: the lockout, if
+// any, is over and so is the window since the last failure.
+func (g *Guard) expired(e *entry, now time.Time) bool {
+	return !now.Before(e.lockedUntil) && now.Sub(e.lastFailure) >= g.policy.Window
+}
+
+// PurgeEvery starts a background loop that forgets the expired failures every
+// interval. The returned func stops it.
+func PurgeEvery(g *Guard, interval time.Duration) (stop func()) {
+	return purge.Every(interval, "expired lockouts", func(now time.Time) (int, error) {
+		return g.Purge(now), nil
+	})
+}
@@ -0,0 +1,137 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("line break in mail header")
+
+// Message is a plain text mail.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the mails.
+type Mailer interface {
+	Send(m Message) error
+}
+
+// format renders the message as sent, with CRLF line endings.
+func format(from string, m Message, now time.Time) ([]byte, error) {
+	for _, h := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return b.Bytes(), nil
+}
+
+// SMTP sends the mails through an SMTP server, over STARTTLS when the server
+// offers it. There's no authentication without a username.
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTP(host string, port int, username, password, from string) *SMTP {
+	s := &SMTP{addr: net.JoinHostPort(host, strconv.Itoa(port)), from: from}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s *SMTP) Send(m Message) error {
+	b, err := format(s.from, m, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, b)
+}
+
+// Outbox keeps the mails in memory instead of sending them, for local
+// testing.
+type Outbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+func (o *Outbox) Send(m Message) error {
+	if _, err := format("", m, time.Now()); err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+// Messages returns the mails sent so far, oldest first.
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]Message(nil), o.messages...)
+}
+
+// FileOutbox writes the mails to .eml files of a directory instead of sending
+// them, for local testing.
+type FileOutbox struct {
+	dir  string
+	from string
+}
+
+func NewFileOutbox(dir, from string) *FileOutbox {
+	return &FileOutbox{dir: dir, from: from}
+}
+
+func (f *FileOutbox) Send(m Message) error {
+	now := time.Now()
+	b, err := format(f.from, m, now)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(f.dir, name), b, 0o600)
+}
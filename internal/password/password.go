@@ -0,0 +1,165 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash")
+
+// Policy is how new passwords are hashed. The zero values of the parameters
+// are the defaults, see WithDefaults.
+type Policy struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// Argon2Params are the argon2id parameters, Memory in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// WithDefaults fills in the unset parameters, argon2id with the parameters
+// OWASP recommends being the default.
+func (p Policy) WithDefaults() Policy {
+	if p.Algorithm == "" {
+		p.Algorithm = Argon2id
+	}
+	if p.BcryptCost == 0 {
+		p.BcryptCost = bcrypt.DefaultCost
+	}
+	if p.Argon2.Time == 0 {
+		p.Argon2.Time = 2
+	}
+	if p.Argon2.Memory == 0 {
+		p.Argon2.Memory = 19 * 1024
+	}
+	if p.Argon2.Threads == 0 {
+		p.Argon2.Threads = 1
+	}
+	if p.Argon2.KeyLen == 0 {
+		p.Argon2.KeyLen = 32
+	}
+	if p.Argon2.SaltLen == 0 {
+		p.Argon2.SaltLen = 16
+	}
+	return p
+}
+
+// Hash hashes the password following the policy. The hash tells how it was
+// made: "$argon2id$v=19$m=...,t=...,p=...$salt$key" for argon2id, the usual
+// "$2a$..." for bcrypt.
+func Hash(password string, p Policy) (string, error) {
+	p = p.WithDefaults()
+
+	switch p.Algorithm {
+	case Argon2id:
+		salt := make([]byte, p.Argon2.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Argon2.Time, p.Argon2.Memory, p.Argon2.Threads, p.Argon2.KeyLen)
+		return encodeArgon2(p.Argon2, salt, key), nil
+
+	case Bcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		return string(b), err
+
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+}
+
+// Verify tells whether the password matches the hash, whatever policy the
+// hash was made with.
+func Verify(password, hash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$"+Argon2id+"$"):
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// NeedsRehash tells whether the hash was made with another algorithm or other
+// parameters than the policy says.
+func NeedsRehash(hash string, p Policy) bool {
+	p = p.WithDefaults()
+
+	switch p.Algorithm {
+	case Argon2id:
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return true
+		}
+		return params.Time != p.Argon2.Time || params.Memory != p.Argon2.Memory || params.Threads != p.Argon2.Threads ||
+			uint32(len(key)) != p.Argon2.KeyLen || uint32(len(salt)) != p.Argon2.SaltLen
+
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != p.BcryptCost
+
+	default:
+		return false
+	}
+}
+
+func encodeArgon2(p Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2(hash string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	p.KeyLen, p.SaltLen = uint32(len(key)), uint32(len(salt))
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,188 @@
+package password
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules are what a password must be like to be accepted, zero values turn
+// their check off.
+type Rules struct {
+	MinLength int
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and symbols the password must mix.
+	MinClasses int
+	// MinEntropy is the least Entropy of the password, in bits.
+	MinEntropy float64
+	// ForbidPersonal refuses passwords containing the username or the email.
+	ForbidPersonal bool
+	Blocklist      *Blocklist
+}
+
+// Check returns what is wrong with the password, nothing when it's fine. The
+// personal strings, like the username and the email, must not be part of it.
+func (r Rules) Check(password string, personal ...string) []string {
+	var problems []string
+
+	length := utf8.RuneCountInString(password)
+	if r.MinLength > 0 && length < r.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", r.MinLength))
+	}
+	if r.MaxLength > 0 && length > r.MaxLength {
+		problems = append(problems, fmt.Sprintf("must be at most %d characters long", r.MaxLength))
+	}
+	if r.MinClasses > 0 && classes(password) < r.MinClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", r.MinClasses))
+	}
+	if r.MinEntropy > 0 && Entropy(password) < r.MinEntropy {
+		problems = append(problems, "is too easy to guess")
+	}
+
+	if r.ForbidPersonal {
+		lower := strings.ToLower(password)
+		for _, s := range personal {
+			// the local part of an email is what is likely to be reused
+			s, _, _ = strings.Cut(strings.ToLower(s), "@")
+			if utf8.RuneCountInString(s) >= 3 && strings.Contains(lower, s) {
+				problems = append(problems, "must not contain the username or email")
+				break
+			}
+		}
+	}
+
+	if r.Blocklist.Contains(password) {
+		problems = append(problems, "is a known breached password")
+	}
+
+	return problems
+}
+
+const (
+	lower = 1 << iota
+	upper
+	digit
+	symbol
+	other
+)
+
+func charClass(c rune) int {
+	switch {
+	case c < utf8.RuneSelf && unicode.IsLower(c):
+		return lower
+	case c < utf8.RuneSelf && unicode.IsUpper(c):
+		return upper
+	case unicode.IsDigit(c):
+		return digit
+	case c < utf8.RuneSelf:
+		return symbol
+	case unicode.IsLetter(c):
+		return other
+	default:
+		return symbol
+	}
+}
+
+// classes counts the character classes of the password, letters beyond ASCII
+// count as lowercase or uppercase ones.
+func classes(password string) int {
+	seen := 0
+	for _, c := range password {
+		class := charClass(c)
+		if class == other {
+			class = lower
+			if unicode.IsUpper(c) {
+				class = upper
+			}
+		}
+		seen |= class
+	}
+
+	n := 0
+	for ; seen != 0; seen &= seen - 1 {
+		n++
+	}
+	return n
+}
+
+// poolSizes are how many characters each class is guessed among.
+var poolSizes = map[int]float64{lower: 26, upper: 26, digit: 10, symbol: 33, other: 100}
+
+// Entropy roughly estimates how many bits guessing the password takes: its
+// length times the bits of a character drawn from the classes it uses.
+// Characters repeating the previous one or following it in a sequence, as in
+// "aaaa" or "1234", don't count.
+func Entropy(password string) float64 {
+	seen := 0
+	length := 0
+	var prev rune = -1
+	for _, c := range password {
+		seen |= charClass(c)
+		if d := c - prev; d < -1 || d > 1 {
+			length++
+		}
+		prev = c
+	}
+
+	pool := 0.0
+	for class, size := range poolSizes {
+		if seen&class != 0 {
+			pool += size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(pool)
+}
+
+// Blocklist holds known breached passwords, compared case-insensitively.
+type Blocklist struct {
+	passwords map[string]struct{}
+}
+
+// LoadBlocklist reads a file of one password per line, blank lines and lines
+// starting with # are skipped.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &Blocklist{passwords: make(map[string]struct{})}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b.passwords[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return b, nil
+}
+
+func (b *Blocklist) Contains(password string) bool {
+	if b == nil {
+		return false
+	}
+	_, ok := b.passwords[strings.ToLower(password)]
+	return ok
+}
+
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.passwords)
+}
@@ -0,0 +1,141 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+type Permission string
+
+const (
+	UsersRead      Permission = "users:read"
+	UsersWrite     Permission = "users:write"
+	UsersDelete    Permission = "users:delete"
+	AuditRead      Permission = "audit:read"
+	RolesManage    Permission = "roles:manage"
+	LockoutsManage Permission = "lockouts:manage"
+)
+
+// Permissions are all the permissions there are.
+var Permissions = []Permission{UsersRead, UsersWrite, UsersDelete, AuditRead, RolesManage, LockoutsManage}
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrRoleExists   = errors.New("role already exists")
+	// ErrBuiltinRole is returned when changing or assigning a builtin role,
+	// they follow the admin flag of the users instead.
+	ErrBuiltinRole = errors.New("builtin role")
+)
+
+// Role is a named set of permissions.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+	Builtin     bool         `json:"builtin,omitempty"`
+}
+
+// The builtin roles: every user has User, the admins have Admin too.
+var (
+	Admin = Role{Name: "admin", Permissions: Permissions, Builtin: true}
+	User  = Role{Name: "user", Permissions: []Permission{UsersRead}, Builtin: true}
+)
+
+func IsBuiltin(name string) bool {
+	return name == Admin.Name || name == User.Name
+}
+
+// Validate checks the permissions are known and sorts them.
+func (r *Role) Validate() error {
+	if IsBuiltin(r.Name) {
+		return ErrBuiltinRole
+	}
+
+	for _, p := range r.Permissions {
+		if !slices.Contains(Permissions, p) {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+	sort.Slice(r.Permissions, func(i, j int) bool { return r.Permissions[i] < r.Permissions[j] })
+	r.Permissions = slices.Compact(r.Permissions)
+
+	return nil
+}
+
+// Store keeps the custom roles and the roles assigned to the users.
+type Store interface {
+	GetRole(name string) (Role, error)
+	ListRoles() ([]Role, error)
+	// CreateRole fails with ErrRoleExists, UpdateRole with ErrRoleNotFound.
+	CreateRole(role Role) error
+	UpdateRole(role Role) error
+	// DeleteRole takes the role away from the users it was assigned to.
+	DeleteRole(name string) error
+
+	UserRoles(userId string) ([]string, error)
+	// SetUserRoles replaces the roles of the user, they must exist.
+	SetUserRoles(userId string, roles []string) error
+}
+
+// Authorizer resolves the permissions of the users.
+type Authorizer struct {
+	store Store
+}
+
+func NewAuthorizer(store Store) *Authorizer {
+	return &Authorizer{store: store}
+}
+
+// Roles lists the roles of a user, the builtin ones first.
+func (a *Authorizer) Roles(userId string, admin bool) ([]Role, error) {
+	roles := []Role{User}
+	if admin {
+		roles = append(roles, Admin)
+	}
+	if userId == "" {
+		return roles, nil
+	}
+
+	names, err := a.store.UserRoles(userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		role, err := a.store.GetRole(name)
+		if errors.Is(err, ErrRoleNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+// Permissions returns the sorted permissions of a user through all its roles.
+func (a *Authorizer) Permissions(userId string, admin bool) ([]Permission, error) {
+	roles, err := a.Roles(userId, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Permission
+	for _, role := range roles {
+		res = append(res, role.Permissions...)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	return slices.Compact(res), nil
+}
+
+// Can tells whether the user has the permission.
+func (a *Authorizer) Can(userId string, admin bool, p Permission) (bool, error) {
+	permissions, err := a.Permissions(userId, admin)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(permissions, p), nil
+}
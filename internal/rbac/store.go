@@ -0,0 +1,150 @@
+package rbac
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	storage "users/internal/db"
+)
+
+const (
+	rolePrefix = "role/"
+	userPrefix = "user/"
+)
+
+// KVStore keeps the roles in a storage.Store, under "role/{name}", and the
+// roles of the users under "user/{id}".
+type KVStore struct {
+	store storage.Store
+}
+
+func NewKVStore(store storage.Store) *KVStore {
+	return &KVStore{store: store}
+}
+
+func (k *KVStore) GetRole(name string) (Role, error) {
+	b, ok := k.store.Get(rolePrefix + name)
+	if !ok {
+		return Role{}, ErrRoleNotFound
+	}
+
+	var role Role
+	err := json.Unmarshal(b, &role)
+	return role, err
+}
+
+func (k *KVStore) ListRoles() ([]Role, error) {
+	res := []Role{}
+	var err error
+
+	k.store.Scan(func(key string, v []byte) bool {
+		if !strings.HasPrefix(key, rolePrefix) {
+			return true
+		}
+		var role Role
+		if err = json.Unmarshal(v, &role); err != nil {
+			return false
+		}
+		res = append(res, role)
+		return true
+	})
+	slices.SortFunc(res, func(a, b Role) int { return strings.Compare(a.Name, b.Name) })
+
+	return res, err
+}
+
+func (k *KVStore) CreateRole(role Role) error {
+	b, _ := json.Marshal(role)
+
+	return k.store.Update(func(tx storage.Tx) error {
+		if _, ok := tx.Get(rolePrefix + role.Name); ok {
+			return ErrRoleExists
+		}
+		tx.Set(rolePrefix+role.Name, b)
+		return nil
+	})
+}
+
+func (k *KVStore) UpdateRole(role Role) error {
+	b, _ := json.Marshal(role)
+
+	return k.store.Update(func(tx storage.Tx) error {
+		if _, ok := tx.Get(rolePrefix + role.Name); !ok {
+			return ErrRoleNotFound
+		}
+		tx.Set(rolePrefix+role.Name, b)
+		return nil
+	})
+}
+
+func (k *KVStore) DeleteRole(name string) error {
+	assigned := make(map[string][]string)
+	k.store.Scan(func(key string, v []byte) bool {
+		if !strings.HasPrefix(key, userPrefix) {
+			return true
+		}
+		var roles []string
+		if json.Unmarshal(v, &roles) == nil && slices.Contains(roles, name) {
+			assigned[key] = roles
+		}
+		return true
+	})
+
+	return k.store.Update(func(tx storage.Tx) error {
+		if _, ok := tx.Get(rolePrefix + name); !ok {
+			return ErrRoleNotFound
+		}
+		tx.Delete(rolePrefix + name)
+
+		for key, roles := range assigned {
+			roles = slices.DeleteFunc(roles, func(r string) bool { return r == name })
+			b, _ := json.Marshal(roles)
+			tx.Set(key, b)
+		}
+		return nil
+	})
+}
+
+func (k *KVStore) UserRoles(userId string) ([]string, error) {
+	b, ok := k.store.Get(userPrefix + userId)
+	if !ok {
+		return []string{}, nil
+	}
+
+	var roles []string
+	err := json.Unmarshal(b, &roles)
+	return roles, err
+}
+
+// Store is the store the roles are kept in, see UserKeys.
+func (k *KVStore) Store() storage.Store {
+	return k.store
+}
+
+// UserKeys returns the key of the roles of the user, if any, for deleting
+// them in a transaction spanning other stores.
+func (k *KVStore) UserKeys(userId string) []string {
+	if _, ok := k.store.Get(userPrefix + userId); !ok {
+		return nil
+	}
+	return []string{userPrefix + userId}
+}
+
+func (k *KVStore) SetUserRoles(userId string, roles []string) error {
+	b, _ := json.Marshal(roles)
+
+	return k.store.Update(func(tx storage.Tx) error {
+		for _, name := range roles {
+			if _, ok := tx.Get(rolePrefix + name); !ok {
+				return ErrRoleNotFound
+			}
+		}
+
+		if len(roles) == 0 {
+			tx.Delete(userPrefix + userId)
+		} else {
+			tx.Set(userPrefix+userId, b)
+		}
+		return nil
+	})
+}
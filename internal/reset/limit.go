@@ -0,0 +1,95 @@
+package reset
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"users/pkg/purge"
+)
+
+// Limits is how many reset requests an email and an IP get per Window, zero
+// limits turn them off.
+type Limits struct {
+	// PerEmail keeps a mailbox from being flooded with reset mails.
+	PerEmail int
+	// PerIP keeps a client from probing or flooding many emails.
+	PerIP  int
+	Window time.Duration
+}
+
+type window struct {
+	requests int
+	endsAt   time.Time
+}
+
+// Limiter counts the reset requests in memory, so they are forgotten on
+// restart and not shared between instances.
+type Limiter struct {
+	limits  Limits
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+func NewLimiter(l Limits) *Limiter {
+	return &Limiter{limits: l, windows: make(map[string]*window)}
+}
+
+// Allow counts a reset request for the email from the IP at now. retryAfter
+// is how long the IP has to wait when it's over its limit, the request isn't
+// counted for the email then. send is false when the email is over its limit:
+// the request is answered as usual, but no mail goes out.
+func (l *Limiter) Allow(email, ip string, now time.Time) (send bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if retryAfter = l.count("ip:"+ip, l.limits.PerIP, now); retryAfter > 0 {
+		return false, retryAfter
+	}
+	if l.count("email:"+strings.ToLower(email), l.limits.PerEmail, now) > 0 {
+		return false, 0
+	}
+	return true, 0
+}
+
+// count counts a request under the key and returns how long until its window
+// ends when it's over the limit, 0 when it isn't.
+func (l *Limiter) count(key string, limit int, now time.Time) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.endsAt) {
+		w = &window{endsAt: now.Add(l.limits.Window)}
+		l.windows[key] = w
+	}
+	if w.requests >= limit {
+		return w.endsAt.Sub(now)
+	}
+	w.requests++
+	return 0
+}
+
+// Purge forgets the windows ended at now and returns how many.
+func (l *Limiter) Purge(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for key, w := range l.windows {
+		if !now.Before(w.endsAt) {
+			delete(l.windows, key)
+			n++
+		}
+	}
+	return n
+}
+
+// PurgeLimitsEvery starts a background loop that forgets the ended windows
+// every interval. The returned func stops it.
+func PurgeLimitsEvery(l *Limiter, interval time.Duration) (stop func()) {
+	return purge.Every(interval, "ended reset limit windows", func(now time.Time) (int, error) {
+		return l.Purge(now), nil
+	})
+}
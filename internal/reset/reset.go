@@ -0,0 +1,102 @@
+package reset
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"users/pkg/purge"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired reset token")
+
+// Token lets its user set a new password without the current one, once.
+type Token struct {
+	UserId    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store keeps the tokens by the hash of their value, see Key, so the values
+// mailed to the users can't be read back from the storage. A user has one
+// token at most.
+type Store interface {
+	// Get returns ErrInvalidToken when there's no token with the key.
+	Get(key string) (Token, error)
+	// Create stores the token, replacing the other tokens of its user.
+	Create(key string, t Token) error
+	// Consume removes the token along with the other tokens of its user and
+	// returns it, ErrInvalidToken when there's none.
+	Consume(key string) (Token, error)
+	// DeleteExpired removes the tokens expired at now and returns how many.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// Key is the key of the token with the value in a Store.
+func Key(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// Manager issues tokens valid for ttl and consumes them.
+type Manager struct {
+	store Store
+	ttl   time.Duration
+}
+
+func NewManager(store Store, ttl time.Duration) *Manager {
+	return &Manager{store: store, ttl: ttl}
+}
+
+// Issue makes a new token for the user and returns its value, the earlier
+// tokens of the user stop working.
+func (m *Manager) Issue(userId string, now time.Time) (string, Token, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Token{}, err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+
+	now = now.UTC()
+	t := Token{UserId: userId, CreatedAt: now, ExpiresAt: now.Add(m.ttl)}
+
+	return value, t, m.store.Create(Key(value), t)
+}
+
+// Check returns the token with the value, ErrInvalidToken when it's unknown,
+// used or expired at now.
+func (m *Manager) Check(value string, now time.Time) (Token, error) {
+	t, err := m.store.Get(Key(value))
+	if err != nil {
+		return Token{}, err
+	}
+	if !now.Before(t.ExpiresAt) {
+		return Token{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// Consume is Check, except the token can't be used again whatever the result.
+func (m *Manager) Consume(value string, now time.Time) (Token, error) {
+	t, err := m.store.Consume(Key(value))
+	if err != nil {
+		return Token{}, err
+	}
+	if !now.Before(t.ExpiresAt) {
+		return Token{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+func (m *Manager) TTL() time.Duration {
+	return m.ttl
+}
+
+// PurgeEvery starts a background loop that removes the expired tokens every
+// interval. The returned func stops it.
+func PurgeEvery(store Store, interval time.Duration) (stop func()) {
+	return purge.Every(interval, "expired reset tokens", store.DeleteExpired)
+}
@@ -0,0 +1,110 @@
+package reset
+
+import (
+	"encoding/json"
+	"time"
+	storage "users/internal/db"
+)
+
+// KVStore keeps the tokens in a storage.Store.
+type KVStore struct {
+	store storage.Store
+}
+
+func NewKVStore(store storage.Store) *KVStore {
+	return &KVStore{store: store}
+}
+
+// Store is the store the tokens are kept in, see UserKeys.
+func (k *KVStore) Store() storage.Store {
+	return k.store
+}
+
+// UserKeys returns the keys of the tokens of the user, also for deleting them
+// in a transaction spanning other stores.
+func (k *KVStore) UserKeys(userId string) []string {
+	var keys []string
+	k.store.Scan(func(key string, v []byte) bool {
+		var t Token
+		if json.Unmarshal(v, &t) == nil && t.UserId == userId {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+func (k *KVStore) Create(key string, t Token) error {
+	b, _ := json.Marshal(t)
+	others := k.UserKeys(t.UserId)
+
+	return k.store.Update(func(tx storage.Tx) error {
+		for _, other := range others {
+			tx.Delete(other)
+		}
+		tx.Set(key, b)
+		return nil
+	})
+}
+
+func (k *KVStore) Get(key string) (Token, error) {
+	b, ok := k.store.Get(key)
+	if !ok {
+		return Token{}, ErrInvalidToken
+	}
+
+	var t Token
+	err := json.Unmarshal(b, &t)
+	return t, err
+}
+
+func (k *KVStore) Consume(key string) (Token, error) {
+	t, err := k.Get(key)
+	if err != nil {
+		return Token{}, err
+	}
+	others := k.UserKeys(t.UserId)
+
+	err = k.store.Update(func(tx storage.Tx) error {
+		// only one of concurrent requests gets the token
+		if _, ok := tx.Get(key); !ok {
+			return ErrInvalidToken
+		}
+		tx.Delete(key)
+		for _, other := range others {
+			tx.Delete(other)
+		}
+		return nil
+	})
+	if err != nil {
+		return Token{}, err
+	}
+
+	return t, nil
+}
+
+func (k *KVStore) DeleteExpired(now time.Time) (int, error) {
+	var expired []string
+	k.store.Scan(func(key string, v []byte) bool {
+		var t Token
+		if json.Unmarshal(v, &t) == nil && !now.Before(t.ExpiresAt) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	err := k.store.Update(func(tx storage.Tx) error {
+		for _, key := range expired {
+			tx.Delete(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
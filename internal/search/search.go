@@ -0,0 +1,210 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// MinSimilarity is the word similarity a document needs to be a hit, unless
+// it contains the query as is.
+const MinSimilarity = 0.6
+
+// Index is an in-memory trigram index for fuzzy search over short texts like
+// names and emails. Each document is a set of text fields under an id.
+//
+// The trigrams only select the candidates, which are then scored word by word
+// with the edit distance, so that typos and swapped letters still match.
+type Index struct {
+	mu    sync.RWMutex
+	grams map[string]map[string]struct{} // trigram -> ids
+	docs  map[string]document
+}
+
+type document struct {
+	text  string // normalized fields joined by spaces
+	words []string
+	grams map[string]struct{}
+}
+
+type Hit struct {
+	Id    string
+	Score float64
+}
+
+func NewIndex() *Index {
+	return &Index{
+		grams: make(map[string]map[string]struct{}),
+		docs:  make(map[string]document),
+	}
+}
+
+// Put indexes the fields under id, replacing what was indexed for it before.
+func (x *Index) Put(id string, fields ...string) {
+	text := normalize(strings.Join(fields, " "))
+	doc := document{text: text, words: strings.Fields(text), grams: trigrams(text)}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.remove(id)
+	x.docs[id] = doc
+	for g := range doc.grams {
+		ids, ok := x.grams[g]
+		if !ok {
+			ids = make(map[string]struct{})
+			x.grams[g] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+func (x *Index) Remove(id string) {
+	x.mu.Lock()
+	x.remove(id)
+	x.mu.Unlock()
+}
+
+// Search returns up to limit documents similar to the query, best first.
+// Documents are scored by how close their words are to the query words, with
+// a bonus for containing the query as is and a smaller one for sharing more
+// trigrams with it.
+func (x *Index) Search(query string, limit int) []Hit {
+	query = normalize(query)
+	qwords := strings.Fields(query)
+	qgrams := trigrams(query)
+	if len(qgrams) == 0 {
+		return nil
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	shared := make(map[string]int)
+	for g := range qgrams {
+		for id := range x.grams[g] {
+			shared[id]++
+		}
+	}
+
+	hits := make([]Hit, 0, len(shared))
+	for id, n := range shared {
+		doc := x.docs[id]
+		similarity := wordSimilarity(qwords, doc.words)
+		contains := strings.Contains(doc.text, query)
+
+		if similarity < MinSimilarity && !contains {
+			continue
+		}
+
+		score := similarity + 0.5*float64(n)/float64(len(qgrams))
+		if contains {
+			score += 1
+		}
+		hits = append(hits, Hit{Id: id, Score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Id < hits[j].Id
+	})
+
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+func (x *Index) remove(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	delete(x.docs, id)
+
+	for g := range doc.grams {
+		delete(x.grams[g], id)
+		if len(x.grams[g]) == 0 {
+			delete(x.grams, g)
+		}
+	}
+}
+
+// normalize lowercases the text and turns everything but letters and digits
+// into single spaces, so "John.Doe@Mail.ru" becomes "john doe mail ru".
+func normalize(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// trigrams of every word of the normalized text, padded so that word starts
+// weigh more than the rest: "bob" gives "  b", " bo", "bob" and "ob ".
+func trigrams(text string) map[string]struct{} {
+	grams := make(map[string]struct{})
+
+	for _, word := range strings.Fields(text) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			grams[string(runes[i:i+3])] = struct{}{}
+		}
+	}
+
+	return grams
+}
+
+// wordSimilarity averages, over the query words, the similarity to the
+// closest document word: 1 for a word the document word starts with,
+// 1 - distance/length otherwise.
+func wordSimilarity(qwords, words []string) float64 {
+	var total float64
+
+	for _, q := range qwords {
+		best := 0.0
+		for _, w := range words {
+			if strings.HasPrefix(w, q) {
+				best = 1
+				break
+			}
+
+			qr, wr := []rune(q), []rune(w)
+			sim := 1 - float64(distance(qr, wr))/float64(max(len(qr), len(wr)))
+			best = max(best, sim)
+		}
+		total += best
+	}
+
+	return total / float64(len(qwords))
+}
+
+// distance is the optimal string alignment distance: the Levenshtein distance
+// with transpositions of adjacent letters counting as one edit.
+func distance(a, b []rune) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(a)][len(b)]
+}
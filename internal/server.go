@@ -1,39 +1,79 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 	"users/config"
+	"users/internal/audit"
 	storage "users/internal/db"
+	"users/internal/lockout"
+	"users/internal/reset"
+	"users/internal/session"
+	"users/internal/token"
 	delivery "users/internal/user/infrastructure/delivery/http"
 	"users/internal/user/infrastructure/repository"
 	slogger "users/pkg/logger"
 )
 
+// shutdownTimeout is how long the requests in flight get to finish on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func Run() {
 
 	slogger.Logger = slogger.GetLogger()
 
-	userdb, authdb := storage.InMemoryStorage{Storage: make(map[string][]byte)}, storage.InMemoryStorage{Storage: make(map[string][]byte)}
+	UserRepo, closeStorage := newRepository()
+	defer closeStorage()
+
+	if err := delivery.Bootstrap(UserRepo); err != nil {
+		slogger.Logger.Error("error while bootstrapping users", "err", err)
+		closeStorage()
+		os.Exit(1)
+	}
+
+	stopPurge := repository.PurgeEvery(UserRepo, config.Cfg.Trash.Retention, config.Cfg.Trash.PurgeInterval)
+	defer stopPurge()
+
+	stopSessionPurge := session.PurgeEvery(UserRepo.Sessions(), config.Cfg.Session.PurgeInterval)
+	defer stopSessionPurge()
+
+	stopTokenPurge := token.PurgeEvery(UserRepo.RefreshTokens(), config.Cfg.Session.PurgeInterval)
+	defer stopTokenPurge()
+
+	stopResetPurge := reset.PurgeEvery(UserRepo.PasswordResets(), config.Cfg.Session.PurgeInterval)
+	defer stopResetPurge()
 
-	UserRepo := repository.NewBannerRepository(&userdb, &authdb)
-	UserRepo.CreateAdmin()
 	UserHandler := delivery.NewUserHandler(UserRepo)
 
+	stopLockoutPurge := lockout.PurgeEvery(UserHandler.Lockouts, config.Cfg.Session.PurgeInterval)
+	defer stopLockoutPurge()
+
+	stopLimitPurge := reset.PurgeLimitsEvery(UserHandler.ResetLimits, config.Cfg.Session.PurgeInterval)
+	defer stopLimitPurge()
+
 	mux := http.NewServeMux()
 
 	mux.Handle("/user/", UserHandler)
+	mux.Handle("/audit", UserHandler)
+	mux.Handle("/roles", UserHandler)
+	mux.Handle("/roles/", UserHandler)
+	mux.Handle("/auth/", UserHandler)
 
 	// Swagger specification
 
 	mux.HandleFunc("GET /redoc", delivery.ReDoc)
 	mux.Handle("/swagger.yaml", http.FileServer(http.Dir(config.Cfg.Swagger.StaticPath)))
 
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%s", config.Cfg.Server.Host, config.Cfg.Server.Port), Handler: mux}
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%s", config.Cfg.Server.Host, config.Cfg.Server.Port), mux); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slogger.Logger.Error("error, server is crashed: ", "err", err)
 		}
 	}()
@@ -50,4 +90,75 @@ func Run() {
 
 	s := <-sigChan
 	slogger.Logger.Info("Shutdown server", "signal", s)
+
+	// the requests in flight finish before the storage is closed by the
+	// deferred calls
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slogger.Logger.Error("error while shutting the server down", "err", err)
+	}
+
+	// the reset mails still being sent
+	UserHandler.Wait()
+}
+
+// VerifyAudit checks the hash chain of the audit log in the configured storage
+// and returns the exit code, 1 when the log was tampered with. The file engine
+// is read without being closed, so no snapshot is written while the server may
+// be running on the same directory.
+func VerifyAudit() int {
+	slogger.Logger = slogger.GetLogger()
+
+	repo, closeStorage := newRepository()
+	if config.Cfg.Storage.Engine != "file" {
+		defer closeStorage()
+	}
+
+	n, err := audit.Verify(repo.AuditLog())
+	if err != nil {
+		slogger.Logger.Error("audit log verification failed", "verified", n, "err", err)
+		return 1
+	}
+
+	slogger.Logger.Info("audit log verified", "entries", n)
+	return 0
+}
+
+// newRepository builds the user repository on the storage engine chosen in
+// the config. The returned func flushes and closes the storage.
+func newRepository() (repository.UserRepository, func()) {
+	switch config.Cfg.Storage.Engine {
+	case "sqlite":
+		repo, err := repository.NewSQLiteRepository(config.Cfg.Storage.Path)
+		if err != nil {
+			slogger.Logger.Error("error while opening storage", "path", config.Cfg.Storage.Path, "err", err)
+			os.Exit(1)
+		}
+
+		return repo, func() {
+			if err := repo.Close(); err != nil {
+				slogger.Logger.Error("error while closing storage", "err", err)
+			}
+		}
+
+	case "file":
+		journal, err := storage.OpenJournal(config.Cfg.Storage.Dir)
+		if err != nil {
+			slogger.Logger.Error("error while opening storage", "dir", config.Cfg.Storage.Dir, "err", err)
+			os.Exit(1)
+		}
+
+		stores := repository.NewMemoryStores(journal)
+		journal.SnapshotEvery(config.Cfg.Storage.SnapshotInterval)
+
+		return repository.NewBannerRepository(stores), func() {
+			if err := journal.Close(); err != nil {
+				slogger.Logger.Error("error while closing storage", "err", err)
+			}
+		}
+
+	default:
+		return repository.NewBannerRepository(repository.NewMemoryStores(nil)), func() {}
+	}
 }
@@ -0,0 +1,123 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"users/pkg/purge"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+// Session of a logged in user.
+type Session struct {
+	UserId    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// SecondFactor is set when the login checked a one-time code too.
+	SecondFactor bool `json:"second_factor,omitempty"`
+}
+
+// Store keeps the sessions by the hash of their id, see Key, so the ids handed
+// out to the clients can't be read back from the storage.
+type Store interface {
+	Get(key string) (Session, error)
+	// Put creates or renews a session.
+	Put(key string, s Session) error
+	Delete(key string) error
+	// DeleteUser removes all the sessions of the user, DeleteOthers all of
+	// them but the one with the key.
+	DeleteUser(userId string) error
+	DeleteOthers(userId, key string) error
+	// DeleteExpired removes the sessions expired at now and returns how many.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// Key is the key of the session with the id in a Store.
+func Key(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Manager starts and checks sessions lasting ttl since their last use.
+type Manager struct {
+	store Store
+	ttl   time.Duration
+}
+
+func NewManager(store Store, ttl time.Duration) *Manager {
+	return &Manager{store: store, ttl: ttl}
+}
+
+// Start opens a session for the user at now and returns its id, secondFactor
+// tells whether the login checked a one-time code.
+func (m *Manager) Start(userId string, secondFactor bool, now time.Time) (string, Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Session{}, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	now = now.UTC()
+	s := Session{UserId: userId, CreatedAt: now, ExpiresAt: now.Add(m.ttl), SecondFactor: secondFactor}
+
+	return id, s, m.store.Put(Key(id), s)
+}
+
+// Check returns the session with the id, ErrNotFound once it has expired at
+// now. A session past half of its ttl is renewed, renewed is true then and the
+// cookie should be renewed too.
+func (m *Manager) Check(id string, now time.Time) (s Session, renewed bool, err error) {
+	key := Key(id)
+
+	s, err = m.store.Get(key)
+	if err != nil {
+		return Session{}, false, err
+	}
+
+	now = now.UTC()
+	if !now.Before(s.ExpiresAt) {
+		m.store.Delete(key)
+		return Session{}, false, ErrNotFound
+	}
+
+	if s.ExpiresAt.Sub(now) < m.ttl/2 {
+		s.ExpiresAt = now.Add(m.ttl)
+		if err := m.store.Put(key, s); err != nil {
+			return Session{}, false, err
+		}
+		renewed = true
+	}
+
+	return s, renewed, nil
+}
+
+// End closes the session with the id, if any.
+func (m *Manager) End(id string) error {
+	return m.store.Delete(Key(id))
+}
+
+// EndAll closes all the sessions of the user, e.g. once its password is reset.
+func (m *Manager) EndAll(userId string) error {
+	return m.store.DeleteUser(userId)
+}
+
+// EndOthers closes the sessions of the user but the one with the id, e.g. the
+// one it just changed its password in.
+func (m *Manager) EndOthers(userId, id string) error {
+	return m.store.DeleteOthers(userId, Key(id))
+}
+
+func (m *Manager) TTL() time.Duration {
+	return m.ttl
+}
+
+// PurgeEvery starts a background loop that removes the expired sessions every
+// interval. The returned func stops it.
+func PurgeEvery(store Store, interval time.Duration) (stop func()) {
+	return purge.Every(interval, "expired sessions", store.DeleteExpired)
+}
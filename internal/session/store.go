@@ -0,0 +1,96 @@
+package session
+
+import (
+	"encoding/json"
+	"time"
+	storage "users/internal/db"
+)
+
+// KVStore keeps the sessions in a storage.Store.
+type KVStore struct {
+	store storage.Store
+}
+
+func NewKVStore(store storage.Store) *KVStore {
+	return &KVStore{store: store}
+}
+
+func (k *KVStore) Get(key string) (Session, error) {
+	b, ok := k.store.Get(key)
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+
+	var s Session
+	err := json.Unmarshal(b, &s)
+	return s, err
+}
+
+func (k *KVStore) Put(key string, s Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return k.store.Set(key, b)
+}
+
+func (k *KVStore) Delete(key string) error {
+	return k.store.Delete(key)
+}
+
+func (k *KVStore) DeleteUser(userId string) error {
+	_, err := k.deleteWhere(func(_ string, s Session) bool { return s.UserId == userId })
+	return err
+}
+
+func (k *KVStore) DeleteOthers(userId, key string) error {
+	_, err := k.deleteWhere(func(other string, s Session) bool { return s.UserId == userId && other != key })
+	return err
+}
+
+func (k *KVStore) DeleteExpired(now time.Time) (int, error) {
+	return k.deleteWhere(func(_ string, s Session) bool { return !now.Before(s.ExpiresAt) })
+}
+
+// Store is the store the sessions are kept in, see UserKeys.
+func (k *KVStore) Store() storage.Store {
+	return k.store
+}
+
+// UserKeys returns the keys of the sessions of the user, for deleting them
+// in a transaction spanning other stores.
+func (k *KVStore) UserKeys(userId string) []string {
+	return k.keysWhere(func(_ string, s Session) bool { return s.UserId == userId })
+}
+
+func (k *KVStore) keysWhere(match func(key string, s Session) bool) []string {
+	var keys []string
+	k.store.Scan(func(key string, v []byte) bool {
+		var s Session
+		if json.Unmarshal(v, &s) == nil && match(key, s) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// deleteWhere removes the sessions matching and returns how many.
+func (k *KVStore) deleteWhere(match func(key string, s Session) bool) (int, error) {
+	keys := k.keysWhere(match)
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	err := k.store.Update(func(tx storage.Tx) error {
+		for _, key := range keys {
+			tx.Delete(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
@@ -0,0 +1,149 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Claims of the access tokens, times are Unix seconds.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // user id
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Id        string `json:"jti"`
+	// Methods are how the user authenticated, see AMRPassword and AMROTP.
+	Methods []string `json:"amr,omitempty"`
+}
+
+// The authentication methods of RFC 8176.
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+)
+
+// SecondFactor tells whether the user gave a one-time code besides its
+// password.
+func (c Claims) SecondFactor() bool {
+	return slices.Contains(c.Methods, AMROTP)
+}
+
+// KeyId identifies an Ed25519 public key in the kid header.
+func KeyId(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// Keys sign and verify JWTs. HMAC signs the tokens unless Signing is set,
+// then Ed25519 does and HMAC is no longer accepted, unless AcceptHMAC keeps it
+// while the tokens issued before the switch expire. Public keys are accepted
+// by kid.
+type Keys struct {
+	HMAC       []byte
+	Signing    ed25519.PrivateKey
+	Public     map[string]ed25519.PublicKey
+	AcceptHMAC bool
+}
+
+func (k Keys) sign(claims Claims) (string, error) {
+	h := header{Alg: HS256, Typ: "JWT"}
+	if k.Signing != nil {
+		h.Alg, h.Kid = EdDSA, KeyId(k.Signing.Public().(ed25519.PublicKey))
+	}
+
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+
+	var sig []byte
+	if k.Signing != nil {
+		sig = ed25519.Sign(k.Signing, []byte(signed))
+	} else {
+		mac := hmac.New(sha256.New, k.HMAC)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parse checks the signature of the token and returns its claims, the times
+// are left to the caller. The algorithm is taken from the header but the key
+// never is, so only the configured keys are accepted.
+func (k Keys) parse(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(hb, &h); err != nil || h.Typ != "JWT" {
+		return Claims{}, ErrInvalidToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch h.Alg {
+	case HS256:
+		if k.Signing != nil && !k.AcceptHMAC {
+			return Claims{}, ErrInvalidToken
+		}
+		mac := hmac.New(sha256.New, k.HMAC)
+		mac.Write(signed)
+		if len(k.HMAC) == 0 || !hmac.Equal(sig, mac.Sum(nil)) {
+			return Claims{}, ErrInvalidToken
+		}
+	case EdDSA:
+		pub, ok := k.Public[h.Kid]
+		if !ok || !ed25519.Verify(pub, signed, sig) {
+			return Claims{}, ErrInvalidToken
+		}
+	default:
+		return Claims{}, ErrInvalidToken
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(cb, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	return claims, nil
+}
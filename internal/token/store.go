@@ -0,0 +1,184 @@
+package token
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	storage "users/internal/db"
+)
+
+// familyIndex orders the tokens by family.
+const familyIndex = "family"
+
+// revokedPrefix keys the revocations of the access tokens by user, apart from
+// the refresh tokens keyed by their hex hash.
+const revokedPrefix = "revoked/"
+
+// revocation is stored with the same user_id and expires_at as a token, so
+// UserKeys and DeleteExpired cover it.
+type revocation struct {
+	UserId    string    `json:"user_id"`
+	NotBefore time.Time `json:"not_before"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func familyTerm(key string, v []byte) (string, bool) {
+	if strings.HasPrefix(key, revokedPrefix) {
+		return "", false
+	}
+	var t RefreshToken
+	if json.Unmarshal(v, &t) != nil {
+		return "", false
+	}
+	return t.Family, true
+}
+
+// KVStore keeps the refresh tokens in a storage.Store.
+type KVStore struct {
+	store storage.Store
+}
+
+func NewKVStore(store storage.Store) *KVStore {
+	store.CreateIndex(familyIndex, familyTerm)
+	return &KVStore{store: store}
+}
+
+func (k *KVStore) Put(key string, t RefreshToken) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return k.store.Set(key, b)
+}
+
+func (k *KVStore) Use(key string) (RefreshToken, error) {
+	var t RefreshToken
+
+	err := k.store.Update(func(tx storage.Tx) error {
+		b, ok := tx.Get(key)
+		if !ok {
+			return ErrInvalidToken
+		}
+		if err := json.Unmarshal(b, &t); err != nil {
+			return err
+		}
+
+		used := t
+		used.Used = true
+		b, _ = json.Marshal(used)
+		tx.Set(key, b)
+		return nil
+	})
+
+	return t, err
+}
+
+func (k *KVStore) RevokeFamily(family string) error {
+	var keys []string
+	err := k.store.ScanIndex(familyIndex, storage.IndexRange{From: family, To: family + "\x00"}, func(_ storage.IndexPos, key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return k.markUsed(keys)
+}
+
+func (k *KVStore) RevokeUser(userId string) error {
+	var keys []string
+	k.store.Scan(func(key string, v []byte) bool {
+		var t RefreshToken
+		if !strings.HasPrefix(key, revokedPrefix) && json.Unmarshal(v, &t) == nil && t.UserId == userId && !t.Used {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	return k.markUsed(keys)
+}
+
+func (k *KVStore) RevokeAccess(userId string, notBefore, expiresAt time.Time) error {
+	b, err := json.Marshal(revocation{UserId: userId, NotBefore: notBefore, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	return k.store.Set(revokedPrefix+userId, b)
+}
+
+func (k *KVStore) AccessNotBefore(userId string) (time.Time, error) {
+	b, ok := k.store.Get(revokedPrefix + userId)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	var r revocation
+	if err := json.Unmarshal(b, &r); err != nil {
+		return time.Time{}, err
+	}
+	return r.NotBefore, nil
+}
+
+// Store is the store the tokens are kept in, see UserKeys.
+func (k *KVStore) Store() storage.Store {
+	return k.store
+}
+
+// UserKeys returns the keys of the tokens of the user, used ones and the
+// revocation included, for deleting them in a transaction spanning other stores.
+func (k *KVStore) UserKeys(userId string) []string {
+	var keys []string
+	k.store.Scan(func(key string, v []byte) bool {
+		var t RefreshToken
+		if json.Unmarshal(v, &t) == nil && t.UserId == userId {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// markUsed marks the tokens with the keys used.
+func (k *KVStore) markUsed(keys []string) error {
+	return k.store.Update(func(tx storage.Tx) error {
+		for _, key := range keys {
+			b, ok := tx.Get(key)
+			if !ok {
+				continue
+			}
+			var t RefreshToken
+			json.Unmarshal(b, &t)
+			t.Used = true
+			b, _ = json.Marshal(t)
+			tx.Set(key, b)
+		}
+		return nil
+	})
+}
+
+func (k *KVStore) DeleteExpired(now time.Time) (int, error) {
+	var expired []string
+	k.store.Scan(func(key string, v []byte) bool {
+		var t RefreshToken
+		if json.Unmarshal(v, &t) == nil && !now.Before(t.ExpiresAt) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	err := k.store.Update(func(tx storage.Tx) error {
+		for _, key := range expired {
+			tx.Delete(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
@@ -0,0 +1,246 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	slogger "users/pkg/logger"
+	"users/pkg/purge"
+)
+
+// ErrTokenReused is returned for a refresh token used a second time. The whole
+// family of tokens it was rotated from and into is revoked then, as either
+// the client or an attacker holds a stolen copy.
+var ErrTokenReused = errors.New("refresh token reused")
+
+// RefreshToken is the server side of a refresh token. The tokens rotated from
+// one another share their Family.
+type RefreshToken struct {
+	UserId    string    `json:"user_id"`
+	Family    string    `json:"family"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"`
+	// SecondFactor is set when the login checked a one-time code too, the
+	// access tokens of the family say so in their amr claim.
+	SecondFactor bool `json:"second_factor,omitempty"`
+}
+
+// RefreshStore keeps the refresh tokens by the hash of the token, see Key.
+type RefreshStore interface {
+	Put(key string, t RefreshToken) error
+	// Use marks the token used and returns it as it was, ErrInvalidToken when
+	// there is no such token.
+	Use(key string) (RefreshToken, error)
+	// RevokeFamily marks all the tokens of the family used.
+	RevokeFamily(family string) error
+	// RevokeUser marks all the tokens of the user used.
+	RevokeUser(userId string) error
+	// RevokeAccess refuses the access tokens of the user issued before
+	// notBefore, until expiresAt when they're all expired anyway.
+	RevokeAccess(userId string, notBefore, expiresAt time.Time) error
+	// AccessNotBefore returns when the access tokens of the user are accepted
+	// from, the zero time unless they were revoked.
+	AccessNotBefore(userId string) (time.Time, error)
+	// DeleteExpired removes the tokens expired at now and returns how many.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// Key is the key of the refresh token in a RefreshStore.
+func Key(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Pair is what the token endpoint responds with.
+type Pair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Issuer issues access tokens lasting AccessTTL along with refresh tokens
+// lasting RefreshTTL.
+type Issuer struct {
+	Name       string
+	Keys       Keys
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	store RefreshStore
+}
+
+func NewIssuer(name string, keys Keys, accessTTL, refreshTTL time.Duration, store RefreshStore) *Issuer {
+	return &Issuer{Name: name, Keys: keys, AccessTTL: accessTTL, RefreshTTL: refreshTTL, store: store}
+}
+
+// ParseEd25519Keys decodes a base64 Ed25519 seed, the signing key, and extra
+// base64 public keys to accept, all optional.
+func ParseEd25519Keys(seed string, public []string) (ed25519.PrivateKey, map[string]ed25519.PublicKey, error) {
+	var signing ed25519.PrivateKey
+	keys := make(map[string]ed25519.PublicKey)
+
+	if seed != "" {
+		b, err := base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(b) != ed25519.SeedSize {
+			return nil, nil, fmt.Errorf("invalid Ed25519 seed")
+		}
+		signing = ed25519.NewKeyFromSeed(b)
+		pub := signing.Public().(ed25519.PublicKey)
+		keys[KeyId(pub)] = pub
+	}
+
+	for _, p := range public {
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("invalid Ed25519 public key %q", p)
+		}
+		keys[KeyId(b)] = ed25519.PublicKey(b)
+	}
+
+	return signing, keys, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Issue starts a new family of refresh tokens for the user, secondFactor
+// tells whether the login checked a one-time code.
+func (i *Issuer) Issue(userId string, secondFactor bool) (Pair, error) {
+	family, err := randomString(16)
+	if err != nil {
+		return Pair{}, err
+	}
+	return i.issue(userId, family, secondFactor)
+}
+
+func (i *Issuer) issue(userId, family string, secondFactor bool) (Pair, error) {
+	now := time.Now()
+
+	jti, err := randomString(16)
+	if err != nil {
+		return Pair{}, err
+	}
+	methods := []string{AMRPassword}
+	if secondFactor {
+		methods = append(methods, AMROTP)
+	}
+	access, err := i.Keys.sign(Claims{
+		Issuer:    i.Name,
+		Subject:   userId,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(i.AccessTTL).Unix(),
+		Id:        jti,
+		Methods:   methods,
+	})
+	if err != nil {
+		return Pair{}, err
+	}
+
+	refresh, err := randomString(32)
+	if err != nil {
+		return Pair{}, err
+	}
+	err = i.store.Put(Key(refresh), RefreshToken{UserId: userId, Family: family, ExpiresAt: now.Add(i.RefreshTTL).UTC(), SecondFactor: secondFactor})
+	if err != nil {
+		return Pair{}, err
+	}
+
+	return Pair{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(i.AccessTTL.Seconds()), RefreshToken: refresh}, nil
+}
+
+// Refresh rotates the refresh token: it can't be used again and a new pair is
+// issued in its family, as long as live accepts the user.
+func (i *Issuer) Refresh(refresh string, live func(userId string) bool) (Pair, error) {
+	t, err := i.store.Use(Key(refresh))
+	if err != nil {
+		return Pair{}, err
+	}
+
+	if t.Used {
+		slogger.Logger.Warn("refresh token reused, revoking its family", "user_id", t.UserId)
+		if err := i.store.RevokeFamily(t.Family); err != nil {
+			return Pair{}, err
+		}
+		return Pair{}, ErrTokenReused
+	}
+	if !time.Now().Before(t.ExpiresAt) || !live(t.UserId) {
+		return Pair{}, ErrInvalidToken
+	}
+
+	return i.issue(t.UserId, t.Family, t.SecondFactor)
+}
+
+// Revoke revokes the family of the refresh token, it's a logout for the
+// clients holding tokens. Unknown tokens are ignored.
+func (i *Issuer) Revoke(refresh string) error {
+	t, err := i.store.Use(Key(refresh))
+	if errors.Is(err, ErrInvalidToken) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return i.store.RevokeFamily(t.Family)
+}
+
+// RevokeUser revokes all the refresh token families of the user along with
+// its access tokens, e.g. once its password is reset. As the access tokens
+// are issued by the second, the ones issued within the same second as the
+// revocation are still accepted.
+func (i *Issuer) RevokeUser(userId string) error {
+	if err := i.store.RevokeUser(userId); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return i.store.RevokeAccess(userId, now.UTC(), now.Add(i.AccessTTL).UTC())
+}
+
+// Verify checks an access token and returns the user id it was issued for.
+func (i *Issuer) Verify(access string) (string, error) {
+	claims, err := i.VerifyClaims(access)
+	return claims.Subject, err
+}
+
+// VerifyClaims checks an access token and returns its claims.
+func (i *Issuer) VerifyClaims(access string) (Claims, error) {
+	claims, err := i.Keys.parse(access)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if claims.Issuer != i.Name || claims.Subject == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrInvalidToken
+	}
+
+	// an issuer only verifying tokens has no store
+	if i.store != nil {
+		notBefore, err := i.store.AccessNotBefore(claims.Subject)
+		if err != nil {
+			return Claims{}, err
+		}
+		if claims.IssuedAt < notBefore.Unix() {
+			return Claims{}, ErrInvalidToken
+		}
+	}
+
+	return claims, nil
+}
+
+// PurgeEvery starts a background loop that removes the expired refresh tokens
+// every interval. The returned func stops it.
+func PurgeEvery(store RefreshStore, interval time.Duration) (stop func()) {
+	return purge.Every(interval, "expired refresh tokens", store.DeleteExpired)
+}
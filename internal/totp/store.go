@@ -0,0 +1,70 @@
+package totp
+
+import (
+	"encoding/json"
+	storage "users/internal/db"
+)
+
+// KVStore keeps the enrollments in a storage.Store by user id.
+type KVStore struct {
+	store storage.Store
+}
+
+func NewKVStore(store storage.Store) *KVStore {
+	return &KVStore{store: store}
+}
+
+func (k *KVStore) Get(userId string) (Enrollment, error) {
+	b, ok := k.store.Get(userId)
+	if !ok {
+		return Enrollment{}, ErrNotEnrolled
+	}
+
+	var e Enrollment
+	err := json.Unmarshal(b, &e)
+	return e, err
+}
+
+func (k *KVStore) Put(userId string, e Enrollment) error {
+	b, _ := json.Marshal(e)
+	return k.store.Set(userId, b)
+}
+
+func (k *KVStore) Update(userId string, fn func(e *Enrollment) error) error {
+	return k.store.Update(func(tx storage.Tx) error {
+		b, ok := tx.Get(userId)
+		if !ok {
+			return ErrNotEnrolled
+		}
+
+		var e Enrollment
+		if err := json.Unmarshal(b, &e); err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+
+		b, _ = json.Marshal(e)
+		tx.Set(userId, b)
+		return nil
+	})
+}
+
+func (k *KVStore) Delete(userId string) error {
+	return k.store.Delete(userId)
+}
+
+// Store is the store the enrollments are kept in, see UserKeys.
+func (k *KVStore) Store() storage.Store {
+	return k.store
+}
+
+// UserKeys returns the key of the enrollment of the user, if any, for
+// deleting it in a transaction spanning other stores.
+func (k *KVStore) UserKeys(userId string) []string {
+	if _, ok := k.store.Get(userId); !ok {
+		return nil
+	}
+	return []string{userId}
+}
@@ -0,0 +1,300 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The parameters of the codes, the ones authenticator apps assume.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// skew is how many periods a code may be late or early, for clocks a bit
+	// off.
+	skew = 1
+
+	secretSize    = 20
+	recoveryCodes = 10
+)
+
+var (
+	ErrNotEnrolled = errors.New("two-factor authentication not enabled")
+	ErrEnrolled    = errors.New("two-factor authentication already enabled")
+	ErrInvalidCode = errors.New("invalid one-time code")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Enrollment is the second factor of a user. It only counts once Confirmed,
+// that is once the user proved its authenticator app has the secret.
+type Enrollment struct {
+	Secret    string `json:"secret"` // base32
+	Confirmed bool   `json:"confirmed"`
+	// LastStep is the period of the last code accepted, so a code can't be
+	// used twice.
+	LastStep int64 `json:"last_step"`
+	// RecoveryCodes are the hashes of the codes left, see hashRecoveryCode.
+	RecoveryCodes []string  `json:"recovery_codes"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Store keeps the enrollments by user id.
+type Store interface {
+	// Get returns ErrNotEnrolled when the user has no enrollment.
+	Get(userId string) (Enrollment, error)
+	Put(userId string, e Enrollment) error
+	// Update changes the enrollment of the user in a transaction, fn's error
+	// cancels it. ErrNotEnrolled when the user has no enrollment.
+	Update(userId string, fn func(e *Enrollment) error) error
+	Delete(userId string) error
+}
+
+// Code is the code of the secret for the period t falls in.
+func Code(secret []byte, t time.Time) string {
+	return code(secret, t.Unix()/int64(Period.Seconds()))
+}
+
+func code(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// the dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range Digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, n%mod)
+}
+
+// validate returns the period the code is good for at now, after the last
+// period accepted.
+func validate(secret []byte, c string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix() / int64(Period.Seconds())
+	for step := current - skew; step <= current+skew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(code(secret, step)), []byte(c)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI is the otpauth:// URI authenticator apps scan as a QR code.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period.Seconds()))},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// hashRecoveryCode is how the recovery codes are stored, they are random
+// enough not to need a slow hash. Dashes and case don't matter.
+func hashRecoveryCode(c string) string {
+	c = strings.ToLower(strings.ReplaceAll(c, "-", ""))
+	sum := sha256.Sum256([]byte(c))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for range recoveryCodes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(encoding.EncodeToString(b))
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+	return codes, hashes, nil
+}
+
+// Manager enrolls the users and checks their codes.
+type Manager struct {
+	store  Store
+	issuer string
+}
+
+// NewManager returns a manager whose URIs show issuer as the account
+// provider.
+func NewManager(store Store, issuer string) *Manager {
+	return &Manager{store: store, issuer: issuer}
+}
+
+// Enroll starts over the enrollment of the user with a new secret, unless a
+// confirmed one exists, and returns the secret along with its URI.
+func (m *Manager) Enroll(userId, account string, now time.Time) (secret, uri string, err error) {
+	e, err := m.store.Get(userId)
+	if err == nil && e.Confirmed {
+		return "", "", ErrEnrolled
+	}
+	if err != nil && !errors.Is(err, ErrNotEnrolled) {
+		return "", "", err
+	}
+
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = encoding.EncodeToString(b)
+
+	if err := m.store.Put(userId, Enrollment{Secret: secret, CreatedAt: now.UTC()}); err != nil {
+		return "", "", err
+	}
+	return secret, URI(m.issuer, account, secret), nil
+}
+
+// Confirm enables the pending enrollment of the user given a code of its
+// secret, and returns the recovery codes. They are only shown this once.
+func (m *Manager) Confirm(userId, c string, now time.Time) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.store.Update(userId, func(e *Enrollment) error {
+		if e.Confirmed {
+			return ErrEnrolled
+		}
+		step, err := e.check(c, now)
+		if err != nil {
+			return err
+		}
+		e.Confirmed, e.LastStep, e.RecoveryCodes = true, step, hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Enabled tells whether the user has a confirmed enrollment.
+func (m *Manager) Enabled(userId string) (bool, error) {
+	e, err := m.store.Get(userId)
+	if errors.Is(err, ErrNotEnrolled) {
+		return false, nil
+	}
+	return e.Confirmed, err
+}
+
+// Status returns whether the user has a confirmed enrollment and how many
+// recovery codes are left.
+func (m *Manager) Status(userId string) (enabled bool, recoveryCodes int, err error) {
+	e, err := m.store.Get(userId)
+	if errors.Is(err, ErrNotEnrolled) {
+		return false, 0, nil
+	}
+	if err != nil || !e.Confirmed {
+		return false, 0, err
+	}
+	return true, len(e.RecoveryCodes), nil
+}
+
+// Verify accepts a code of the confirmed enrollment of the user, once, or one
+// of its recovery codes, which is used up then.
+func (m *Manager) Verify(userId, c string, now time.Time) error {
+	return m.store.Update(userId, func(e *Enrollment) error {
+		if !e.Confirmed {
+			return ErrNotEnrolled
+		}
+
+		if step, err := e.check(c, now); err == nil {
+			e.LastStep = step
+			return nil
+		}
+
+		hash := hashRecoveryCode(c)
+		for i, h := range e.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				e.RecoveryCodes = append(e.RecoveryCodes[:i:i], e.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrInvalidCode
+	})
+}
+
+// VerifyRepeated accepts a code of the confirmed enrollment of the user as
+// long as it's good, again and again, for clients sending it with every
+// request. Recovery codes aren't, they would be used up one per request. The
+// enrollment is only written when the code is of a later period than the last
+// accepted one, not on every request.
+func (m *Manager) VerifyRepeated(userId, c string, now time.Time) error {
+	e, err := m.store.Get(userId)
+	if err != nil {
+		return err
+	}
+	step, err := e.checkRepeated(c, now)
+	if err != nil || step <= e.LastStep {
+		return err
+	}
+
+	return m.store.Update(userId, func(e *Enrollment) error {
+		// the enrollment may have changed since it was read
+		step, err := e.checkRepeated(c, now)
+		if err != nil {
+			return err
+		}
+		e.LastStep = max(e.LastStep, step)
+		return nil
+	})
+}
+
+// Disable removes the enrollment of the user, if any.
+func (m *Manager) Disable(userId string) error {
+	return m.store.Delete(userId)
+}
+
+// checkRepeated is check for VerifyRepeated: the period last accepted is good
+// again, the earlier ones still aren't.
+func (e *Enrollment) checkRepeated(c string, now time.Time) (int64, error) {
+	if !e.Confirmed {
+		return 0, ErrNotEnrolled
+	}
+
+	secret, err := encoding.DecodeString(e.Secret)
+	if err != nil {
+		return 0, err
+	}
+	step, ok := validate(secret, c, now, e.LastStep-1)
+	if !ok {
+		return 0, ErrInvalidCode
+	}
+	return step, nil
+}
+
+func (e *Enrollment) check(c string, now time.Time) (int64, error) {
+	secret, err := encoding.DecodeString(e.Secret)
+	if err != nil {
+		return 0, err
+	}
+
+	step, ok := validate(secret, c, now, e.LastStep)
+	if !ok {
+		return 0, ErrInvalidCode
+	}
+	return step, nil
+}
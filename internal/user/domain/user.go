@@ -1,9 +1,16 @@
 package entity
 
+import "time"
+
 type User struct {
-	Id       string `json:"id,omitempty"`
-	Username string `json:"username,omitempty"`
-	Email    string `json:"email,omitempty"`
-	Password string `json:"password,omitempty"`
-	Admin    *bool  `json:"admin,omitempty"`
+	Id        string     `json:"id,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	Password  string     `json:"password,omitempty"`
+	Admin     *bool      `json:"admin,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Version   uint64     `json:"version"`              // bumped by every update
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // in the trash since
+	// MustChangePassword is set until the user changes its password.
+	MustChangePassword bool `json:"must_change_password,omitempty"`
 }
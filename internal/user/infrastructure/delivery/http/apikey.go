@@ -0,0 +1,138 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"users/config"
+	"users/internal/apikey"
+	"users/internal/audit"
+	"users/internal/rbac"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// ListAPIKeys lists the API keys of the authenticated user, oldest first.
+func (u *UserHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	keys, err := u.APIKeys.List(me.Id)
+	if err != nil {
+		slogger.Logger.Error("error while listing api keys", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(keys)
+	w.Write(b)
+}
+
+// CreateAPIKey makes a new API key for the authenticated user, scoped to some
+// of its permissions. The key is in the response only.
+func (u *UserHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	req := &dto.CreateAPIKey{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		slogger.Logger.Info("error while CreateAPIKey decoding", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		slogger.Logger.Info("error while CreateAPIKey validation", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(config.Cfg.APIKey.DefaultTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > config.Cfg.APIKey.MaxTTL {
+		BadRequestMessageHandler(w, r, fmt.Sprintf("expires_at must be in the next %s", config.Cfg.APIKey.MaxTTL))
+		return
+	}
+
+	slices.Sort(req.Scopes)
+	scopes := slices.Compact(req.Scopes)
+	for _, p := range scopes {
+		if !slices.Contains(rbac.Permissions, p) {
+			BadRequestMessageHandler(w, r, fmt.Sprintf("unknown permission %q", p))
+			return
+		}
+		allowed, err := u.Roles.Can(me.Id, me.Admin, p)
+		if err != nil {
+			slogger.Logger.Error("error while checking permission", "user", me.Id, "permission", p, "err", err)
+			InternalServerErrorHandler(w, r)
+			return
+		}
+		if !allowed {
+			ForbiddenHandler(w, r, fmt.Sprintf("missing permission %s", p))
+			return
+		}
+	}
+
+	value, key, err := u.APIKeys.Create(apikey.Key{
+		UserId:       me.Id,
+		Name:         req.Name,
+		Scopes:       scopes,
+		SecondFactor: me.SecondFactor,
+		ExpiresAt:    expiresAt,
+	}, now)
+	if err != nil {
+		slogger.Logger.Error("error while creating api key", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "apikey_create", me.Id, apiKeyChanges(nil, &key))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	b, _ := json.Marshal(dto.CreatedAPIKey{Key: key, Value: value})
+	w.Write(b)
+}
+
+// RevokeAPIKey deletes an API key of the authenticated user.
+func (u *UserHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+	id := strings.TrimPrefix(r.URL.Path, "/user/me/keys/")
+
+	err := u.APIKeys.Revoke(me.Id, id)
+	if errors.Is(err, apikey.ErrNotFound) {
+		NotFoundHandler(w, r)
+		return
+	}
+	if err != nil {
+		slogger.Logger.Error("error while revoking api key", "id", me.Id, "key", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "apikey_revoke", me.Id, apiKeyChanges(&apikey.Key{Id: id}, nil))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiKeyChanges(before, after *apikey.Key) map[string]audit.Change {
+	fields := func(k *apikey.Key) map[string]string {
+		if k == nil {
+			return nil
+		}
+		scopes := make([]string, len(k.Scopes))
+		for i, p := range k.Scopes {
+			scopes[i] = string(p)
+		}
+		return map[string]string{"api_key": k.Id, "name": k.Name, "scopes": strings.Join(scopes, ",")}
+	}
+
+	return audit.Diff(fields(before), fields(after))
+}
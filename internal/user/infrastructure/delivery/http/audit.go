@@ -0,0 +1,103 @@
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"users/internal/audit"
+	slogger "users/pkg/logger"
+)
+
+// passwordChange is how a password change shows in the audit log.
+var passwordChange = audit.Change{From: audit.Redacted, To: audit.Redacted}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditRecord is the audit entry of a mutation made by the request, for the
+// repository to complete and append along with the mutation of a user.
+func auditRecord(r *http.Request, action string, changes map[string]audit.Change) *audit.Entry {
+	actor, _ := UserFromContext(r.Context())
+
+	return &audit.Entry{
+		Time:    time.Now(),
+		Actor:   actor.Username,
+		Action:  action,
+		Changes: changes,
+		IP:      clientIP(r),
+	}
+}
+
+// recordAudit appends a mutation of the target made by the request to the
+// audit log. The mutation is already done, so a failure is only logged.
+func (u *UserHandler) recordAudit(r *http.Request, action, target string, changes map[string]audit.Change) {
+	e := auditRecord(r, action, changes)
+	e.Target = target
+
+	_, err := u.Store.AuditLog().Append(*e)
+	if err != nil {
+		slogger.Logger.Error("error while recording audit entry", "action", action, "target", target, "err", err)
+	}
+}
+
+// AuditLog lists the audit entries matching the query, oldest first. The next
+// page starts after the seq of the last entry.
+func (u *UserHandler) AuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error params validation of AuditLog", "err", err)
+		return
+	}
+
+	entries, err := audit.List(u.Store.AuditLog(), filter)
+	if err != nil {
+		slogger.Logger.Error("error while listing audit log", "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(entries)
+	w.Write(b)
+}
+
+func parseAuditFilter(params url.Values) (audit.Filter, error) {
+	var (
+		filter audit.Filter
+		err    error
+	)
+
+	filter.Actor = params.Get("actor")
+	filter.Target = params.Get("target")
+	filter.Action = params.Get("action")
+
+	if filter.From, err = parseTime(params.Get("from")); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseTime(params.Get("to")); err != nil {
+		return filter, err
+	}
+
+	if after := params.Get("after"); after != "" {
+		if filter.After, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid after %q", after)
+		}
+	}
+
+	filter.Limit = defaultAuditLimit
+	if limit := params.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxAuditLimit {
+			return filter, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,87 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"users/config"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+	slogger "users/pkg/logger"
+)
+
+// Bootstrap creates the accounts of the bootstrap section of the config when
+// there are no users yet, and does nothing otherwise. Outside dev mode, it
+// refuses passwords breaking the password rules or equal to the username,
+// before creating any account.
+func Bootstrap(repo repository.UserRepository) error {
+	cfg := config.Cfg.Bootstrap
+
+	found, err := repo.HasUsers()
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+	if len(cfg.Users) == 0 {
+		slogger.Logger.Warn("no users and no bootstrap accounts, nobody can log in")
+		return nil
+	}
+
+	rules := passwordRules()
+	users := make([]dto.CreateUser, 0, len(cfg.Users))
+	for _, b := range cfg.Users {
+		password, err := bootstrapPassword(b)
+		if err != nil {
+			return fmt.Errorf("bootstrap user %q: %w", b.Username, err)
+		}
+
+		if !cfg.DevMode {
+			problems := rules.Check(password, b.Username, b.Email)
+			if strings.EqualFold(password, b.Username) {
+				problems = append(problems, "must not be the username")
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("bootstrap user %q: weak password: %s", b.Username, strings.Join(problems, ", "))
+			}
+		}
+
+		admin := b.Admin
+		user := dto.CreateUser{Username: b.Username, Email: b.Email, Password: password, Admin: &admin, MustChangePassword: b.MustChangePassword}
+		if err := user.Validate(); err != nil {
+			return fmt.Errorf("bootstrap user %q: %w", b.Username, err)
+		}
+		users = append(users, user)
+	}
+
+	for _, user := range users {
+		if _, err := repo.CreateUser(user, nil); err != nil {
+			return fmt.Errorf("bootstrap user %q: %w", user.Username, err)
+		}
+		slogger.Logger.Info("created bootstrap user", "username", user.Username, "admin", *user.Admin)
+	}
+	return nil
+}
+
+func bootstrapPassword(b config.BootstrapUser) (string, error) {
+	if b.PasswordEnv != "" {
+		if password := os.Getenv(b.PasswordEnv); password != "" {
+			return password, nil
+		}
+	}
+
+	if b.PasswordFile != "" {
+		content, err := os.ReadFile(b.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	if b.Password == "" {
+		return "", errors.New("no password")
+	}
+	return b.Password, nil
+}
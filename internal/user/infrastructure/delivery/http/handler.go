@@ -1,48 +1,220 @@
 package delivery
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"users/config"
+	"users/internal/apikey"
+	"users/internal/audit"
+	"users/internal/lockout"
+	"users/internal/mail"
+	"users/internal/password"
+	"users/internal/rbac"
+	"users/internal/reset"
+	"users/internal/session"
+	"users/internal/token"
+	"users/internal/totp"
 	"users/internal/user/infrastructure/dto"
 	"users/internal/user/infrastructure/repository"
 	slogger "users/pkg/logger"
 )
 
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+const uuidPattern = `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[1-5][0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}`
+
 var (
-	UserRe       = regexp.MustCompile(`^/user/\w*$`)
-	UserReWithID = regexp.MustCompile(`^/user/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[1-5][0-9a-fA-F]{3}-[89abAB][0-9a-fA-F]{3}-[0-9a-fA-F]{12}$`)
+	UserRe        = regexp.MustCompile(`^/user/$`)
+	UserReWithID  = regexp.MustCompile(`^/user/` + uuidPattern + `$`)
+	UserHistoryRe = regexp.MustCompile(`^/user/` + uuidPattern + `/history$`)
+	UserRestoreRe = regexp.MustCompile(`^/user/` + uuidPattern + `/restore$`)
+	UserRolesRe   = regexp.MustCompile(`^/user/` + uuidPattern + `/roles$`)
+	RoleRe        = regexp.MustCompile(`^/roles/[\w-]{1,64}$`)
+	LockoutRe     = regexp.MustCompile(`^/auth/lockouts/(user|ip):.+$`)
+	UserTOTPRe    = regexp.MustCompile(`^/user/` + uuidPattern + `/2fa$`)
+	APIKeyRe      = regexp.MustCompile(`^/user/me/keys/` + uuidPattern + `$`)
 )
 
 type UserHandler struct {
-	Store repository.UserRepository
+	Store    repository.UserRepository
+	Sessions *session.Manager
+	Cookies  CookieKeys
+	Tokens   *token.Issuer
+	Roles    *rbac.Authorizer
+	Lockouts *lockout.Guard
+	// TwoFactor enrolls the users in two-factor authentication and checks
+	// their one-time codes.
+	TwoFactor *totp.Manager
+	APIKeys   *apikey.Manager
+	Resets    *reset.Manager
+	// ResetLimits caps the reset requests per email and per IP.
+	ResetLimits *reset.Limiter
+	// Mailer sends the reset tokens, see RequestPasswordReset.
+	Mailer mail.Mailer
+	// Passwords are the rules new passwords must follow.
+	Passwords password.Rules
+
+	// mailing tracks the mails sent in the background, see Wait.
+	mailing *sync.WaitGroup
 }
 
 func (u *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/auth/login":
+		LogRequest(http.HandlerFunc(u.Login)).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/auth/logout":
+		LogRequest(http.HandlerFunc(u.Logout)).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/auth/token":
+		LogRequest(http.HandlerFunc(u.Token)).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/auth/password-reset":
+		LogRequest(http.HandlerFunc(u.RequestPasswordReset)).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/auth/password-reset/confirm":
+		LogRequest(http.HandlerFunc(u.ConfirmPasswordReset)).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/auth/revoke":
+		LogRequest(http.HandlerFunc(u.RevokeToken)).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/auth/lockouts":
+		u.authorized(rbac.LockoutsManage, u.ListLockouts).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodDelete && LockoutRe.MatchString(r.URL.Path):
+		u.authorized(rbac.LockoutsManage, u.ClearLockout).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/audit":
+		u.authorized(rbac.AuditRead, u.AuditLog).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/roles":
+		u.authorized(rbac.RolesManage, u.ListRoles).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/roles":
+		u.authorized(rbac.RolesManage, u.CreateRole).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPut && RoleRe.MatchString(r.URL.Path):
+		u.authorized(rbac.RolesManage, u.UpdateRole).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodDelete && RoleRe.MatchString(r.URL.Path):
+		u.authorized(rbac.RolesManage, u.DeleteRole).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && UserRolesRe.MatchString(r.URL.Path):
+		u.authorized(rbac.RolesManage, u.GetUserRoles).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPut && UserRolesRe.MatchString(r.URL.Path):
+		u.authorized(rbac.RolesManage, u.SetUserRoles).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/user/me":
+		u.authenticated(u.GetMe).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPatch && r.URL.Path == "/user/me":
+		u.authenticated(u.UpdateMe).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/user/me/password":
+		u.authenticated(u.ChangePassword).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/user/me/2fa":
+		u.authenticated(u.GetTwoFactor).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/user/me/2fa":
+		u.authenticated(u.EnrollTwoFactor).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/user/me/2fa/confirm":
+		u.authenticated(u.ConfirmTwoFactor).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodDelete && r.URL.Path == "/user/me/2fa":
+		u.authenticated(u.DisableTwoFactor).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/user/me/keys":
+		u.authenticated(u.ListAPIKeys).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && r.URL.Path == "/user/me/keys":
+		u.authenticated(u.CreateAPIKey).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodDelete && APIKeyRe.MatchString(r.URL.Path):
+		u.authenticated(u.RevokeAPIKey).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodDelete && UserTOTPRe.MatchString(r.URL.Path):
+		u.authorized(rbac.RolesManage, u.ResetTwoFactor).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/user/trash":
+		u.authorized(rbac.UsersDelete, u.ListDeletedUsers).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && r.URL.Path == "/user/search":
+		u.authorized(rbac.UsersRead, u.SearchUser).ServeHTTP(w, r)
+		return
+
 	case r.Method == http.MethodPost && UserRe.MatchString(r.URL.Path):
-		LogRequest(AuthRequiredCheck(u.Store, IsAdminCheck(http.HandlerFunc(u.CreateUser)))).ServeHTTP(w, r)
+		u.authorized(rbac.UsersWrite, u.CreateUser).ServeHTTP(w, r)
 		return
 
 	case r.Method == http.MethodGet && UserRe.MatchString(r.URL.Path):
-		LogRequest(AuthRequiredCheck(u.Store, http.HandlerFunc(u.ListUser))).ServeHTTP(w, r)
+		u.authorized(rbac.UsersRead, u.ListUser).ServeHTTP(w, r)
 		return
 
 	case r.Method == http.MethodGet && UserReWithID.MatchString(r.URL.Path):
-		LogRequest(AuthRequiredCheck(u.Store, http.HandlerFunc(u.GetUser))).ServeHTTP(w, r)
+		u.authorized(rbac.UsersRead, u.GetUser).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodGet && UserHistoryRe.MatchString(r.URL.Path):
+		u.authorized(rbac.UsersRead, u.UserHistory).ServeHTTP(w, r)
+		return
+
+	case r.Method == http.MethodPost && UserRestoreRe.MatchString(r.URL.Path):
+		u.authorized(rbac.UsersWrite, u.RestoreUser).ServeHTTP(w, r)
 		return
 
 	case r.Method == http.MethodPatch && UserReWithID.MatchString(r.URL.Path):
-		LogRequest(AuthRequiredCheck(u.Store, IsAdminCheck(http.HandlerFunc(u.UpdateUser)))).ServeHTTP(w, r)
+		u.authorized(rbac.UsersWrite, u.UpdateUser).ServeHTTP(w, r)
 		return
 
 	case r.Method == http.MethodDelete && UserReWithID.MatchString(r.URL.Path):
-		LogRequest(AuthRequiredCheck(u.Store, IsAdminCheck(http.HandlerFunc(u.DeleteUser)))).ServeHTTP(w, r)
+		u.authorized(rbac.UsersDelete, u.DeleteUser).ServeHTTP(w, r)
 		return
 
 	default:
@@ -51,6 +223,17 @@ func (u *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authenticated wraps a handler for any authenticated user, whatever its
+// permissions. These manage the account, so API keys aren't accepted.
+func (u *UserHandler) authenticated(h http.HandlerFunc) http.Handler {
+	return LogRequest(AuthRequiredCheck(u.Store, u.Sessions, u.Cookies, u.Tokens, u.Lockouts, u.TwoFactor, u.APIKeys, RejectAPIKey(h)))
+}
+
+// authorized wraps a handler for the authenticated users with the permission.
+func (u *UserHandler) authorized(permission rbac.Permission, h http.HandlerFunc) http.Handler {
+	return LogRequest(AuthRequiredCheck(u.Store, u.Sessions, u.Cookies, u.Tokens, u.Lockouts, u.TwoFactor, u.APIKeys, RequirePermission(u.Roles, permission, h)))
+}
+
 func (u *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	user := &dto.CreateUser{}
 	if err := json.NewDecoder(r.Body).Decode(user); err != nil {
@@ -59,18 +242,24 @@ func (u *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := user.Validate(); err != nil {
 		BadRequestHandler(w, r)
-		slogger.Logger.Info("error while user creation validation: %s", err)
+		slogger.Logger.Info("error while user creation validation", "err", err)
 		return
 	}
-
-	if _, ok := u.Store.GetCredentialsByUsername(user.Username); ok {
-		slogger.Logger.Info("username miss while creating", "username:", user.Username)
-		AlreadyExistsHandler(w, r)
+	if *user.Admin && !u.requireRolesManage(w, r) {
+		return
+	}
+	if !u.checkNewPassword(w, r, "password", user.Password, user.Username, user.Email) {
 		return
 	}
 
-	id, err := u.Store.CreateUser(*user)
+	record := auditRecord(r, "create", map[string]audit.Change{"password": {To: audit.Redacted}})
+	id, err := u.Store.CreateUser(*user, record)
 
+	if errors.Is(err, repository.ErrAlreadyExists) {
+		slogger.Logger.Info("user already exists", "username:", user.Username, "email:", user.Email, "err", err)
+		AlreadyExistsHandler(w, r, err)
+		return
+	}
 	if err != nil {
 		InternalServerErrorHandler(w, r)
 		return
@@ -80,38 +269,132 @@ func (u *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u *UserHandler) ListUser(w http.ResponseWriter, r *http.Request) {
-	var limit_value, offset_value int
+	query, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error params validation of ListUser", "err", err)
+		return
+	}
+	// the plain array stays the default for the clients written before paging
+	envelope, err := strconv.ParseBool(r.URL.Query().Get("envelope"))
+	if err != nil && r.URL.Query().Has("envelope") {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error params validation of ListUser", "envelope", r.URL.Query().Get("envelope"))
+		return
+	}
 
-	params := r.URL.Query()
+	users, err := u.Store.GetUserList(query)
+
+	switch {
+	case errors.Is(err, repository.ErrInvalidCursor):
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error params validation of ListUser", "cursor", query.Cursor, "err", err)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while listing users", "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
 
-	limit, offset := params.Get("limit"), params.Get("offset")
+	StatusListUserHandler(w, r, users, envelope)
+}
 
-	if limit == "" || offset == "" {
+// parseListQuery reads the paging, filtering and sorting parameters of the
+// user list. sort takes a sortable field, prefixed with "-" for the
+// descending order.
+func parseListQuery(params url.Values) (dto.ListQuery, error) {
+	var (
+		query dto.ListQuery
+		err   error
+	)
+
+	query.Cursor = params.Get("cursor")
+
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 0 {
+			return query, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
 
-		users := u.Store.GetUserList(limit_value, offset_value)
-		StatusListUserHandler(w, r, users)
-		return
+	if offset := params.Get("offset"); offset != "" {
+		query.Offset, err = strconv.Atoi(offset)
+		if err != nil || query.Offset < 0 || query.Cursor != "" {
+			return query, fmt.Errorf("invalid offset %q", offset)
+		}
+	}
 
-	} else {
+	if sort := params.Get("sort"); sort != "" {
+		query.Sort, query.Desc = strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+		if !slices.Contains(dto.SortableFields, query.Sort) {
+			return query, fmt.Errorf("invalid sort %q", sort)
+		}
+	}
 
-		limit_value, err := strconv.Atoi(limit)
+	query.Filter.UsernamePrefix = params.Get("username_prefix")
+	query.Filter.EmailDomain = params.Get("email_domain")
+
+	if admin := params.Get("admin"); admin != "" {
+		value, err := strconv.ParseBool(admin)
 		if err != nil {
-			BadRequestHandler(w, r)
-			slogger.Logger.Info("error params validation of ListUser", "err", err)
-			return
+			return query, fmt.Errorf("invalid admin %q", admin)
 		}
+		query.Filter.Admin = &value
+	}
 
-		offset_value, err = strconv.Atoi(offset)
-		if err != nil {
+	if query.Filter.CreatedFrom, err = parseTime(params.Get("created_from")); err != nil {
+		return query, err
+	}
+	if query.Filter.CreatedTo, err = parseTime(params.Get("created_to")); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func (u *UserHandler) SearchUser(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error params validation of SearchUser", "q", q)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
 			BadRequestHandler(w, r)
-			slogger.Logger.Info("error params validation of ListUser", "err", err)
+			slogger.Logger.Info("error params validation of SearchUser", "limit", l, "err", err)
 			return
 		}
+	}
 
-		users := u.Store.GetUserList(limit_value, offset_value)
-		StatusListUserHandler(w, r, users)
+	users, err := u.Store.SearchUsers(q, limit)
+	if err != nil {
+		slogger.Logger.Error("error while searching users", "q", q, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(users)
+	w.Write(b)
 }
 
 func (u *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -119,47 +402,108 @@ func (u *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	user := &dto.UpdateUser{}
 
 	if err := json.NewDecoder(r.Body).Decode(user); err != nil {
-		slogger.Logger.Info("error while UpdateUser decoding: %s", err)
+		slogger.Logger.Info("error while UpdateUser decoding", "err", err)
 		InternalServerErrorHandler(w, r)
 		return
 	}
 
 	if err := user.Validate(); err != nil {
-		slogger.Logger.Info("error while UpdateUser validation: %s", err)
+		slogger.Logger.Info("error while UpdateUser validation", "err", err)
 		BadRequestHandler(w, r)
 		return
 	}
+	if user.Admin != nil && !u.requireRolesManage(w, r) {
+		return
+	}
 	id := strings.TrimPrefix(r.URL.Path, "/user/")
-
-	if ok := u.Store.IfUserExist(id); !ok {
-		NotFoundHandler(w, r)
+	if (user.Password != "" || user.Email != "" || user.MustChangePassword != nil) && !u.requireRolesManageFor(w, r, id) {
 		return
 	}
 
-	_, ok := u.Store.GetCredentialsByUsername(id)
+	if user.Password != "" {
+		username, email := user.Username, user.Email
+		if u.Store.IfUserExist(id) {
+			current := u.Store.GetUserById(id)
+			username, email = cmp.Or(username, current.Username), cmp.Or(email, current.Email)
+		}
+		if !u.checkNewPassword(w, r, "password", user.Password, username, email) {
+			return
+		}
+	}
+
+	u.updateUser(w, r, id, *user)
+}
 
-	if u.Store.GetUserById(id).Username != user.Username && ok {
-		slogger.Logger.Info("username already exists", "username:", user.Username)
-		AlreadyExistsHandler(w, r)
-		return
+// updateUser applies the update to the user, the If-Match header of the
+// request permitting, and records it.
+func (u *UserHandler) updateUser(w http.ResponseWriter, r *http.Request, id string, user dto.UpdateUser) {
+	if u.saveUpdate(w, r, id, user) {
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
 
-	u.Store.UpdateUser(id, *user)
+// saveUpdate is updateUser without the response on success, it tells whether
+// the update was saved.
+func (u *UserHandler) saveUpdate(w http.ResponseWriter, r *http.Request, id string, user dto.UpdateUser) bool {
+	version, ok := parseIfMatch(r.Header.Get("If-Match"))
+	if !ok {
+		PreconditionFailedHandler(w, r)
+		return false
+	}
 
-	w.WriteHeader(http.StatusNoContent)
+	record := auditRecord(r, "update", nil)
+	if user.Password != "" {
+		record.Changes = map[string]audit.Change{"password": passwordChange}
+	}
+	err := u.Store.UpdateUser(id, user, version, record)
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		NotFoundHandler(w, r)
+		return false
+	case errors.Is(err, repository.ErrVersionMismatch):
+		PreconditionFailedHandler(w, r)
+		return false
+	case errors.Is(err, repository.ErrAlreadyExists):
+		slogger.Logger.Info("user already exists", "username:", user.Username, "email:", user.Email, "err", err)
+		AlreadyExistsHandler(w, r, err)
+		return false
+	case err != nil:
+		slogger.Logger.Error("error while updating user", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return false
+	}
 
+	return true
 }
 
 func (u *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 
 	id := strings.TrimPrefix(r.URL.Path, "/user/")
+	if !u.requireRolesManageFor(w, r, id) {
+		return
+	}
 
-	if ok := u.Store.IfUserExist(id); !ok {
-		NotFoundHandler(w, r)
+	version, ok := parseIfMatch(r.Header.Get("If-Match"))
+	if !ok {
+		PreconditionFailedHandler(w, r)
 		return
 	}
 
-	u.Store.DeleteUser(id)
+	err := u.Store.DeleteUser(id, version, auditRecord(r, "delete", nil))
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		NotFoundHandler(w, r)
+		return
+	case errors.Is(err, repository.ErrVersionMismatch):
+		PreconditionFailedHandler(w, r)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while deleting user", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 
@@ -169,6 +513,11 @@ func (u *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 
 	id := strings.TrimPrefix(r.URL.Path, "/user/")
 
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		u.getUserAsOf(w, r, id, asOf)
+		return
+	}
+
 	if ok := u.Store.IfUserExist(id); !ok {
 		NotFoundHandler(w, r)
 		return
@@ -176,12 +525,166 @@ func (u *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 
 	user := u.Store.GetUserById(id)
 
+	w.Header().Set("ETag", etag(user.Version))
 	StatusOkContent(w, r, user)
 }
 
+// getUserAsOf responds with the user as it was at the time, without an ETag
+// as it's not the current version.
+func (u *UserHandler) getUserAsOf(w http.ResponseWriter, r *http.Request, id, asOf string) {
+	at, err := parseTime(asOf)
+	if err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error params validation of GetUser", "as_of", asOf, "err", err)
+		return
+	}
+
+	user, err := u.Store.GetUserAsOf(id, at)
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		NotFoundHandler(w, r)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while getting user", "id", id, "as_of", asOf, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	StatusOkContent(w, r, user)
+}
+
+func (u *UserHandler) UserHistory(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/user/"), "/history")
+
+	history, err := u.Store.GetUserHistory(id)
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		NotFoundHandler(w, r)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while getting user history", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(history)
+	w.Write(b)
+}
+
+func (u *UserHandler) ListDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := u.Store.ListDeletedUsers()
+	if err != nil {
+		slogger.Logger.Error("error while listing deleted users", "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(users)
+	w.Write(b)
+}
+
+func (u *UserHandler) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/user/"), "/restore")
+
+	// without a body the user is taken out of the trash
+	restore := &dto.RestoreUser{}
+	if err := json.NewDecoder(r.Body).Decode(restore); err != nil && !errors.Is(err, io.EOF) {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while RestoreUser decoding", "err", err)
+		return
+	}
+	if err := restore.Validate(); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while RestoreUser validation", "err", err)
+		return
+	}
+	if restore.Version != 0 && u.restoresAdmin(id, restore.Version) && !u.requireRolesManage(w, r) {
+		return
+	}
+
+	version, ok := parseIfMatch(r.Header.Get("If-Match"))
+	if !ok {
+		PreconditionFailedHandler(w, r)
+		return
+	}
+
+	var err error
+	if restore.Version == 0 {
+		err = u.Store.UndeleteUser(id, version, auditRecord(r, "undelete", nil))
+	} else {
+		err = u.Store.RestoreUser(id, restore.Version, version, auditRecord(r, "restore", nil))
+	}
+
+	switch {
+	case errors.Is(err, repository.ErrNotFound), errors.Is(err, repository.ErrVersionNotFound):
+		NotFoundHandler(w, r)
+		return
+	case errors.Is(err, repository.ErrVersionMismatch):
+		PreconditionFailedHandler(w, r)
+		return
+	case errors.Is(err, repository.ErrAlreadyExists):
+		slogger.Logger.Info("user already exists", "id", id, "version", restore.Version, "err", err)
+		AlreadyExistsHandler(w, r, err)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while restoring user", "id", id, "version", restore.Version, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// etag is the entity tag of a user version.
+func etag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parseIfMatch returns the version an If-Match header requires, nil when the
+// header is absent or "*". A header that can't match any version, like a weak
+// or a malformed tag, gives ok false. Only a single tag is supported, as there
+// is only one current version to compare with.
+func parseIfMatch(header string) (version *uint64, ok bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return nil, true
+	}
+
+	tag, err := strconv.Unquote(header)
+	if err != nil || !strings.HasPrefix(header, `"`) {
+		return nil, false
+	}
+	v, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	return &v, true
+}
+
 func NewUserHandler(s repository.UserRepository) *UserHandler {
 	return &UserHandler{
-		Store: s,
+		Store:    s,
+		Sessions: session.NewManager(s.Sessions(), config.Cfg.Session.TTL),
+		Cookies:  newCookieKeys(),
+		Tokens:   newIssuer(s.RefreshTokens()),
+		Roles:    rbac.NewAuthorizer(s.Roles()),
+		Lockouts: newGuard(),
+
+		TwoFactor: totp.NewManager(s.TwoFactor(), config.Cfg.TOTP.Issuer),
+		APIKeys:   apikey.NewManager(s.APIKeys()),
+		Resets:    reset.NewManager(s.PasswordResets(), config.Cfg.PasswordReset.TTL),
+		Mailer:    newMailer(),
+		Passwords: passwordRules(),
+
+		ResetLimits: newResetLimiter(),
+		mailing:     &sync.WaitGroup{},
 	}
 }
 
@@ -199,12 +702,68 @@ func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(b))
 }
 
-func AlreadyExistsHandler(w http.ResponseWriter, r *http.Request) {
+// AlreadyExistsHandler responds with the field that collided when err is a
+// repository.ConflictError.
+func AlreadyExistsHandler(w http.ResponseWriter, r *http.Request, err error) {
+	message := "user already exists"
+	var conflict *repository.ConflictError
+	if errors.As(err, &conflict) {
+		message = conflict.Error()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusConflict)
-	b, _ := json.Marshal(`{"Error": "409 Conflict", "message": "username already exists"}`)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "409 Conflict", Message: message})
 	w.Write([]byte(b))
 }
+func UnauthorizedHandler(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "401 Unauthorized", Message: message})
+	w.Write([]byte(b))
+}
+
+func ForbiddenHandler(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "403 Forbidden", Message: message})
+	w.Write([]byte(b))
+}
+
+// TooManyRequestsHandler tells the client why it is held back and for how
+// long.
+func TooManyRequestsHandler(w http.ResponseWriter, r *http.Request, message string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "429 Too Many Requests", Message: message})
+	w.Write([]byte(b))
+}
+
+// InvalidFieldsHandler is BadRequestHandler telling what is wrong with each
+// field.
+func InvalidFieldsHandler(w http.ResponseWriter, r *http.Request, fields map[string][]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "400 Bad request", Fields: fields})
+	w.Write([]byte(b))
+}
+
+// BadRequestMessageHandler is BadRequestHandler telling what is wrong.
+func BadRequestMessageHandler(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "400 Bad request", Message: message})
+	w.Write([]byte(b))
+}
+
+func PreconditionFailedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	b, _ := json.Marshal(dto.ErrorResponse{Error: "412 Precondition Failed", Message: "user was changed since the If-Match version"})
+	w.Write([]byte(b))
+}
+
 func BadRequestHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusBadRequest)
@@ -219,9 +778,20 @@ func StatusCreatedHandler(w http.ResponseWriter, r *http.Request, id string) {
 	w.Write([]byte(b))
 }
 
-func StatusListUserHandler(w http.ResponseWriter, r *http.Request, users []dto.ListUser) {
+// StatusListUserHandler writes the users as an array, or the whole page when
+// envelope is set. The next cursor goes to the X-Next-Cursor header either way.
+func StatusListUserHandler(w http.ResponseWriter, r *http.Request, users dto.UserPage, envelope bool) {
 	w.Header().Set("Content-Type", "application/json")
-	data, _ := json.Marshal(users)
+	if users.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", users.NextCursor)
+	}
+
+	var data []byte
+	if envelope {
+		data, _ = json.Marshal(users)
+	} else {
+		data, _ = json.Marshal(users.Users)
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
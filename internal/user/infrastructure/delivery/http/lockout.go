@@ -0,0 +1,59 @@
+package delivery
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"users/config"
+	"users/internal/lockout"
+)
+
+// newGuard builds the lockout guard from the config, see config.AppConfig.
+func newGuard() *lockout.Guard {
+	cfg := config.Cfg.Lockout
+	return lockout.NewGuard(lockout.Policy{
+		Threshold:   cfg.Threshold,
+		IPThreshold: cfg.IPThreshold,
+		BaseDelay:   cfg.BaseDelay,
+		MaxDelay:    cfg.MaxDelay,
+		Window:      cfg.Window,
+	})
+}
+
+// clientIP is the IP the request comes from, proxies aside.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// ListLockouts lists the usernames and IPs with recent failed logins, locked
+// out or not yet.
+func (u *UserHandler) ListLockouts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(u.Lockouts.List(time.Now()))
+	w.Write(b)
+}
+
+// ClearLockout forgets the failed logins of a username, "user:{username}", or
+// of an IP, "ip:{ip}", lifting its lockout.
+func (u *UserHandler) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/auth/lockouts/")
+	if username, ok := strings.CutPrefix(key, "user:"); ok {
+		key = lockout.UserKey(username)
+	}
+
+	if !u.Lockouts.Clear(key) {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "lockout_clear", key, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
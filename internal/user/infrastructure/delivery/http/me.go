@@ -0,0 +1,154 @@
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"users/internal/mail"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// GetMe responds with the profile of the authenticated user.
+func (u *UserHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+	if !u.Store.IfUserExist(me.Id) {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	user := u.Store.GetUserById(me.Id)
+
+	w.Header().Set("ETag", etag(user.Version))
+	StatusOkContent(w, r, user)
+}
+
+// UpdateMe changes the username or email of the authenticated user, anything
+// else is refused: the admin flag takes roles:manage, the password the
+// current one, see ChangePassword. Changing the email takes the current
+// password too, as the email is where the password resets go, and the old
+// address is told about it.
+func (u *UserHandler) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	profile := &dto.UpdateProfile{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(profile); err != nil {
+		slogger.Logger.Info("error while UpdateMe decoding", "err", err)
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+	if err := profile.Validate(); err != nil {
+		slogger.Logger.Info("error while UpdateMe validation", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+
+	if !u.Store.IfUserExist(me.Id) {
+		NotFoundHandler(w, r)
+		return
+	}
+	user := u.Store.GetUserById(me.Id)
+
+	emailChanged := profile.Email != "" && !strings.EqualFold(profile.Email, user.Email)
+	if emailChanged {
+		if profile.CurrentPassword == "" {
+			ForbiddenHandler(w, r, "current password is required to change the email")
+			return
+		}
+		if !u.checkCurrentPassword(w, r, user, profile.CurrentPassword) {
+			return
+		}
+	}
+
+	if !u.saveUpdate(w, r, me.Id, profile.ToUpdateUser()) {
+		return
+	}
+
+	if emailChanged {
+		u.inBackground(func() {
+			err := u.Mailer.Send(mail.Message{To: user.Email, Subject: "Your email was changed",
+				Body: fmt.Sprintf("Hello %s,\n\nThe email of your account was just changed to %s. If it wasn't you, contact an administrator right away.\n", user.Username, profile.Email)})
+			if err != nil {
+				slogger.Logger.Error("error while mailing email change", "id", user.Id, "err", err)
+			}
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword sets a new password for the authenticated user given its
+// current one. Wrong current passwords count as failed logins, see
+// lockout.Guard. Whoever knew the old password may hold a session, a token or
+// a key, so they are all revoked but the session of the request.
+func (u *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	change := &dto.ChangePassword{}
+	if err := json.NewDecoder(r.Body).Decode(change); err != nil {
+		slogger.Logger.Info("error while ChangePassword decoding", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+	if err := change.Validate(); err != nil {
+		slogger.Logger.Info("error while ChangePassword validation", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+
+	if !u.Store.IfUserExist(me.Id) {
+		NotFoundHandler(w, r)
+		return
+	}
+	user := u.Store.GetUserById(me.Id)
+
+	if !u.checkCurrentPassword(w, r, user, change.CurrentPassword) {
+		return
+	}
+	if !u.checkNewPassword(w, r, "new_password", change.NewPassword, user.Username, user.Email) {
+		return
+	}
+
+	// the password the user chose isn't a temporary one
+	temporary := false
+	if !u.saveUpdate(w, r, me.Id, dto.UpdateUser{Password: change.NewPassword, MustChangePassword: &temporary}) {
+		return
+	}
+
+	if err := u.revokeAccess(me.Id, me.Session); err != nil {
+		slogger.Logger.Error("error while revoking access after password change", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCurrentPassword responds with 403 unless the password is the one of
+// the user, wrong ones count as failed logins, see lockout.Guard. It tells
+// whether the password is right.
+func (u *UserHandler) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user dto.ListUser, password string) bool {
+	attempt, retryAfter := u.Lockouts.Begin(user.Username, clientIP(r), time.Now())
+	if attempt == nil {
+		TooManyRequestsHandler(w, r, "too many failed logins, retry later", retryAfter)
+		return false
+	}
+	defer attempt.Release()
+
+	credentials, ok := u.Store.GetCredentialsByUsername(user.Username)
+	if !ok || credentials.Id != user.Id || !dto.CheckPassword(password, credentials.Password) {
+		slogger.Logger.Info("wrong current password", "username", user.Username)
+		if retryAfter := attempt.Fail(); retryAfter > 0 {
+			TooManyRequestsHandler(w, r, "too many failed logins, retry later", retryAfter)
+			return false
+		}
+		ForbiddenHandler(w, r, "current password is wrong")
+		return false
+	}
+	attempt.Succeed()
+	return true
+}
@@ -2,43 +2,117 @@ package delivery
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 	"users/config"
+	"users/internal/apikey"
 	"users/internal/cookies"
+	"users/internal/lockout"
+	"users/internal/rbac"
+	"users/internal/session"
+	"users/internal/token"
+	"users/internal/totp"
 	"users/internal/user/infrastructure/dto"
 	"users/internal/user/infrastructure/repository"
 	slogger "users/pkg/logger"
 )
 
-func AuthRequiredCheck(repo repository.UserRepository, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// AuthUser is the user a request is made by, see UserFromContext.
+type AuthUser struct {
+	Id       string
+	Username string
+	Admin    bool
+	// SecondFactor is set when the user gave a one-time code at login.
+	SecondFactor bool
+	// Session is the id of the session the request was made in, if any.
+	Session string
+	// APIKey is the key the request was made with, if any, which limits it to
+	// the scopes of the key.
+	APIKey *apikey.Key
+	// MustChangePassword is set while the user has a temporary password.
+	MustChangePassword bool
+}
 
-		username, password, ok := r.BasicAuth()
+type contextKey int
 
-		var loggingCredentials = dto.AuthPermission{Password: password}
+const authUserKey contextKey = 0
 
-		if ok {
-			dbCredentials, ok := repo.GetCredentialsByUsername(username)
+// UserFromContext returns the user AuthRequiredCheck let the request through
+// for.
+func UserFromContext(ctx context.Context) (AuthUser, bool) {
+	user, ok := ctx.Value(authUserKey).(AuthUser)
+	return user, ok
+}
 
-			if ok && dto.CheckPassword(loggingCredentials.Password, dbCredentials.Password) {
-				if *dbCredentials.Admin {
-					setRoleCookieHandler(w, r, "admin")
-					next.ServeHTTP(w, r)
-					return
+// AuthRequiredCheck lets the request through with a valid session cookie, see
+// Login, or else with a valid API key in the X-API-Key header or as a Bearer
+// token, see CreateAPIKey, or a valid Bearer access token, see Token, or valid
+// Basic auth credentials, along with a one-time code in the X-OTP header for
+// the users with two-factor authentication. Failed Basic auth counts towards
+// the lockouts of the guard, a locked out request gets 429.
+func AuthRequiredCheck(repo repository.UserRepository, sessions *session.Manager, cookieKeys CookieKeys, tokens *token.Issuer, guard *lockout.Guard, factors *totp.Manager, keys *apikey.Manager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-				} else {
-					setRoleCookieHandler(w, r, "user")
-					next.ServeHTTP(w, r)
-					return
+		if user, ok := sessionUser(w, r, repo, sessions, cookieKeys); ok {
+			serveAs(w, r, user, next)
+			return
+		}
 
-				}
+		scheme, access, bearer := strings.Cut(r.Header.Get("Authorization"), " ")
+		bearer = bearer && strings.EqualFold(scheme, "Bearer")
+		access = strings.TrimSpace(access)
+
+		key := r.Header.Get(apiKeyHeader)
+		if key == "" && bearer && strings.HasPrefix(access, apikey.Prefix) {
+			key = access
+		}
+		if key != "" {
+			user, err := keyUser(repo, keys, key)
+			if err == nil {
+				serveAs(w, r, user, next)
+				return
+			}
+			if !errors.Is(err, apikey.ErrInvalidKey) {
+				slogger.Logger.Error("error while checking api key", "err", err)
+				InternalServerErrorHandler(w, r)
+				return
+			}
+			slogger.Logger.Info("Unauthorized access", "scheme", "api key")
+			UnauthorizedHandler(w, r, err.Error())
+			return
+		}
 
+		if bearer {
+			if user, ok := tokenUser(repo, tokens, access); ok {
+				serveAs(w, r, user, next)
+				return
 			}
+			slogger.Logger.Info("Unauthorized access", "scheme", "Bearer")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 
+		username, password, ok := r.BasicAuth()
+
+		if ok {
+			l, err := authenticate(repo, guard, factors, r, username, password, r.Header.Get(otpHeader), true)
+			if err == nil {
+				serveAs(w, r, AuthUser{Id: l.credentials.Id, Username: username, Admin: *l.credentials.Admin, SecondFactor: l.secondFactor, MustChangePassword: l.credentials.MustChangePassword}, next)
+				return
+			}
+			if !errors.Is(err, errWrongCredentials) || l.retryAfter > 0 {
+				loginFailed(w, r, l, err)
+				return
+			}
 		}
 		slogger.Logger.Info("Unauthorized access", "username", username)
 		w.Header().Set("WWW-Authenticate", `Basic realm="username/password", charset="UTF-8"`)
@@ -46,73 +120,267 @@ func AuthRequiredCheck(repo repository.UserRepository, next http.Handler) http.H
 	})
 }
 
-func IsAdminCheck(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		role, err := getCookieHandler(r)
-		if err != nil {
-			switch {
-			case errors.Is(err, http.ErrNoCookie):
-				http.Error(w, "Unallowed action", http.StatusForbidden)
-				return
-			case errors.Is(err, cookies.ErrInvalidValue):
-				http.Error(w, "Unallowed action", http.StatusForbidden)
-				return
-			default:
-				log.Println(err)
-				http.Error(w, "server error", http.StatusInternalServerError)
-				return
+const (
+	// otpHeader carries the one-time code along with Basic auth credentials.
+	otpHeader = "X-OTP"
+	// apiKeyHeader carries an API key, it may be sent as a Bearer token too.
+	apiKeyHeader = "X-API-Key"
+)
 
-			}
+var (
+	errWrongCredentials = errors.New("wrong username or password")
+	errCodeRequired     = errors.New("one-time code required")
+	errWrongCode        = errors.New("wrong one-time code")
+	errLockedOut        = errors.New("too many failed logins")
+)
+
+// login is what authenticate found out.
+type login struct {
+	credentials  dto.AuthPermission
+	secondFactor bool          // the one-time code was checked
+	retryAfter   time.Duration // set once locked out
+}
+
+// authenticate checks the password of the username, then the one-time code
+// for the users with two-factor authentication, unless the username or the IP
+// of the request is locked out. Wrong passwords and codes count towards the
+// lockouts, see lockout.Guard.Begin. Basic auth sends the code with every
+// request, so basic accepts the code again, but no recovery code, see
+// totp.Manager.VerifyRepeated.
+func authenticate(repo repository.UserRepository, guard *lockout.Guard, factors *totp.Manager, r *http.Request, username, password, code string, basic bool) (login, error) {
+	ip, now := clientIP(r), time.Now()
+
+	attempt, retryAfter := guard.Begin(username, ip, now)
+	if attempt == nil {
+		slogger.Logger.Info("locked out login", "username", username, "ip", ip)
+		return login{retryAfter: retryAfter}, errLockedOut
+	}
+	defer attempt.Release()
 
+	credentials, ok := repo.GetCredentialsByUsername(username)
+	if !ok || !checkPassword(repo, credentials, password) {
+		return login{retryAfter: attempt.Fail()}, errWrongCredentials
+	}
+
+	enabled, err := factors.Enabled(credentials.Id)
+	if err != nil {
+		return login{}, err
+	}
+	if enabled {
+		if code == "" {
+			return login{}, errCodeRequired
 		}
-		if role == "admin" {
-			next.ServeHTTP(w, r)
-			return
-		} else {
-			http.Error(w, "Unallowed action", http.StatusForbidden)
-			return
+		verify := factors.Verify
+		if basic {
+			verify = factors.VerifyRepeated
 		}
+		err := verify(credentials.Id, code, now)
+		if errors.Is(err, totp.ErrInvalidCode) {
+			return login{retryAfter: attempt.Fail()}, errWrongCode
+		}
+		if err != nil {
+			return login{}, err
+		}
+	}
 
-	})
+	attempt.Succeed()
+	return login{credentials: credentials, secondFactor: enabled}, nil
 }
 
-func setRoleCookieHandler(w http.ResponseWriter, r *http.Request, userRole string) {
+// loginFailed responds to a failed authenticate.
+func loginFailed(w http.ResponseWriter, r *http.Request, l login, err error) {
+	switch {
+	case l.retryAfter > 0:
+		TooManyRequestsHandler(w, r, "too many failed logins, retry later", l.retryAfter)
+	case errors.Is(err, errWrongCredentials), errors.Is(err, errCodeRequired), errors.Is(err, errWrongCode):
+		slogger.Logger.Info("failed login", "err", err)
+		UnauthorizedHandler(w, r, err.Error())
+	default:
+		slogger.Logger.Error("error while authenticating", "err", err)
+		InternalServerErrorHandler(w, r)
+	}
+}
 
-	cookie := http.Cookie{
-		Name:     "Role",
-		Value:    userRole,
-		Path:     "/",
-		MaxAge:   3600 * 12,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
+// mustChangePassword tells whether the user has a temporary password, see
+// dto.AuthPermission.
+func mustChangePassword(repo repository.UserRepository, username string) bool {
+	credentials, _ := repo.GetCredentialsByUsername(username)
+	return credentials.MustChangePassword
+}
+
+// secondFactorMissing tells whether the user is an admin who logged in
+// without a one-time code while the config requires one.
+func secondFactorMissing(user AuthUser) bool {
+	return config.Cfg.TOTP.RequireForAdmins && user.Admin && !user.SecondFactor
+}
+
+// checkPassword verifies the password of the credentials, rehashing it when
+// its hash is behind the current policy, see dto.PasswordPolicy.
+func checkPassword(repo repository.UserRepository, credentials dto.AuthPermission, password string) bool {
+	if !dto.CheckPassword(password, credentials.Password) {
+		return false
 	}
 
-	secretKey, err := hex.DecodeString(config.Cfg.Token.Secret)
+	if credentials.Id != "" && dto.NeedsRehash(credentials.Password) {
+		hash, err := dto.HashPassword(password)
+		if err == nil {
+			err = repo.RehashPassword(credentials.Id, credentials.Password, hash)
+		}
+		if err != nil {
+			slogger.Logger.Error("error while rehashing password", "id", credentials.Id, "err", err)
+		}
+	}
+	return true
+}
+
+// tokenUser returns the user of a valid access token.
+func tokenUser(repo repository.UserRepository, tokens *token.Issuer, access string) (AuthUser, bool) {
+	claims, err := tokens.VerifyClaims(strings.TrimSpace(access))
+	if err != nil || !repo.IfUserExist(claims.Subject) {
+		return AuthUser{}, false
+	}
+
+	user := repo.GetUserById(claims.Subject)
+	return AuthUser{Id: user.Id, Username: user.Username, Admin: user.Admin, SecondFactor: claims.SecondFactor(), MustChangePassword: mustChangePassword(repo, user.Username)}, true
+}
+
+// keyUser returns the user of a valid API key, apikey.ErrInvalidKey when the
+// key is unknown, expired or its user deleted.
+func keyUser(repo repository.UserRepository, keys *apikey.Manager, value string) (AuthUser, error) {
+	key, err := keys.Authenticate(strings.TrimSpace(value), time.Now())
 	if err != nil {
-		log.Fatal(err)
+		return AuthUser{}, err
+	}
+	if !repo.IfUserExist(key.UserId) {
+		return AuthUser{}, apikey.ErrInvalidKey
+	}
+
+	user := repo.GetUserById(key.UserId)
+	return AuthUser{Id: user.Id, Username: user.Username, Admin: user.Admin, SecondFactor: key.SecondFactor, APIKey: &key, MustChangePassword: mustChangePassword(repo, user.Username)}, nil
+}
+
+func serveAs(w http.ResponseWriter, r *http.Request, user AuthUser, next http.Handler) {
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey, user)))
+}
+
+// sessionUser returns the user of the session cookie of the request, renewing
+// the cookie along with the session.
+func sessionUser(w http.ResponseWriter, r *http.Request, repo repository.UserRepository, sessions *session.Manager, cookieKeys CookieKeys) (AuthUser, bool) {
+	id, err := readSessionCookie(r, cookieKeys)
+	if err != nil {
+		return AuthUser{}, false
 	}
 
-	err = cookies.WriteSigned(w, r, &cookie, secretKey)
+	s, renewed, err := sessions.Check(id, time.Now())
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "server error", http.StatusInternalServerError)
-		return
+		if !errors.Is(err, session.ErrNotFound) {
+			slogger.Logger.Error("error while checking session", "err", err)
+		}
+		return AuthUser{}, false
+	}
+	// the user may have been deleted since the login
+	if !repo.IfUserExist(s.UserId) {
+		return AuthUser{}, false
+	}
+
+	if renewed {
+		setSessionCookie(w, r, cookieKeys, id, sessions.TTL())
 	}
+
+	user := repo.GetUserById(s.UserId)
+	return AuthUser{Id: user.Id, Username: user.Username, Admin: user.Admin, SecondFactor: s.SecondFactor, Session: id, MustChangePassword: mustChangePassword(repo, user.Username)}, true
 }
 
-func getCookieHandler(r *http.Request) (string, error) {
+// RequirePermission lets the request through when the user AuthRequiredCheck
+// authenticated has the permission through any of its roles, and the API key
+// of the request, if any, is scoped for it. Admins must have given a one-time
+// code when the config requires it, users with a temporary password must
+// change it first.
+func RequirePermission(roles *rbac.Authorizer, permission rbac.Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unallowed action", http.StatusForbidden)
+			return
+		}
 
-	secretKey, err := hex.DecodeString(config.Cfg.Token.Secret)
+		if secondFactorMissing(user) {
+			ForbiddenHandler(w, r, "admins must log in with a one-time code")
+			return
+		}
+		if user.MustChangePassword {
+			ForbiddenHandler(w, r, "password change required")
+			return
+		}
+
+		allowed, err := roles.Can(user.Id, user.Admin, permission)
+		if err != nil {
+			slogger.Logger.Error("error while checking permission", "user", user.Id, "permission", permission, "err", err)
+			InternalServerErrorHandler(w, r)
+			return
+		}
+		if !allowed {
+			slogger.Logger.Info("Forbidden access", "username", user.Username, "permission", permission)
+			http.Error(w, "Unallowed action", http.StatusForbidden)
+			return
+		}
+		if user.APIKey != nil && !user.APIKey.Allows(permission) {
+			slogger.Logger.Info("Forbidden access", "username", user.Username, "api_key", user.APIKey.Id, "permission", permission)
+			ForbiddenHandler(w, r, fmt.Sprintf("api key not scoped for %s", permission))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectAPIKey refuses the requests AuthRequiredCheck authenticated with an
+// API key.
+func RejectAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _ := UserFromContext(r.Context()); user.APIKey != nil {
+			ForbiddenHandler(w, r, "not allowed with an api key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CookieKeys are the keys of the cookies, built once from the config by
+// newCookieKeys.
+type CookieKeys struct {
+	// Keyring encrypts the cookies.
+	Keyring *cookies.Keyring
+	// Legacy is the key the session cookies used to be signed with.
+	Legacy []byte
+}
+
+// newCookieKeys builds the cookie keys from the config, see config.AppConfig.
+// Config.Validate makes sure the keys are set outside dev mode.
+func newCookieKeys() CookieKeys {
+	primary, keys := config.Cfg.Cookie.Primary, config.Cfg.Cookie.Keys
+	if len(keys) == 0 {
+		mac := hmac.New(sha256.New, tokenSecret())
+		mac.Write([]byte("cookie encryption"))
+		primary, keys = "default", map[string]string{"default": hex.EncodeToString(mac.Sum(nil))}
+	}
+
+	keyring, err := cookies.NewKeyring(primary, keys)
 	if err != nil {
 		log.Fatal(err)
 	}
-	value, err := cookies.ReadSigned(r, "Role", secretKey)
+	return CookieKeys{Keyring: keyring, Legacy: tokenSecret()}
+}
 
+// tokenSecret is Token.Secret, the key the cookies used to be signed with and
+// the access token key is derived from.
+func tokenSecret() []byte {
+	secretKey, err := hex.DecodeString(config.Cfg.Token.Secret)
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
-	return value, nil
+	return secretKey
 }
 
 type ResponseWriterWrapper struct {
@@ -0,0 +1,44 @@
+package delivery
+
+import (
+	"log"
+	"net/http"
+	"users/config"
+	"users/internal/password"
+)
+
+// passwordRules are the rules of config.AppConfig new passwords must follow,
+// the blocklist is loaded once here.
+func passwordRules() password.Rules {
+	cfg := config.Cfg.Password
+	rules := password.Rules{
+		MinLength:      cfg.MinLength,
+		MaxLength:      cfg.MaxLength,
+		MinClasses:     cfg.MinClasses,
+		MinEntropy:     cfg.MinEntropy,
+		ForbidPersonal: cfg.ForbidPersonal,
+	}
+
+	if cfg.Blocklist != "" {
+		blocklist, err := password.LoadBlocklist(cfg.Blocklist)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rules.Blocklist = blocklist
+	}
+
+	return rules
+}
+
+// checkNewPassword answers 400 with what is wrong with the password of the
+// field unless it follows the rules. The personal strings, like the username
+// and the email, must not be part of it.
+func (u *UserHandler) checkNewPassword(w http.ResponseWriter, r *http.Request, field, newPassword string, personal ...string) bool {
+	problems := u.Passwords.Check(newPassword, personal...)
+	if len(problems) == 0 {
+		return true
+	}
+
+	InvalidFieldsHandler(w, r, map[string][]string{field: problems})
+	return false
+}
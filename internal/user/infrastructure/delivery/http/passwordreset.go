@@ -0,0 +1,211 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"users/config"
+	"users/internal/audit"
+	"users/internal/mail"
+	"users/internal/reset"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// newMailer builds the mailer from the config, see config.AppConfig.
+func newMailer() mail.Mailer {
+	cfg := config.Cfg.Mail
+
+	switch cfg.Driver {
+	case "smtp":
+		return mail.NewSMTP(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.From)
+	case "file":
+		return mail.NewFileOutbox(cfg.Dir, cfg.From)
+	case "memory", "":
+		return mail.NewOutbox()
+	default:
+		log.Fatalf("unknown mail driver %q", cfg.Driver)
+		return nil
+	}
+}
+
+// newResetLimiter builds the reset request limits from the config, see
+// config.AppConfig.
+func newResetLimiter() *reset.Limiter {
+	cfg := config.Cfg.PasswordReset
+	return reset.NewLimiter(reset.Limits{PerEmail: cfg.EmailLimit, PerIP: cfg.IPLimit, Window: cfg.LimitWindow})
+}
+
+// inBackground runs fn, which mails someone, without holding the response up.
+func (u *UserHandler) inBackground(fn func()) {
+	u.mailing.Add(1)
+	go func() {
+		defer u.mailing.Done()
+		fn()
+	}()
+}
+
+// Wait blocks until the mails sent in the background are out.
+func (u *UserHandler) Wait() {
+	u.mailing.Wait()
+}
+
+// RequestPasswordReset mails a reset token to the user with the email, if
+// any. The lookup, the token and the mail are left to the background, so the
+// response is the same 202, just as fast, whether the email has an account or
+// not. Only an IP over its limit is told to retry later, an email over its
+// limit gets no more mails.
+func (u *UserHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	req := &dto.PasswordReset{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		slogger.Logger.Info("error while RequestPasswordReset decoding", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		slogger.Logger.Info("error while RequestPasswordReset validation", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+
+	send, retryAfter := u.ResetLimits.Allow(req.Email, clientIP(r), time.Now())
+	if retryAfter > 0 {
+		TooManyRequestsHandler(w, r, "too many reset requests, retry later", retryAfter)
+		return
+	}
+	if send {
+		u.inBackground(func() { u.mailResetToken(req.Email) })
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// mailResetToken issues a reset token for the user with the email, if any,
+// and mails it.
+func (u *UserHandler) mailResetToken(email string) {
+	user, ok := u.Store.GetUserByEmail(email)
+	if !ok {
+		return
+	}
+
+	value, token, err := u.Resets.Issue(user.Id, time.Now())
+	if err != nil {
+		slogger.Logger.Error("error while issuing reset token", "id", user.Id, "err", err)
+		return
+	}
+
+	err = u.Mailer.Send(mail.Message{To: user.Email, Subject: "Reset your password", Body: resetMail(user.Username, value, token)})
+	if err != nil {
+		slogger.Logger.Error("error while mailing reset token", "id", user.Id, "err", err)
+	}
+}
+
+func resetMail(username, value string, token reset.Token) string {
+	body := fmt.Sprintf("Hello %s,\n\nSomeone, hopefully you, asked to reset your password.\n\n", username)
+
+	if link, err := url.Parse(config.Cfg.PasswordReset.URL); err == nil && config.Cfg.PasswordReset.URL != "" {
+		query := link.Query()
+		query.Set("token", value)
+		link.RawQuery = query.Encode()
+		body += fmt.Sprintf("Choose a new one at %s\n\nor", link)
+	} else {
+		body += "Choose a new one by"
+	}
+	body += fmt.Sprintf(" sending this token along with it to /auth/password-reset/confirm:\n\n%s\n\n", value)
+
+	return body + fmt.Sprintf("The token works once, until %s. If you didn't ask for it, ignore this mail, your password stays the same.\n",
+		token.ExpiresAt.Format(time.RFC1123))
+}
+
+// ConfirmPasswordReset sets the new password of the user of a reset token,
+// which then can't be used again, and logs the user out everywhere: its
+// sessions, refresh tokens and API keys are revoked.
+func (u *UserHandler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	req := &dto.ConfirmPasswordReset{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		slogger.Logger.Info("error while ConfirmPasswordReset decoding", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		slogger.Logger.Info("error while ConfirmPasswordReset validation", "err", err)
+		BadRequestHandler(w, r)
+		return
+	}
+
+	// the token is checked first so a password breaking the rules doesn't
+	// use it up
+	token, err := u.Resets.Check(req.Token, time.Now())
+	if err == nil && !u.Store.IfUserExist(token.UserId) {
+		err = reset.ErrInvalidToken
+	}
+	if errors.Is(err, reset.ErrInvalidToken) {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		slogger.Logger.Error("error while checking reset token", "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	user := u.Store.GetUserById(token.UserId)
+	if !u.checkNewPassword(w, r, "new_password", req.NewPassword, user.Username, user.Email) {
+		return
+	}
+
+	_, err = u.Resets.Consume(req.Token, time.Now())
+	if errors.Is(err, reset.ErrInvalidToken) {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+	if err == nil {
+		// nobody is logged in, the user resets its own password, which isn't
+		// a temporary one then
+		record := auditRecord(r, "password_reset", map[string]audit.Change{"password": passwordChange})
+		record.Actor = user.Username
+		temporary := false
+		err = u.Store.UpdateUser(user.Id, dto.UpdateUser{Password: req.NewPassword, MustChangePassword: &temporary}, nil, record)
+	}
+	if err != nil {
+		slogger.Logger.Error("error while resetting password", "id", user.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	// whoever knew the old password may hold a session, a token or a key
+	if err := u.revokeAccess(user.Id, ""); err != nil {
+		slogger.Logger.Error("error while revoking access after password reset", "id", user.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	// the user gets its account back, lockout included
+	u.Lockouts.Succeed(user.Username)
+
+	u.inBackground(func() {
+		err := u.Mailer.Send(mail.Message{To: user.Email, Subject: "Your password was changed",
+			Body: fmt.Sprintf("Hello %s,\n\nYour password was just reset. If it wasn't you, contact an administrator right away.\n", user.Username)})
+		if err != nil {
+			slogger.Logger.Error("error while mailing password change", "id", user.Id, "err", err)
+		}
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeAccess ends the sessions of the user but keepSession, if any, and
+// revokes its refresh tokens and API keys.
+func (u *UserHandler) revokeAccess(userId, keepSession string) error {
+	if err := u.Sessions.EndOthers(userId, keepSession); err != nil {
+		return err
+	}
+	if err := u.Tokens.RevokeUser(userId); err != nil {
+		return err
+	}
+	return u.APIKeys.RevokeAll(userId)
+}
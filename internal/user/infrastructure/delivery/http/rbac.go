@@ -0,0 +1,288 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"users/internal/audit"
+	"users/internal/rbac"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// requireRolesManage answers 403 unless the user of the request may manage
+// roles. Changing the admin flag takes it too, or users:write would be enough
+// to become an admin.
+func (u *UserHandler) requireRolesManage(w http.ResponseWriter, r *http.Request) bool {
+	user, _ := UserFromContext(r.Context())
+
+	allowed, err := u.Roles.Can(user.Id, user.Admin, rbac.RolesManage)
+	if err != nil {
+		slogger.Logger.Error("error while checking permission", "user", user.Id, "permission", rbac.RolesManage, "err", err)
+		InternalServerErrorHandler(w, r)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Unallowed action", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireRolesManageFor requires roles:manage, as requireRolesManage does, when
+// the user with the id is an admin or holds roles:manage itself. Taking over
+// such a user through its credentials is as good as making an admin.
+func (u *UserHandler) requireRolesManageFor(w http.ResponseWriter, r *http.Request, id string) bool {
+	if !u.Store.IfUserExist(id) {
+		return true
+	}
+
+	target := u.Store.GetUserById(id)
+	privileged, err := u.Roles.Can(target.Id, target.Admin, rbac.RolesManage)
+	if err != nil {
+		slogger.Logger.Error("error while checking permission", "user", target.Id, "permission", rbac.RolesManage, "err", err)
+		InternalServerErrorHandler(w, r)
+		return false
+	}
+
+	return !privileged || u.requireRolesManage(w, r)
+}
+
+// restoresAdmin tells whether restoring the version changes the admin flag of
+// the user.
+func (u *UserHandler) restoresAdmin(id string, version uint64) bool {
+	history, err := u.Store.GetUserHistory(id)
+	if err != nil || len(history) == 0 {
+		return false
+	}
+
+	current := history[len(history)-1]
+	for _, v := range history {
+		if v.Version == version {
+			return v.Admin != current.Admin
+		}
+	}
+	return false
+}
+
+// ListRoles lists the builtin roles then the custom ones by name.
+func (u *UserHandler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := u.Store.Roles().ListRoles()
+	if err != nil {
+		slogger.Logger.Error("error while listing roles", "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(append([]rbac.Role{rbac.Admin, rbac.User}, roles...))
+	w.Write(b)
+}
+
+func (u *UserHandler) CreateRole(w http.ResponseWriter, r *http.Request) {
+	req := &dto.Role{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while CreateRole decoding", "err", err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+
+	role := rbac.Role{Name: req.Name, Permissions: req.Permissions}
+	if err := role.Validate(); err != nil {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+
+	err := u.Store.Roles().CreateRole(role)
+	if errors.Is(err, rbac.ErrRoleExists) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		b, _ := json.Marshal(dto.ErrorResponse{Error: "409 Conflict", Message: err.Error()})
+		w.Write(b)
+		return
+	}
+	if err != nil {
+		slogger.Logger.Error("error while creating role", "role", role.Name, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "role_create", role.Name, permissionChanges(nil, role.Permissions))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	b, _ := json.Marshal(role)
+	w.Write(b)
+}
+
+func (u *UserHandler) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/roles/")
+
+	req := &dto.UpdateRole{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while UpdateRole decoding", "err", err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+
+	role := rbac.Role{Name: name, Permissions: req.Permissions}
+	if err := role.Validate(); err != nil {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+
+	before, err := u.Store.Roles().GetRole(name)
+	if err == nil {
+		err = u.Store.Roles().UpdateRole(role)
+	}
+	switch {
+	case errors.Is(err, rbac.ErrRoleNotFound):
+		NotFoundHandler(w, r)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while updating role", "role", name, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "role_update", name, permissionChanges(before.Permissions, role.Permissions))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *UserHandler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/roles/")
+	if rbac.IsBuiltin(name) {
+		BadRequestMessageHandler(w, r, rbac.ErrBuiltinRole.Error())
+		return
+	}
+
+	before, err := u.Store.Roles().GetRole(name)
+	if err == nil {
+		err = u.Store.Roles().DeleteRole(name)
+	}
+	switch {
+	case errors.Is(err, rbac.ErrRoleNotFound):
+		NotFoundHandler(w, r)
+		return
+	case err != nil:
+		slogger.Logger.Error("error while deleting role", "role", name, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "role_delete", name, permissionChanges(before.Permissions, nil))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetUserRoles returns all the roles of a user and what they allow.
+func (u *UserHandler) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/user/"), "/roles")
+	if !u.Store.IfUserExist(id) {
+		NotFoundHandler(w, r)
+		return
+	}
+	user := u.Store.GetUserById(id)
+
+	roles, err := u.Roles.Roles(id, user.Admin)
+	if err != nil {
+		slogger.Logger.Error("error while getting user roles", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+	permissions, err := u.Roles.Permissions(id, user.Admin)
+	if err != nil {
+		slogger.Logger.Error("error while getting user permissions", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	res := dto.UserPermissions{Roles: []string{}, Permissions: permissions}
+	for _, role := range roles {
+		res.Roles = append(res.Roles, role.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(res)
+	w.Write(b)
+}
+
+// SetUserRoles replaces the custom roles of a user, the builtin ones follow
+// its admin flag.
+func (u *UserHandler) SetUserRoles(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/user/"), "/roles")
+
+	req := &dto.UserRoles{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while SetUserRoles decoding", "err", err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	}
+	slices.Sort(req.Roles)
+	req.Roles = slices.Compact(req.Roles)
+	for _, name := range req.Roles {
+		if rbac.IsBuiltin(name) {
+			BadRequestMessageHandler(w, r, rbac.ErrBuiltinRole.Error()+" "+name)
+			return
+		}
+	}
+
+	if !u.Store.IfUserExist(id) {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	before, err := u.Store.Roles().UserRoles(id)
+	if err == nil {
+		err = u.Store.Roles().SetUserRoles(id, req.Roles)
+	}
+	switch {
+	case errors.Is(err, rbac.ErrRoleNotFound):
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	case err != nil:
+		slogger.Logger.Error("error while setting user roles", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	after, _ := u.Store.Roles().UserRoles(id)
+	changes := audit.Diff(map[string]string{"roles": strings.Join(before, ",")}, map[string]string{"roles": strings.Join(after, ",")})
+	u.recordAudit(r, "roles_assign", id, changes)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// permissionChanges is how a change of the permissions of a role shows in the
+// audit log.
+func permissionChanges(before, after []rbac.Permission) map[string]audit.Change {
+	join := func(permissions []rbac.Permission) map[string]string {
+		if permissions == nil {
+			return nil
+		}
+		s := make([]string, len(permissions))
+		for i, p := range permissions {
+			s[i] = string(p)
+		}
+		return map[string]string{"permissions": strings.Join(s, ",")}
+	}
+
+	return audit.Diff(join(before), join(after))
+}
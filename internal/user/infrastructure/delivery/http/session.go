@@ -0,0 +1,104 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"users/internal/cookies"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// sessionCookie holds the encrypted id of the session, see Login.
+const sessionCookie = "Session"
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, keys CookieKeys, id string, ttl time.Duration) {
+	cookie := http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if err := cookies.WriteEncrypted(w, r, &cookie, keys.Keyring); err != nil {
+		slogger.Logger.Error("error while writing session cookie", "err", err)
+	}
+}
+
+// readSessionCookie returns the session id of the session cookie. Cookies
+// signed before they were encrypted are still accepted, they are encrypted
+// when renewed.
+func readSessionCookie(r *http.Request, keys CookieKeys) (string, error) {
+	id, err := cookies.ReadEncrypted(r, sessionCookie, keys.Keyring)
+	if errors.Is(err, cookies.ErrInvalidValue) {
+		return cookies.ReadSigned(r, sessionCookie, keys.Legacy)
+	}
+	return id, err
+}
+
+// Login checks the credentials, and the one-time code of the users with
+// two-factor authentication, and opens a session, its id is set in the session
+// cookie.
+func (u *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
+	login := &dto.Login{}
+	if err := json.NewDecoder(r.Body).Decode(login); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while Login decoding", "err", err)
+		return
+	}
+	if err := login.Validate(); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while Login validation", "err", err)
+		return
+	}
+
+	l, err := authenticate(u.Store, u.Lockouts, u.TwoFactor, r, login.Username, login.Password, login.OTP, false)
+	if err != nil {
+		loginFailed(w, r, l, err)
+		return
+	}
+	if l.credentials.Id == "" {
+		slogger.Logger.Error("credentials without user id", "username", login.Username)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	id, s, err := u.Sessions.Start(l.credentials.Id, l.secondFactor, time.Now())
+	if err != nil {
+		slogger.Logger.Error("error while starting session", "username", login.Username, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+	setSessionCookie(w, r, u.Cookies, id, u.Sessions.TTL())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(dto.SessionInfo{UserId: s.UserId, ExpiresAt: s.ExpiresAt})
+	w.Write(b)
+}
+
+// Logout closes the session of the session cookie, if any, and clears the
+// cookie.
+func (u *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if id, err := readSessionCookie(r, u.Cookies); err == nil {
+		if err := u.Sessions.End(id); err != nil {
+			slogger.Logger.Error("error while ending session", "err", err)
+			InternalServerErrorHandler(w, r)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
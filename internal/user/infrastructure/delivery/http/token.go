@@ -0,0 +1,129 @@
+package delivery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"users/config"
+	"users/internal/token"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// newIssuer builds the token issuer from the config, see config.AppConfig.
+func newIssuer(store token.RefreshStore) *token.Issuer {
+	signing, public, err := token.ParseEd25519Keys(config.Cfg.Token.Ed25519Key, config.Cfg.Token.Ed25519PublicKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys := token.Keys{HMAC: accessTokenKey(), Signing: signing, Public: public, AcceptHMAC: config.Cfg.Token.AcceptHMAC}
+	return token.NewIssuer(config.Cfg.Token.Issuer, keys, config.Cfg.Token.AccessTTL, config.Cfg.Token.RefreshTTL, store)
+}
+
+// accessTokenKey is the HS256 key of the access tokens, Token.HMACKey or else
+// one derived from Token.Secret under its own label, so it's never the key of
+// the cookies.
+func accessTokenKey() []byte {
+	if config.Cfg.Token.HMACKey != "" {
+		key, err := hex.DecodeString(config.Cfg.Token.HMACKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return key
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, tokenSecret(), nil, []byte("users access token signing")), key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// Token issues an access token and a refresh token, for the credentials of a
+// user or in exchange for a refresh token. A refresh token is only good once.
+func (u *UserHandler) Token(w http.ResponseWriter, r *http.Request) {
+	req := &dto.TokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while Token decoding", "err", err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while Token validation", "err", err)
+		return
+	}
+
+	var (
+		pair token.Pair
+		err  error
+	)
+	switch req.GrantType {
+	case "password":
+		l, authErr := authenticate(u.Store, u.Lockouts, u.TwoFactor, r, req.Username, req.Password, req.OTP, false)
+		if authErr != nil {
+			loginFailed(w, r, l, authErr)
+			return
+		}
+		if l.credentials.Id == "" {
+			slogger.Logger.Info("failed login", "username", req.Username)
+			UnauthorizedHandler(w, r, "wrong username or password")
+			return
+		}
+		pair, err = u.Tokens.Issue(l.credentials.Id, l.secondFactor)
+
+	case "refresh_token":
+		pair, err = u.Tokens.Refresh(req.RefreshToken, u.Store.IfUserExist)
+	}
+
+	switch {
+	case errors.Is(err, token.ErrTokenReused):
+		UnauthorizedHandler(w, r, "refresh token reused, the session is revoked")
+		return
+	case errors.Is(err, token.ErrInvalidToken):
+		UnauthorizedHandler(w, r, "invalid refresh token")
+		return
+	case err != nil:
+		slogger.Logger.Error("error while issuing tokens", "grant_type", req.GrantType, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(pair)
+	w.Write(b)
+}
+
+// RevokeToken revokes the refresh token along with the ones it was rotated
+// from and into. The access tokens already issued stay valid until they
+// expire.
+func (u *UserHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	req := &dto.RevokeToken{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while RevokeToken decoding", "err", err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		BadRequestHandler(w, r)
+		slogger.Logger.Info("error while RevokeToken validation", "err", err)
+		return
+	}
+
+	if err := u.Tokens.Revoke(req.RefreshToken); err != nil {
+		slogger.Logger.Error("error while revoking token", "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"users/internal/totp"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// GetTwoFactor tells whether the authenticated user has two-factor
+// authentication.
+func (u *UserHandler) GetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	enabled, recoveryCodes, err := u.TwoFactor.Status(me.Id)
+	if err != nil {
+		slogger.Logger.Error("error while getting two-factor status", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(dto.TwoFactorStatus{Enabled: enabled, RecoveryCodes: recoveryCodes})
+	w.Write(b)
+}
+
+// EnrollTwoFactor hands out a new secret for the authenticated user, it only
+// counts once confirmed, see ConfirmTwoFactor.
+func (u *UserHandler) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	secret, uri, err := u.TwoFactor.Enroll(me.Id, me.Username, time.Now())
+	if errors.Is(err, totp.ErrEnrolled) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		b, _ := json.Marshal(dto.ErrorResponse{Error: "409 Conflict", Message: err.Error()})
+		w.Write(b)
+		return
+	}
+	if err != nil {
+		slogger.Logger.Error("error while enrolling two-factor", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(dto.TwoFactorEnrollment{Secret: secret, URI: uri})
+	w.Write(b)
+}
+
+// ConfirmTwoFactor enables the two-factor authentication of the authenticated
+// user given a code of the secret EnrollTwoFactor handed out, and responds
+// with the recovery codes.
+func (u *UserHandler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	code, ok := decodeOneTimeCode(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := u.TwoFactor.Confirm(me.Id, code.Code, time.Now())
+	switch {
+	case errors.Is(err, totp.ErrNotEnrolled), errors.Is(err, totp.ErrEnrolled):
+		BadRequestMessageHandler(w, r, err.Error())
+		return
+	case errors.Is(err, totp.ErrInvalidCode):
+		ForbiddenHandler(w, r, err.Error())
+		return
+	case err != nil:
+		slogger.Logger.Error("error while confirming two-factor", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "2fa_enable", me.Id, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(dto.RecoveryCodes{RecoveryCodes: codes})
+	w.Write(b)
+}
+
+// DisableTwoFactor turns off the two-factor authentication of the
+// authenticated user given a one-time or recovery code.
+func (u *UserHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	me, _ := UserFromContext(r.Context())
+
+	code, ok := decodeOneTimeCode(w, r)
+	if !ok {
+		return
+	}
+
+	err := u.TwoFactor.Verify(me.Id, code.Code, time.Now())
+	if err == nil {
+		err = u.TwoFactor.Disable(me.Id)
+	}
+	switch {
+	case errors.Is(err, totp.ErrNotEnrolled):
+		NotFoundHandler(w, r)
+		return
+	case errors.Is(err, totp.ErrInvalidCode):
+		ForbiddenHandler(w, r, err.Error())
+		return
+	case err != nil:
+		slogger.Logger.Error("error while disabling two-factor", "id", me.Id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "2fa_disable", me.Id, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResetTwoFactor turns off the two-factor authentication of a user who lost
+// both its authenticator and its recovery codes.
+func (u *UserHandler) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/user/"), "/2fa")
+	if !u.Store.IfUserExist(id) {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	if err := u.TwoFactor.Disable(id); err != nil {
+		slogger.Logger.Error("error while resetting two-factor", "id", id, "err", err)
+		InternalServerErrorHandler(w, r)
+		return
+	}
+
+	u.recordAudit(r, "2fa_reset", id, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeOneTimeCode(w http.ResponseWriter, r *http.Request) (*dto.OneTimeCode, bool) {
+	code := &dto.OneTimeCode{}
+	if err := json.NewDecoder(r.Body).Decode(code); err != nil {
+		slogger.Logger.Info("error while one-time code decoding", "err", err)
+		BadRequestHandler(w, r)
+		return nil, false
+	}
+	if err := code.Validate(); err != nil {
+		slogger.Logger.Info("error while one-time code validation", "err", err)
+		BadRequestHandler(w, r)
+		return nil, false
+	}
+	return code, true
+}
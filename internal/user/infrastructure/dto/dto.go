@@ -1,29 +1,40 @@
 package dto
 
 import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
 	"users/config"
+	"users/internal/apikey"
+	"users/internal/password"
+	"users/internal/rbac"
 	entity "users/internal/user/domain"
 
 	"dario.cat/mergo"
 	"github.com/go-playground/validator/v10"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var falseValue = false
-
 type CreateUser struct {
 	Username string `json:"username" validate:"required,max=150"`
 	Email    string `json:"email" validate:"required,email,max=150"`
-	Password string `json:"password" validate:"required,alphanumunicode,max=100"`
+	Password string `json:"password" validate:"required,max=1024"`
 	Admin    *bool  `json:"admin" validate:"required,boolean"`
+	// MustChangePassword makes the password a temporary one, see
+	// AuthPermission.
+	MustChangePassword bool `json:"must_change_password,omitempty"`
 }
 
 func (c *CreateUser) ToStorageUser(id string) entity.User {
 	return entity.User{Id: id,
-		Username: c.Username,
-		Email:    c.Email,
-		Password: c.Password,
-		Admin:    c.Admin}
+		Username:           c.Username,
+		Email:              c.Email,
+		Password:           c.Password,
+		Admin:              c.Admin,
+		CreatedAt:          time.Now().UTC(),
+		Version:            1,
+		MustChangePassword: c.MustChangePassword}
 }
 
 func (c *CreateUser) Validate() error {
@@ -37,19 +48,23 @@ func (c *CreateUser) Validate() error {
 }
 
 func (c *CreateUser) HashPassword() error {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(c.Password+config.Cfg.Token.Salt), 4)
+	hash, err := HashPassword(c.Password)
 	if err != nil {
 		return err
 	}
-	c.Password = string(bytes)
+	c.Password = hash
 	return nil
 }
 
 type UpdateUser struct {
 	Username string `json:"username,omitempty" validate:"omitempty,max=150"`
 	Email    string `json:"email,omitempty" validate:"omitempty,email,max=150"`
-	Password string `json:"password,omitempty" validate:"omitempty,alphanumunicode,max=100"`
+	Password string `json:"password,omitempty" validate:"omitempty,max=1024"`
 	Admin    *bool  `json:"admin,omitempty" validate:"omitempty,boolean"`
+	// MustChangePassword sets or clears the temporary password flag, see
+	// AuthPermission. A new password alone leaves it as it is, so a password
+	// an admin resets stays temporary.
+	MustChangePassword *bool `json:"must_change_password,omitempty"`
 }
 
 func (u *UpdateUser) Validate() error {
@@ -62,27 +77,29 @@ func (u *UpdateUser) Validate() error {
 	return nil
 }
 
+// MakeUpdatedUser applies the update to the user, leaving the fields it
+// doesn't set as they are, admin flag included.
 func (u *UpdateUser) MakeUpdatedUser(userToUpdate *entity.User) {
-	if u.Admin == nil {
-		u.Admin = &falseValue
-	}
 	updatedEntity := entity.User{
-		Id:       userToUpdate.Id,
-		Username: u.Username,
-		Email:    u.Email,
-		Password: u.Password,
-		Admin:    u.Admin,
+		Id:        userToUpdate.Id,
+		Username:  u.Username,
+		Email:     u.Email,
+		Password:  u.Password,
+		Admin:     u.Admin,
+		CreatedAt: userToUpdate.CreatedAt, // mergo overrides zero time.Time too
 	}
 	mergo.Merge(userToUpdate, updatedEntity, mergo.WithOverride, mergo.WithoutDereference)
-
+	if u.MustChangePassword != nil {
+		userToUpdate.MustChangePassword = *u.MustChangePassword
+	}
 }
 
 func (u *UpdateUser) HashPassword() error {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(u.Password+config.Cfg.Token.Salt), 4)
+	hash, err := HashPassword(u.Password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(bytes)
+	u.Password = hash
 	return nil
 }
 
@@ -91,32 +108,341 @@ type UserId struct {
 }
 
 type AuthPermission struct {
+	Id       string `json:"id,omitempty"`
 	Password string `json:"password"`
 	Admin    *bool  `json:"admin"`
+	// MustChangePassword keeps the user from anything but the /user/me
+	// endpoints until it changes its password.
+	MustChangePassword bool `json:"must_change_password,omitempty"`
 }
 
 func (a *AuthPermission) HashPassword() error {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(a.Password+config.Cfg.Token.Salt), 4)
+	hash, err := HashPassword(a.Password)
 	if err != nil {
 		return err
 	}
-	a.Password = string(bytes)
+	a.Password = hash
 	return nil
 }
 
 type ListUser struct {
-	Id       string `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Admin    bool   `json:"admin"`
+	Id        string     `json:"id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Admin     bool       `json:"admin"`
+	CreatedAt time.Time  `json:"created_at"`
+	Version   uint64     `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// UserVersion is a state of a profile kept in its history. Passwords are not
+// part of the history.
+type UserVersion struct {
+	Version   uint64    `json:"version"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"created_at"`
+	ChangedAt time.Time `json:"changed_at"`
+	Deleted   bool      `json:"deleted,omitempty"` // the user was deleted by this change
+}
+
+// ToUserVersion snapshots the user as it is after a change made at changedAt.
+func ToUserVersion(user entity.User, changedAt time.Time, deleted bool) UserVersion {
+	return UserVersion{
+		Version:   user.Version,
+		Username:  user.Username,
+		Email:     user.Email,
+		Admin:     user.Admin != nil && *user.Admin,
+		CreatedAt: user.CreatedAt,
+		ChangedAt: changedAt,
+		Deleted:   deleted,
+	}
+}
+
+// ListUser is the profile as it was in the version.
+func (v UserVersion) ListUser(id string) ListUser {
+	return ListUser{
+		Id:        id,
+		Username:  v.Username,
+		Email:     v.Email,
+		Admin:     v.Admin,
+		CreatedAt: v.CreatedAt,
+		Version:   v.Version,
+	}
+}
+
+// RestoreUser restores the version of a user, or takes the user out of the
+// trash when Version is zero.
+type RestoreUser struct {
+	Version uint64 `json:"version"`
+}
+
+func (r *RestoreUser) Validate() error {
+	return validator.New().Struct(r)
+}
+
+// SortableFields are the ListUser fields the list can be sorted by.
+var SortableFields = []string{"id", "username", "email", "admin", "created_at"}
+
+// ListQuery selects a slice of the user list: the users matching Filter,
+// sorted by Sort (created_at when empty), Limit of them (all when zero) after
+// Cursor or after skipping Offset users.
+type ListQuery struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Filter UserFilter
+	Sort   string
+	Desc   bool
+}
+
+// UserFilter narrows the user list down, zero fields match everything.
+type UserFilter struct {
+	UsernamePrefix string
+	EmailDomain    string
+	Admin          *bool
+	CreatedFrom    time.Time // inclusive
+	CreatedTo      time.Time // exclusive
+}
+
+type UserPage struct {
+	Users      []ListUser `json:"users"`
+	NextCursor string     `json:"next_cursor,omitempty"`
 }
 
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+	// Fields tells what is wrong with each invalid field of the request.
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
+type Login struct {
+	Username string `json:"username" validate:"required,max=150"`
+	Password string `json:"password" validate:"required,max=1024"`
+	// OTP is a one-time code or a recovery code, for the users with
+	// two-factor authentication.
+	OTP string `json:"otp,omitempty" validate:"max=64"`
+}
+
+func (l *Login) Validate() error {
+	return validator.New().Struct(l)
+}
+
+// TokenRequest asks for tokens with the credentials of a user, GrantType
+// "password", or with a refresh token, GrantType "refresh_token".
+type TokenRequest struct {
+	GrantType    string `json:"grant_type" validate:"required,oneof=password refresh_token"`
+	Username     string `json:"username,omitempty" validate:"required_if=GrantType password,max=150"`
+	Password     string `json:"password,omitempty" validate:"required_if=GrantType password,max=1024"`
+	RefreshToken string `json:"refresh_token,omitempty" validate:"required_if=GrantType refresh_token"`
+	OTP          string `json:"otp,omitempty" validate:"max=64"`
+}
+
+func (t *TokenRequest) Validate() error {
+	return validator.New().Struct(t)
+}
+
+type RevokeToken struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+func (t *RevokeToken) Validate() error {
+	return validator.New().Struct(t)
+}
+
+// SessionInfo describes the session a login opened, its id is only sent in the
+// cookie.
+type SessionInfo struct {
+	UserId    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TwoFactorStatus tells whether the two-factor authentication of a user is
+// enabled and how many recovery codes it has left.
+type TwoFactorStatus struct {
+	Enabled       bool `json:"enabled"`
+	RecoveryCodes int  `json:"recovery_codes"`
+}
+
+// TwoFactorEnrollment is the secret to add to an authenticator app, by hand
+// or by scanning the URI as a QR code.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// OneTimeCode is a code of the authenticator app, or a recovery code where
+// one is accepted.
+type OneTimeCode struct {
+	Code string `json:"code" validate:"required,max=64"`
+}
+
+func (c *OneTimeCode) Validate() error {
+	return validator.New().Struct(c)
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// CreateAPIKey is a new API key of the authenticated user. Its scopes are
+// permissions the user has, ExpiresAt defaults to the config, see
+// config.AppConfig.
+type CreateAPIKey struct {
+	Name      string            `json:"name" validate:"required,max=100"`
+	Scopes    []rbac.Permission `json:"scopes" validate:"required,min=1"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+}
+
+func (k *CreateAPIKey) Validate() error {
+	return validator.New().Struct(k)
+}
+
+// CreatedAPIKey is a new API key along with the key itself, which is never
+// shown again.
+type CreatedAPIKey struct {
+	apikey.Key
+	Value string `json:"key"`
 }
 
+// UpdateProfile is what users may change of their own profile, an unknown
+// field, like admin, is an error rather than ignored.
+type UpdateProfile struct {
+	Username string `json:"username,omitempty" validate:"omitempty,max=150"`
+	Email    string `json:"email,omitempty" validate:"omitempty,email,max=150"`
+	// CurrentPassword is required to change the email.
+	CurrentPassword string `json:"current_password,omitempty" validate:"omitempty,max=1024"`
+}
+
+func (p *UpdateProfile) Validate() error {
+	return validator.New().Struct(p)
+}
+
+func (p *UpdateProfile) ToUpdateUser() UpdateUser {
+	return UpdateUser{Username: p.Username, Email: p.Email}
+}
+
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password" validate:"required,max=1024"`
+	NewPassword     string `json:"new_password" validate:"required,max=1024,nefield=CurrentPassword"`
+}
+
+func (c *ChangePassword) Validate() error {
+	return validator.New().Struct(c)
+}
+
+// PasswordReset asks for a reset token to be mailed to the user with the
+// email.
+type PasswordReset struct {
+	Email string `json:"email" validate:"required,email,max=150"`
+}
+
+func (p *PasswordReset) Validate() error {
+	return validator.New().Struct(p)
+}
+
+// ConfirmPasswordReset sets a new password given a reset token.
+type ConfirmPasswordReset struct {
+	Token       string `json:"token" validate:"required,max=256"`
+	NewPassword string `json:"new_password" validate:"required,max=1024"`
+}
+
+func (c *ConfirmPasswordReset) Validate() error {
+	return validator.New().Struct(c)
+}
+
+// RoleNameRe is what a role name looks like, so it fits in a path.
+var RoleNameRe = regexp.MustCompile(`^[\w-]{1,64}$`)
+
+type Role struct {
+	Name        string            `json:"name" validate:"required"`
+	Permissions []rbac.Permission `json:"permissions" validate:"required"`
+}
+
+func (r *Role) Validate() error {
+	if err := validator.New().Struct(r); err != nil {
+		return err
+	}
+	if !RoleNameRe.MatchString(r.Name) {
+		return fmt.Errorf("invalid role name %q", r.Name)
+	}
+	return nil
+}
+
+type UpdateRole struct {
+	Permissions []rbac.Permission `json:"permissions" validate:"required"`
+}
+
+func (r *UpdateRole) Validate() error {
+	return validator.New().Struct(r)
+}
+
+// UserRoles are the roles assigned to a user, without the builtin ones.
+type UserRoles struct {
+	Roles []string `json:"roles" validate:"required"`
+}
+
+func (r *UserRoles) Validate() error {
+	return validator.New().Struct(r)
+}
+
+// UserPermissions are all the roles of a user, the builtin ones included, and
+// the permissions they give.
+type UserPermissions struct {
+	Roles       []string          `json:"roles"`
+	Permissions []rbac.Permission `json:"permissions"`
+}
+
+// PasswordPolicy is how new passwords are hashed, see config.AppConfig.
+func PasswordPolicy() password.Policy {
+	cfg := config.Cfg.Password
+	return password.Policy{
+		Algorithm:  cfg.Algorithm,
+		BcryptCost: cfg.BcryptCost,
+		Argon2:     password.Argon2Params{Time: cfg.Argon2.Time, Memory: cfg.Argon2.Memory, Threads: uint8(cfg.Argon2.Threads)},
+	}
+}
+
+var (
+	hashingOnce sync.Once
+	hashing     chan struct{}
+)
+
+// startHashing waits for a slot among the Password.MaxConcurrent hashes
+// computed at once, the returned func frees it.
+func startHashing() (done func()) {
+	hashingOnce.Do(func() {
+		n := config.Cfg.Password.MaxConcurrent
+		if n == 0 {
+			n = runtime.NumCPU()
+		}
+		hashing = make(chan struct{}, n)
+	})
+
+	hashing <- struct{}{}
+	return func() { <-hashing }
+}
+
+// HashPassword hashes a password following PasswordPolicy.
+func HashPassword(plain string) (string, error) {
+	defer startHashing()()
+
+	return password.Hash(plain+config.Cfg.Token.Salt, PasswordPolicy())
+}
+
+// CheckPassword verifies a password against its hash, legacy bcrypt hashes
+// included.
 func CheckPassword(providedPassword string, db_password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(db_password), []byte(providedPassword+config.Cfg.Token.Salt))
+	defer startHashing()()
+
+	ok, err := password.Verify(providedPassword+config.Cfg.Token.Salt, db_password)
+
+	return err == nil && ok
+}
 
-	return err == nil
+// NeedsRehash tells whether a hash is behind PasswordPolicy.
+func NeedsRehash(hash string) bool {
+	return password.NeedsRehash(hash, PasswordPolicy())
 }
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+	"users/internal/apikey"
+)
+
+func (u *UserRepo) APIKeys() apikey.Store {
+	return u.keys
+}
+
+func (s *SQLiteRepo) APIKeys() apikey.Store {
+	return s.keys
+}
+
+// sqliteAPIKeyStore keeps the keys in the api_keys table.
+type sqliteAPIKeyStore struct {
+	db *sql.DB
+}
+
+const apiKeyColumns = `id, user_id, name, hint, hash, scopes, second_factor, created_at, expires_at, last_used_at`
+
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (apikey.Key, error) {
+	var (
+		k                    apikey.Key
+		scopes               string
+		createdAt, expiresAt int64
+		lastUsedAt           sql.NullInt64
+	)
+
+	err := row.Scan(&k.Id, &k.UserId, &k.Name, &k.Hint, &k.Hash, &scopes, &k.SecondFactor, &createdAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return apikey.Key{}, err
+	}
+	k.CreatedAt, k.ExpiresAt = time.Unix(0, createdAt).UTC(), time.Unix(0, expiresAt).UTC()
+	if lastUsedAt.Valid {
+		t := time.Unix(0, lastUsedAt.Int64).UTC()
+		k.LastUsedAt = &t
+	}
+
+	err = json.Unmarshal([]byte(scopes), &k.Scopes)
+	return k, err
+}
+
+func (s *sqliteAPIKeyStore) Create(k apikey.Key) error {
+	scopes, _ := json.Marshal(k.Scopes)
+
+	_, err := s.db.Exec(`INSERT INTO api_keys (id, user_id, name, hint, hash, scopes, second_factor, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.Id, k.UserId, k.Name, k.Hint, k.Hash, string(scopes), k.SecondFactor, k.CreatedAt.UnixNano(), k.ExpiresAt.UnixNano())
+	return err
+}
+
+func (s *sqliteAPIKeyStore) GetByHash(hash string) (apikey.Key, error) {
+	k, err := scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return apikey.Key{}, apikey.ErrNotFound
+	}
+	return k, err
+}
+
+func (s *sqliteAPIKeyStore) List(userId string) ([]apikey.Key, error) {
+	rows, err := s.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY created_at`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []apikey.Key{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, k)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqliteAPIKeyStore) Delete(userId, id string) error {
+	res, err := s.db.Exec(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userId)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return apikey.ErrNotFound
+	}
+	return err
+}
+
+func (s *sqliteAPIKeyStore) DeleteUser(userId string) error {
+	_, err := s.db.Exec(`DELETE FROM api_keys WHERE user_id = ?`, userId)
+	return err
+}
+
+func (s *sqliteAPIKeyStore) Touch(id string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, at.UnixNano(), id)
+	return err
+}
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+	"users/internal/audit"
+	entity "users/internal/user/domain"
+)
+
+func (u *UserRepo) AuditLog() audit.Log {
+	return u.audit
+}
+
+func (s *SQLiteRepo) AuditLog() audit.Log {
+	return s.audit
+}
+
+// auditFields are the fields of a user the audit log diffs, nil for a user
+// that doesn't exist or is in the trash.
+func auditFields(user entity.User) map[string]string {
+	if user.Id == "" || user.DeletedAt != nil {
+		return nil
+	}
+
+	return map[string]string{
+		"username": user.Username,
+		"email":    user.Email,
+		"admin":    strconv.FormatBool(user.Admin != nil && *user.Admin),
+	}
+}
+
+// auditEntry completes the entry recording the change of a user from before to
+// after with its target and the diff of the fields. The changes the entry
+// already has, a redacted password for one, are kept.
+func auditEntry(e audit.Entry, before, after entity.User) audit.Entry {
+	e.Target = after.Id
+	if e.Target == "" {
+		e.Target = before.Id
+	}
+
+	changes := audit.Diff(auditFields(before), auditFields(after))
+	for field, change := range e.Changes {
+		changes[field] = change
+	}
+	e.Changes = changes
+
+	return e
+}
+
+// recordChange appends the entry recording the change of the user from before
+// to after in the transaction of the change, nil recording nothing.
+func recordChange(tx *sql.Tx, record *audit.Entry, before, after entity.User) error {
+	if record == nil {
+		return nil
+	}
+	_, err := appendAudit(tx, auditEntry(*record, before, after))
+	return err
+}
+
+// sqliteAuditLog keeps the log in the audit_log table, one row per entry.
+type sqliteAuditLog struct {
+	db *sql.DB
+}
+
+func (l *sqliteAuditLog) Append(e audit.Entry) (audit.Entry, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return audit.Entry{}, err
+	}
+	defer tx.Rollback()
+
+	e, err = appendAudit(tx, e)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+
+	return e, tx.Commit()
+}
+
+// appendAudit seals the entry after the last one and inserts it. The
+// transactions of the repository take the write lock as they begin, so two
+// appends can't race for the last entry.
+func appendAudit(tx *sql.Tx, e audit.Entry) (audit.Entry, error) {
+	var prev audit.Entry
+	err := tx.QueryRow(`SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1`).Scan(&prev.Seq, &prev.Hash)
+	if err != nil && err != sql.ErrNoRows {
+		return audit.Entry{}, err
+	}
+
+	e = audit.Seal(e, prev)
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO audit_log (seq, time, actor, action, target, changes, ip, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Seq, e.Time.UnixNano(), e.Actor, e.Action, e.Target, string(changes), e.IP, e.PrevHash, e.Hash)
+	if err != nil {
+		return audit.Entry{}, err
+	}
+
+	return e, nil
+}
+
+func (l *sqliteAuditLog) Scan(fn func(e audit.Entry) bool) error {
+	rows, err := l.db.Query(`SELECT seq, time, actor, action, target, changes, ip, prev_hash, hash FROM audit_log ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			e       audit.Entry
+			at      int64
+			changes string
+		)
+		if err := rows.Scan(&e.Seq, &at, &e.Actor, &e.Action, &e.Target, &changes, &e.IP, &e.PrevHash, &e.Hash); err != nil {
+			return err
+		}
+		e.Time = time.Unix(0, at).UTC()
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return err
+		}
+
+		if !fn(e) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
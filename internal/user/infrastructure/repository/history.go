@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"users/internal/audit"
+	storage "users/internal/db"
+	entity "users/internal/user/domain"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+)
+
+// ErrVersionNotFound is returned when the history of a user has no such
+// version to restore.
+var ErrVersionNotFound = errors.New("user version not found")
+
+// historyIndex orders historydb by key, that is by user and then by version.
+const historyIndex = "key"
+
+func historyKeyIndex(key string, _ []byte) (string, bool) {
+	return key, true
+}
+
+// historyKey is the key of a version in historydb. Versions are zero-padded
+// to sort as numbers.
+func historyKey(id string, version uint64) string {
+	return fmt.Sprintf("%s/%020d", id, version)
+}
+
+func recordVersion(history storage.Tx, id string, v dto.UserVersion) {
+	b, _ := json.Marshal(v)
+	history.Set(historyKey(id, v.Version), b)
+}
+
+// backfillHistory records the current version of the users stored before the
+// history existed. Its change time is only known for never updated users.
+func (u *UserRepo) backfillHistory() {
+	var users []entity.User
+	u.userdb.Scan(func(_ string, v []byte) bool {
+		var user entity.User
+		json.Unmarshal(v, &user)
+		users = append(users, user)
+		return true
+	})
+
+	now := time.Now().UTC()
+	err := u.historydb.Update(func(history storage.Tx) error {
+		for _, user := range users {
+			if _, ok := history.Get(historyKey(user.Id, user.Version)); ok {
+				continue
+			}
+
+			changedAt := now
+			if user.Version <= 1 {
+				changedAt = user.CreatedAt
+			}
+			recordVersion(history, user.Id, dto.ToUserVersion(user, changedAt, false))
+		}
+		return nil
+	})
+	if err != nil {
+		slogger.Logger.Error("error while recording user history", "err", err)
+	}
+}
+
+func (u *UserRepo) GetUserHistory(uuid string) ([]dto.UserVersion, error) {
+	res := []dto.UserVersion{}
+
+	err := u.historydb.ScanIndex(historyIndex, storage.IndexRange{Prefix: uuid + "/"}, func(_ storage.IndexPos, _ string, b []byte) bool {
+		var v dto.UserVersion
+		json.Unmarshal(b, &v)
+		res = append(res, v)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return res, nil
+}
+
+func (u *UserRepo) GetUserAsOf(uuid string, at time.Time) (dto.ListUser, error) {
+	var (
+		found dto.UserVersion
+		ok    bool
+	)
+
+	r := storage.IndexRange{Prefix: uuid + "/", Desc: true}
+	err := u.historydb.ScanIndex(historyIndex, r, func(_ storage.IndexPos, _ string, b []byte) bool {
+		var v dto.UserVersion
+		json.Unmarshal(b, &v)
+		if v.ChangedAt.After(at) {
+			return true
+		}
+		found, ok = v, true
+		return false
+	})
+	if err != nil {
+		return dto.ListUser{}, err
+	}
+	if !ok || found.Deleted {
+		return dto.ListUser{}, ErrNotFound
+	}
+
+	return found.ListUser(uuid), nil
+}
+
+func (u *UserRepo) RestoreUser(uuid string, version uint64, ifMatch *uint64, record *audit.Entry) error {
+	defer u.reindex(uuid)
+
+	return u.update(func(tx userTx) error {
+		user, err := tx.getUser(uuid, ifMatch)
+		if err != nil {
+			return err
+		}
+
+		b, ok := tx.history.Get(historyKey(uuid, version))
+		if !ok {
+			return ErrVersionNotFound
+		}
+		var v dto.UserVersion
+		json.Unmarshal(b, &v)
+		if v.Deleted {
+			return ErrVersionNotFound
+		}
+
+		old := user
+		user.Username, user.Email, user.Admin = v.Username, v.Email, &v.Admin
+		user.Version++
+
+		if err := tx.saveUser(old, user); err != nil {
+			return err
+		}
+		return tx.record(record, old, user)
+	})
+}
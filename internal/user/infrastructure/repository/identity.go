@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ConflictError tells which identity field of a user is already taken by
+// another one. It matches ErrAlreadyExists.
+type ConflictError struct {
+	Field string // "username" or "email"
+}
+
+func (e *ConflictError) Error() string {
+	return e.Field + " already exists"
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrAlreadyExists
+}
+
+// UsernameKey is the identity of a username: "Admin", "ADMIN" and "admin"
+// are the same user, and so are the composed and decomposed forms of "José".
+// A Caser is not safe for concurrent use, hence a new one every time.
+func UsernameKey(username string) string {
+	return norm.NFC.String(cases.Fold().String(norm.NFC.String(username)))
+}
+
+// emailKey is the identity of an email.
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+type identityKey struct {
+	field string
+	key   string
+}
+
+// identityKeys are the keys of the identity index for a user, the username
+// first.
+func identityKeys(username, email string) []identityKey {
+	return []identityKey{
+		{"username", usernameIdentity(username)},
+		{"email", emailIdentity(email)},
+	}
+}
+
+func usernameIdentity(username string) string {
+	return "username/" + UsernameKey(username)
+}
+
+func emailIdentity(email string) string {
+	return "email/" + emailKey(email)
+}
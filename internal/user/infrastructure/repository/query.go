@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	storage "users/internal/db"
+	"users/internal/user/infrastructure/dto"
+)
+
+// termTimeLayout is fixed-width, so formatted times sort as strings.
+const termTimeLayout = "2006-01-02T15:04:05.000000000"
+
+// userIndexes are the secondary indexes UserRepo keeps over userdb: one per
+// sortable field, plus email_domain and username_key for filtering, all of
+// them over the live users only, and deleted_at over the trash.
+var userIndexes = map[string]storage.IndexFunc{
+	"id":           userIndex("id"),
+	"username":     userIndex("username"),
+	"email":        userIndex("email"),
+	"admin":        userIndex("admin"),
+	"created_at":   userIndex("created_at"),
+	"email_domain": userIndex("email_domain"),
+	"username_key": userIndex("username_key"),
+	"deleted_at":   trashIndex,
+}
+
+func userIndex(field string) storage.IndexFunc {
+	return func(_ string, value []byte) (string, bool) {
+		var user dto.ListUser
+		if err := json.Unmarshal(value, &user); err != nil || user.DeletedAt != nil {
+			return "", false
+		}
+		return userTerm(field, user), true
+	}
+}
+
+func trashIndex(_ string, value []byte) (string, bool) {
+	var user dto.ListUser
+	if err := json.Unmarshal(value, &user); err != nil || user.DeletedAt == nil {
+		return "", false
+	}
+	return timeTerm(*user.DeletedAt), true
+}
+
+// userTerm encodes a field of the user as an index term.
+func userTerm(field string, user dto.ListUser) string {
+	switch field {
+	case "id":
+		return user.Id
+	case "username":
+		return user.Username
+	case "email":
+		return user.Email
+	case "admin":
+		return boolTerm(user.Admin)
+	case "created_at":
+		return timeTerm(user.CreatedAt)
+	case "email_domain":
+		return emailDomain(user.Email)
+	case "username_key":
+		return UsernameKey(user.Username)
+	}
+	return ""
+}
+
+func boolTerm(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func timeTerm(t time.Time) string {
+	return t.UTC().Format(termTimeLayout)
+}
+
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// exact is the index range holding term only.
+func exact(term string) storage.IndexRange {
+	return storage.IndexRange{From: term, To: term + "\x00"}
+}
+
+type indexScan struct {
+	index string
+	r     storage.IndexRange
+}
+
+// filterScans translates the filter into index scans whose results are to be
+// intersected.
+func filterScans(f dto.UserFilter) []indexScan {
+	var scans []indexScan
+
+	if f.EmailDomain != "" {
+		scans = append(scans, indexScan{"email_domain", exact(strings.ToLower(f.EmailDomain))})
+	}
+	if f.UsernamePrefix != "" {
+		scans = append(scans, indexScan{"username_key", storage.IndexRange{Prefix: UsernameKey(f.UsernamePrefix)}})
+	}
+	if !f.CreatedFrom.IsZero() || !f.CreatedTo.IsZero() {
+		var r storage.IndexRange
+		if !f.CreatedFrom.IsZero() {
+			r.From = timeTerm(f.CreatedFrom)
+		}
+		if !f.CreatedTo.IsZero() {
+			r.To = timeTerm(f.CreatedTo)
+		}
+		scans = append(scans, indexScan{"created_at", r})
+	}
+	// the least selective one goes last
+	if f.Admin != nil {
+		scans = append(scans, indexScan{"admin", exact(boolTerm(*f.Admin))})
+	}
+
+	return scans
+}
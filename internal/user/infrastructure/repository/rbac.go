@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"users/internal/rbac"
+)
+
+func (u *UserRepo) Roles() rbac.Store {
+	return u.roles
+}
+
+func (s *SQLiteRepo) Roles() rbac.Store {
+	return s.roles
+}
+
+// sqliteRoleStore keeps the roles in the roles table, the permissions as JSON,
+// and the roles of the users in user_roles.
+type sqliteRoleStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteRoleStore) GetRole(name string) (rbac.Role, error) {
+	var permissions string
+	err := s.db.QueryRow(`SELECT permissions FROM roles WHERE name = ?`, name).Scan(&permissions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rbac.Role{}, rbac.ErrRoleNotFound
+	}
+	if err != nil {
+		return rbac.Role{}, err
+	}
+
+	role := rbac.Role{Name: name}
+	err = json.Unmarshal([]byte(permissions), &role.Permissions)
+	return role, err
+}
+
+func (s *sqliteRoleStore) ListRoles() ([]rbac.Role, error) {
+	rows, err := s.db.Query(`SELECT name, permissions FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []rbac.Role{}
+	for rows.Next() {
+		var (
+			role        rbac.Role
+			permissions string
+		)
+		if err := rows.Scan(&role.Name, &permissions); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(permissions), &role.Permissions); err != nil {
+			return nil, err
+		}
+		res = append(res, role)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqliteRoleStore) CreateRole(role rbac.Role) error {
+	permissions, _ := json.Marshal(role.Permissions)
+
+	res, err := s.db.Exec(`INSERT INTO roles (name, permissions) VALUES (?, ?) ON CONFLICT DO NOTHING`, role.Name, string(permissions))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return rbac.ErrRoleExists
+	}
+
+	return nil
+}
+
+func (s *sqliteRoleStore) UpdateRole(role rbac.Role) error {
+	permissions, _ := json.Marshal(role.Permissions)
+
+	res, err := s.db.Exec(`UPDATE roles SET permissions = ? WHERE name = ?`, string(permissions), role.Name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return rbac.ErrRoleNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteRoleStore) DeleteRole(name string) error {
+	res, err := s.db.Exec(`DELETE FROM roles WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return rbac.ErrRoleNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteRoleStore) UserRoles(userId string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT role FROM user_roles WHERE user_id = ? ORDER BY role`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		res = append(res, role)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqliteRoleStore) SetUserRoles(userId string, roles []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM roles WHERE name = ?)`, role).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return rbac.ErrRoleNotFound
+		}
+
+		if _, err := tx.Exec(`INSERT INTO user_roles (user_id, role) VALUES (?, ?) ON CONFLICT DO NOTHING`, userId, role); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
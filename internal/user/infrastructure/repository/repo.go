@@ -2,34 +2,234 @@ package repository
 
 import (
 	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+	"users/internal/apikey"
+	"users/internal/audit"
 	storage "users/internal/db"
+	"users/internal/rbac"
+	"users/internal/reset"
+	"users/internal/search"
+	"users/internal/session"
+	"users/internal/token"
+	"users/internal/totp"
 	entity "users/internal/user/domain"
 	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrAlreadyExists = errors.New("user already exists")
+	ErrNotFound      = errors.New("user not found")
+
+	// ErrVersionMismatch is returned when the user was changed since the
+	// version the caller expected.
+	ErrVersionMismatch = errors.New("user version mismatch")
+
+	// ErrIdentityCollision is returned at startup when users stored before
+	// the identities were normalized collide with each other.
+	ErrIdentityCollision = errors.New("users collide on their normalized username or email, rename them")
+)
+
+// The mutations of the users take the audit entry recording them, if any. It's
+// completed with the target and the changed fields, see auditEntry, and
+// appended to the AuditLog in the same transaction as the mutation.
 type UserRepository interface {
-	CreateUser(user dto.CreateUser) (uuid string, err error)
-	GetUserList(limit, offset int) []dto.ListUser
-	UpdateUser(uuid string, user dto.UpdateUser)
-	DeleteUser(uuid string)
+	CreateUser(user dto.CreateUser, record *audit.Entry) (uuid string, err error)
+	GetUserList(query dto.ListQuery) (dto.UserPage, error)
+	// UpdateUser and DeleteUser fail with ErrVersionMismatch unless version
+	// is nil or the current version of the user.
+	UpdateUser(uuid string, user dto.UpdateUser, version *uint64, record *audit.Entry) error
+	DeleteUser(uuid string, version *uint64, record *audit.Entry) error
+	// RehashPassword replaces the password hash of the user with another hash
+	// of the same password, unless it's no longer oldHash. As the password
+	// stays the same, it's not a new version.
+	RehashPassword(uuid, oldHash, newHash string) error
+
+	// GetUserHistory lists the versions of a user, deleted ones included,
+	// oldest first. GetUserAsOf returns the user as it was at the time.
+	GetUserHistory(uuid string) ([]dto.UserVersion, error)
+	GetUserAsOf(uuid string, at time.Time) (dto.ListUser, error)
+	// RestoreUser makes the username, email and admin flag of an earlier
+	// version current again, as a new version. The password is kept.
+	RestoreUser(uuid string, version uint64, ifMatch *uint64, record *audit.Entry) error
+
+	// DeleteUser only moves a user to the trash, where it's hidden from
+	// everything but ListDeletedUsers until UndeleteUser takes it out or
+	// PurgeDeleted removes it for good.
+	ListDeletedUsers() ([]dto.ListUser, error)
+	UndeleteUser(uuid string, ifMatch *uint64, record *audit.Entry) error
+	PurgeDeleted(before time.Time) (int, error)
 	IfUserExist(uuid string) bool
 	GetCredentialsByUsername(username string) (dto.AuthPermission, bool)
 	GetUserById(uuid string) dto.ListUser
-	CreateAdmin()
+	// GetUserByEmail finds a live user by the identity of the email.
+	GetUserByEmail(email string) (dto.ListUser, bool)
+	SearchUsers(query string, limit int) ([]dto.ListUser, error)
+	// HasUsers tells whether any user was ever created, the ones in the
+	// trash count.
+	HasUsers() (bool, error)
+
+	// AuditLog is where the changes made through the API are recorded.
+	AuditLog() audit.Log
+	Sessions() session.Store
+	RefreshTokens() token.RefreshStore
+	Roles() rbac.Store
+	TwoFactor() totp.Store
+	APIKeys() apikey.Store
+	PasswordResets() reset.Store
 }
 
 type UserRepo struct {
-	userdb *storage.InMemoryStorage // profile Storage by id
-	authdb *storage.InMemoryStorage // credentials Storage by username
+	userdb     storage.Store // profile Storage by id
+	authdb     storage.Store // credentials Storage by username
+	identitydb storage.Store // user ids by normalized username and email, see identityKeys
+	historydb  storage.Store // versions of the profiles by id and version, see historyKey
+	audit      *audit.StoreLog
+	sessions   *session.KVStore
+	refresh    *token.KVStore
+	roles      *rbac.KVStore
+	totp       *totp.KVStore
+	keys       *apikey.KVStore
+	resets     *reset.KVStore
+
+	searchMu sync.Mutex
+	search   *search.Index // usernames and emails by id
+}
+
+// Stores are the stores UserRepo is built on.
+type Stores struct {
+	Users      storage.Store // profiles by id
+	Auth       storage.Store // credentials by username
+	Identities storage.Store // user ids by normalized username and email
+	History    storage.Store // versions of the profiles
+	Audit      storage.Store
+	Sessions   storage.Store
+	Refresh    storage.Store // refresh tokens
+	Roles      storage.Store
+	TwoFactor  storage.Store
+	APIKeys    storage.Store
+	Resets     storage.Store // password reset tokens
+}
+
+// NewMemoryStores returns empty in-memory Stores, attached to the journal
+// unless it's nil. The names they are attached under are the ones the
+// journals were written with, don't change them.
+func NewMemoryStores(journal *storage.Journal) Stores {
+	var s Stores
+	for _, n := range []struct {
+		name  string
+		store *storage.Store
+	}{
+		{"userdb", &s.Users},
+		{"authdb", &s.Auth},
+		{"identitydb", &s.Identities},
+		{"historydb", &s.History},
+		{"auditdb", &s.Audit},
+		{"sessiondb", &s.Sessions},
+		{"refreshdb", &s.Refresh},
+		{"roledb", &s.Roles},
+		{"totpdb", &s.TwoFactor},
+		{"keydb", &s.APIKeys},
+		{"resetdb", &s.Resets},
+	} {
+		store := storage.NewInMemoryStorage()
+		if journal != nil {
+			journal.Attach(n.name, store)
+		}
+		*n.store = store
+	}
+	return s
+}
+
+func NewBannerRepository(stores Stores) UserRepository {
+	for name, fn := range userIndexes {
+		stores.Users.CreateIndex(name, fn)
+	}
+	stores.History.CreateIndex(historyIndex, historyKeyIndex)
+
+	u := &UserRepo{
+		userdb:     stores.Users,
+		authdb:     stores.Auth,
+		identitydb: stores.Identities,
+		historydb:  stores.History,
+		audit:      audit.NewStoreLog(stores.Audit),
+		sessions:   session.NewKVStore(stores.Sessions),
+		refresh:    token.NewKVStore(stores.Refresh),
+		roles:      rbac.NewKVStore(stores.Roles),
+		totp:       totp.NewKVStore(stores.TwoFactor),
+		keys:       apikey.NewKVStore(stores.APIKeys),
+		resets:     reset.NewKVStore(stores.Resets),
+		search:     search.NewIndex(),
+	}
+
+	var users []dto.ListUser
+	stores.Users.Scan(func(id string, v []byte) bool {
+		var user dto.ListUser
+		json.Unmarshal(v, &user)
+		if user.DeletedAt == nil {
+			u.search.Put(id, user.Username, user.Email)
+		}
+		users = append(users, user)
+		return true
+	})
+	u.backfillIdentities(users)
+	u.backfillHistory()
+
+	return u
+}
+
+// backfillIdentities adds the users stored before the identity index existed
+// to it. Users colliding with an indexed one are left out and logged, they
+// have to be renamed by hand.
+func (u *UserRepo) backfillIdentities(users []dto.ListUser) {
+	err := u.identitydb.Update(func(ids storage.Tx) error {
+		for _, user := range users {
+			if user.DeletedAt != nil {
+				continue
+			}
+			if err := claimIdentity(ids, user.Id, user.Username, user.Email); err != nil {
+				slogger.Logger.Warn("user identity collides with another user", "id", user.Id, "err", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slogger.Logger.Error("error while indexing user identities", "err", err)
+	}
 }
 
-func NewBannerRepository(userdb *storage.InMemoryStorage, authdb *storage.InMemoryStorage) UserRepository {
-	return &UserRepo{userdb: userdb, authdb: authdb}
+// claimIdentity points the identity keys of the user at id, unless one of
+// them belongs to another user.
+func claimIdentity(ids storage.Tx, id, username, email string) error {
+	keys := identityKeys(username, email)
+
+	for _, k := range keys {
+		if owner, ok := ids.Get(k.key); ok && string(owner) != id {
+			return &ConflictError{Field: k.field}
+		}
+	}
+	for _, k := range keys {
+		ids.Set(k.key, []byte(id))
+	}
+
+	return nil
+}
+
+// releaseIdentity removes the identity keys of the user that point at id.
+func releaseIdentity(ids storage.Tx, id, username, email string) {
+	for _, k := range identityKeys(username, email) {
+		if owner, ok := ids.Get(k.key); ok && string(owner) == id {
+			ids.Delete(k.key)
+		}
+	}
 }
 
-func (u *UserRepo) CreateUser(user dto.CreateUser) (uuid string, err error) {
+func (u *UserRepo) CreateUser(user dto.CreateUser, record *audit.Entry) (uuid string, err error) {
 	id := u.GenerateUUID()
 	err = user.HashPassword()
 
@@ -38,117 +238,397 @@ func (u *UserRepo) CreateUser(user dto.CreateUser) (uuid string, err error) {
 	}
 
 	db_user := user.ToStorageUser(id)
-	b, _ := json.Marshal(db_user)
 
-	u.userdb.Set(id, b)
-
-	auth_user := dto.AuthPermission{Password: db_user.Password,
-		Admin: db_user.Admin}
-
-	b, _ = json.Marshal(auth_user)
-	u.authdb.Set(user.Username, b)
+	err = u.update(func(tx userTx) error {
+		if err := tx.saveUser(entity.User{}, db_user); err != nil {
+			return err
+		}
+		return tx.record(record, entity.User{}, db_user)
+	})
+	if err != nil {
+		return "", err
+	}
+	u.reindex(id)
 
 	return id, nil
 
 }
 
-func (u *UserRepo) GetUserList(limit, offset int) []dto.ListUser {
+// memoryCursor points at the last listed user by its position in the index
+// of the sort field.
+type memoryCursor struct {
+	Sort string `json:"f"`
+	Desc bool   `json:"d,omitempty"`
+	Term string `json:"t"`
+	Seq  uint64 `json:"s"`
+}
 
-	if offset != 0 && limit != 0 {
+func (u *UserRepo) GetUserList(query dto.ListQuery) (dto.UserPage, error) {
+	if query.Sort == "" {
+		query.Sort = "created_at"
+	}
 
-		res := make([]dto.ListUser, 0, limit)
-		cnt := 0
+	var after *storage.IndexPos
 
-		u.userdb.RLock()
-		for _, v := range u.userdb.Storage {
-			cnt++
-			if cnt <= offset {
-				continue
-			}
+	if query.Cursor != "" {
+		var cursor memoryCursor
+		if err := decodeCursor(query.Cursor, &cursor); err != nil {
+			return dto.UserPage{}, err
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return dto.UserPage{}, ErrInvalidCursor
+		}
+		after = &storage.IndexPos{Term: cursor.Term, Seq: cursor.Seq}
+	}
+
+	res := dto.UserPage{Users: []dto.ListUser{}}
+	skipped := 0
+	var last storage.IndexPos
+
+	collect := func(pos storage.IndexPos, user dto.ListUser) bool {
+		if skipped < query.Offset {
+			skipped++
+			return true
+		}
+
+		if query.Limit != 0 && len(res.Users) == query.Limit {
+			res.NextCursor = encodeCursor(memoryCursor{Sort: query.Sort, Desc: query.Desc, Term: last.Term, Seq: last.Seq})
+			return false
+		}
+
+		res.Users = append(res.Users, user)
+		last = pos
+
+		return true
+	}
+
+	scans := filterScans(query.Filter)
+
+	// Without a filter the index of the sort field is walked from the cursor
+	// on. Otherwise the filter indexes give the matching users, which are
+	// then sorted.
+	if len(scans) == 0 {
+		r := storage.IndexRange{After: after, Desc: query.Desc}
 
+		err := u.userdb.ScanIndex(query.Sort, r, func(pos storage.IndexPos, _ string, v []byte) bool {
 			var user dto.ListUser
 			json.Unmarshal(v, &user)
-			res = append(res, user)
+			return collect(pos, user)
+		})
+		return res, err
+	}
 
-			if cnt == offset+limit {
-				break
-			}
+	matched, err := u.match(scans)
+	if err != nil {
+		return dto.UserPage{}, err
+	}
 
+	positions := make([]storage.IndexPos, 0, len(matched))
+	users := make(map[storage.IndexPos]dto.ListUser, len(matched))
+
+	for seq, user := range matched {
+		pos := storage.IndexPos{Term: userTerm(query.Sort, user), Seq: seq}
+		positions = append(positions, pos)
+		users[pos] = user
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		if query.Desc {
+			return positions[j].Less(positions[i])
 		}
-		u.userdb.RUnlock()
-		return res
+		return positions[i].Less(positions[j])
+	})
 
+	for _, pos := range positions {
+		if after != nil && (query.Desc && !pos.Less(*after) || !query.Desc && !after.Less(pos)) {
+			continue
+		}
+		if !collect(pos, users[pos]) {
+			break
+		}
 	}
 
-	res := []dto.ListUser{}
-	var db_user dto.ListUser
+	return res, nil
+}
 
-	users := u.userdb.GetUsers()
+// match runs the index scans and returns the users found by all of them, by
+// sequence number.
+func (u *UserRepo) match(scans []indexScan) (map[uint64]dto.ListUser, error) {
+	var matched map[uint64]dto.ListUser
+
+	for _, scan := range scans {
+		found := make(map[uint64]dto.ListUser)
+
+		err := u.userdb.ScanIndex(scan.index, scan.r, func(pos storage.IndexPos, _ string, v []byte) bool {
+			if matched == nil {
+				var user dto.ListUser
+				json.Unmarshal(v, &user)
+				found[pos.Seq] = user
+			} else if user, ok := matched[pos.Seq]; ok {
+				found[pos.Seq] = user
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
 
-	for _, user := range users {
-		json.Unmarshal(user, &db_user)
-		res = append(res, db_user)
+		matched = found
 	}
 
-	return res
+	return matched, nil
+}
+
+func (u *UserRepo) UpdateUser(uuid string, user dto.UpdateUser, version *uint64, record *audit.Entry) error {
+	if user.Password != "" {
+		if err := user.HashPassword(); err != nil {
+			return err
+		}
+	}
+	defer u.reindex(uuid)
 
+	return u.update(func(tx userTx) error {
+		userToUpdate, err := tx.getUser(uuid, version)
+		if err != nil {
+			return err
+		}
+		old := userToUpdate
+
+		user.MakeUpdatedUser(&userToUpdate)
+		userToUpdate.Version++
+
+		if err := tx.saveUser(old, userToUpdate); err != nil {
+			return err
+		}
+		return tx.record(record, old, userToUpdate)
+	})
 }
 
-func (u *UserRepo) UpdateUser(uuid string, user dto.UpdateUser) {
-	var userToUpdate entity.User
+func (u *UserRepo) RehashPassword(uuid, oldHash, newHash string) error {
+	return u.update(func(tx userTx) error {
+		user, err := tx.getUser(uuid, nil)
+		if err != nil {
+			return err
+		}
+		if user.Password != oldHash {
+			return nil
+		}
 
-	json.Unmarshal(u.userdb.Storage[uuid], &userToUpdate)
+		user.Password = newHash
+		b, _ := json.Marshal(user)
+		tx.users.Set(user.Id, b)
 
-	user.HashPassword()
-	user.MakeUpdatedUser(&userToUpdate)
+		b, _ = json.Marshal(dto.AuthPermission{Id: user.Id, Password: user.Password, Admin: user.Admin, MustChangePassword: user.MustChangePassword})
+		tx.auth.Set(user.Username, b)
+		return nil
+	})
+}
 
-	b, _ := json.Marshal(userToUpdate)
-	u.userdb.Set(uuid, b)
+func (u *UserRepo) DeleteUser(uuid string, version *uint64, record *audit.Entry) error {
+	defer u.reindex(uuid)
 
-	if user.Username != "" {
-		a := dto.AuthPermission{Password: user.Password,
-			Admin: user.Admin}
+	return u.update(func(tx userTx) error {
+		user, err := tx.getUser(uuid, version)
+		if err != nil {
+			return err
+		}
 
-		b, _ = json.Marshal(a)
-		u.authdb.Delete(userToUpdate.Username)
-		u.authdb.Set(user.Username, b)
-	}
+		tx.trashUser(user)
+		return tx.record(record, user, entity.User{})
+	})
+}
 
+// userTx is a transaction over all the stores of UserRepo, so a profile, its
+// credentials, its identity, its history and the audit entry of the change
+// are always written together.
+type userTx struct {
+	users   storage.Tx
+	auth    storage.Tx
+	ids     storage.Tx
+	history storage.Tx
+	audit   storage.Tx
+	log     *audit.StoreLog
 }
 
-func (u *UserRepo) DeleteUser(uuid string) {
+func (u *UserRepo) update(fn func(tx userTx) error) error {
+	return u.updateWith(nil, func(tx userTx, _ []storage.Tx) error {
+		return fn(tx)
+	})
+}
+
+// updateWith runs fn in a userTx extended over the extra stores, fn gets
+// one Tx per extra store in the same order.
+func (u *UserRepo) updateWith(extra []storage.Store, fn func(tx userTx, extra []storage.Tx) error) error {
+	stores := append([]storage.Store{u.userdb, u.authdb, u.identitydb, u.historydb, u.audit.Store()}, extra...)
+
+	return storage.UpdateAll(stores, func(txs []storage.Tx) error {
+		return fn(userTx{users: txs[0], auth: txs[1], ids: txs[2], history: txs[3], audit: txs[4], log: u.audit}, txs[5:])
+	})
+}
+
+// record appends the entry recording the change of the user from before to
+// after, nil recording nothing.
+func (tx userTx) record(record *audit.Entry, before, after entity.User) error {
+	if record == nil {
+		return nil
+	}
+	_, err := tx.log.AppendTx(tx.audit, auditEntry(*record, before, after))
+	return err
+}
+
+// getUser reads a live user, failing with ErrVersionMismatch unless version
+// is nil or the current one.
+func (tx userTx) getUser(uuid string, version *uint64) (entity.User, error) {
+	user, ok := tx.readUser(uuid)
+	if !ok || user.DeletedAt != nil {
+		return user, ErrNotFound
+	}
 
+	if version != nil && *version != user.Version {
+		return user, ErrVersionMismatch
+	}
+	return user, nil
+}
+
+// readUser reads the user whether it's in the trash or not.
+func (tx userTx) readUser(uuid string) (entity.User, bool) {
 	var user entity.User
 
-	b, _ := u.userdb.Get(uuid)
+	b, ok := tx.users.Get(uuid)
+	if ok {
+		json.Unmarshal(b, &user)
+	}
+	return user, ok
+}
+
+// saveUser stores the new state of the user, whose previous state was old
+// (the zero User for a new one), and records it in the history.
+func (tx userTx) saveUser(old, user entity.User) error {
+	// the old keys are released first, so changing only the case of the
+	// username doesn't collide with the user itself
+	if old.Id != "" {
+		releaseIdentity(tx.ids, old.Id, old.Username, old.Email)
+	}
+	if err := claimIdentity(tx.ids, user.Id, user.Username, user.Email); err != nil {
+		return err
+	}
+	if old.Id != "" && old.Username != user.Username {
+		tx.auth.Delete(old.Username)
+	}
+
+	b, _ := json.Marshal(user)
+	tx.users.Set(user.Id, b)
+
+	// credentials are rewritten every time as the password and the admin
+	// flag may have changed as well
+	a := dto.AuthPermission{Id: user.Id, Password: user.Password,
+		Admin: user.Admin, MustChangePassword: user.MustChangePassword}
+
+	b, _ = json.Marshal(a)
+	tx.auth.Set(user.Username, b)
+
+	recordVersion(tx.history, user.Id, dto.ToUserVersion(user, time.Now().UTC(), false))
+	return nil
+}
+
+// trashUser moves the user to the trash as its next version. It can't log in
+// anymore and gives up its identity, which it claims back when restored.
+func (tx userTx) trashUser(user entity.User) {
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+	user.Version++
+
+	b, _ := json.Marshal(user)
+	tx.users.Set(user.Id, b)
+	tx.auth.Delete(user.Username)
+	releaseIdentity(tx.ids, user.Id, user.Username, user.Email)
+
+	recordVersion(tx.history, user.Id, dto.ToUserVersion(user, now, true))
+}
+
+func (u *UserRepo) SearchUsers(query string, limit int) ([]dto.ListUser, error) {
+	res := []dto.ListUser{}
+
+	for _, hit := range u.search.Search(query, limit) {
+		if user, ok := u.liveUser(hit.Id); ok {
+			res = append(res, user)
+		}
+	}
+
+	return res, nil
+}
+
+// liveUser reads the user unless it's missing or in the trash.
+func (u *UserRepo) liveUser(uuid string) (dto.ListUser, bool) {
+	var user dto.ListUser
+
+	b, ok := u.userdb.Get(uuid)
+	if !ok {
+		return user, false
+	}
 	json.Unmarshal(b, &user)
 
-	u.userdb.Delete(uuid)
-	u.authdb.Delete(user.Username)
+	if user.DeletedAt != nil {
+		return dto.ListUser{}, false
+	}
+	return user, true
+}
+
+// reindex brings the search index up to date with the stored profile. It's
+// serialized, so the last call always indexes the latest committed state.
+func (u *UserRepo) reindex(uuid string) {
+	u.searchMu.Lock()
+	defer u.searchMu.Unlock()
+
+	user, ok := u.liveUser(uuid)
+	if !ok {
+		u.search.Remove(uuid)
+		return
+	}
+	u.search.Put(uuid, user.Username, user.Email)
 }
 
 func (u *UserRepo) IfUserExist(uuid string) bool {
-	_, ok := u.userdb.Get(uuid)
+	_, ok := u.liveUser(uuid)
 	return ok
 }
 
 func (u *UserRepo) GetUserById(uuid string) dto.ListUser {
-	var user dto.ListUser
-	b, _ := u.userdb.Get(uuid)
-	json.Unmarshal(b, &user)
+	user, _ := u.liveUser(uuid)
 	return user
 }
 
+func (u *UserRepo) GetUserByEmail(email string) (dto.ListUser, bool) {
+	id, ok := u.identitydb.Get(emailIdentity(email))
+	if !ok {
+		return dto.ListUser{}, false
+	}
+	return u.liveUser(string(id))
+}
+
+// GetCredentialsByUsername finds the credentials by the identity of the
+// username, so "Admin" logs in as "admin".
 func (u *UserRepo) GetCredentialsByUsername(username string) (dto.AuthPermission, bool) {
 
 	var authCredentials dto.AuthPermission
 	b, ok := u.authdb.Get(username)
+	id, found := u.identitydb.Get(usernameIdentity(username))
 
 	if !ok {
-		return authCredentials, ok
+		if !found {
+			return authCredentials, false
+		}
+		if b, ok = u.authdb.Get(u.GetUserById(string(id)).Username); !ok {
+			return authCredentials, false
+		}
 	}
 	json.Unmarshal(b, &authCredentials)
 
+	// credentials stored before they had the id
+	if authCredentials.Id == "" && found {
+		authCredentials.Id = string(id)
+	}
+
 	return authCredentials, true
 }
 
@@ -156,25 +636,11 @@ func (u *UserRepo) GenerateUUID() string {
 	return uuid.New().String()
 }
 
-func (u *UserRepo) CreateAdmin() {
-	admin := true
-	user := dto.CreateUser{Email: "lol@test.ru",
-		Username: "admin",
-		Password: "admin",
-		Admin:    &admin}
-
-	id := u.GenerateUUID()
-	user.HashPassword()
-
-	db_user := user.ToStorageUser(id)
-	b, _ := json.Marshal(db_user)
-
-	u.userdb.Set(id, b)
-
-	auth_user := dto.AuthPermission{Password: db_user.Password,
-		Admin: db_user.Admin}
-
-	b, _ = json.Marshal(auth_user)
-
-	u.authdb.Set(user.Username, b)
+func (u *UserRepo) HasUsers() (bool, error) {
+	found := false
+	u.userdb.Scan(func(string, []byte) bool {
+		found = true
+		return false
+	})
+	return found, nil
 }
@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"users/internal/reset"
+)
+
+func (u *UserRepo) PasswordResets() reset.Store {
+	return u.resets
+}
+
+func (s *SQLiteRepo) PasswordResets() reset.Store {
+	return s.resets
+}
+
+// sqliteResetStore keeps the tokens in the password_resets table.
+type sqliteResetStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteResetStore) Create(key string, t reset.Token) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, t.UserId); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO password_resets (key, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		key, t.UserId, t.CreatedAt.UnixNano(), t.ExpiresAt.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func getResetToken(q queryRower, key string) (reset.Token, error) {
+	var (
+		t                    reset.Token
+		createdAt, expiresAt int64
+	)
+
+	err := q.QueryRow(`SELECT user_id, created_at, expires_at FROM password_resets WHERE key = ?`, key).
+		Scan(&t.UserId, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return reset.Token{}, reset.ErrInvalidToken
+	}
+	if err != nil {
+		return reset.Token{}, err
+	}
+	t.CreatedAt, t.ExpiresAt = time.Unix(0, createdAt).UTC(), time.Unix(0, expiresAt).UTC()
+
+	return t, nil
+}
+
+func (s *sqliteResetStore) Get(key string) (reset.Token, error) {
+	return getResetToken(s.db, key)
+}
+
+func (s *sqliteResetStore) Consume(key string) (reset.Token, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return reset.Token{}, err
+	}
+	defer tx.Rollback()
+
+	t, err := getResetToken(tx, key)
+	if err != nil {
+		return reset.Token{}, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, t.UserId); err != nil {
+		return reset.Token{}, err
+	}
+
+	return t, tx.Commit()
+}
+
+func (s *sqliteResetStore) DeleteExpired(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM password_resets WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
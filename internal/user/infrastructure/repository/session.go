@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"users/internal/session"
+)
+
+func (u *UserRepo) Sessions() session.Store {
+	return u.sessions
+}
+
+func (s *SQLiteRepo) Sessions() session.Store {
+	return s.sessions
+}
+
+// sqliteSessionStore keeps the sessions in the sessions table.
+type sqliteSessionStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteSessionStore) Get(key string) (session.Session, error) {
+	var (
+		res                  session.Session
+		createdAt, expiresAt int64
+	)
+
+	err := s.db.QueryRow(`SELECT user_id, created_at, expires_at, second_factor FROM sessions WHERE key = ?`, key).
+		Scan(&res.UserId, &createdAt, &expiresAt, &res.SecondFactor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session.Session{}, session.ErrNotFound
+	}
+	if err != nil {
+		return session.Session{}, err
+	}
+	res.CreatedAt, res.ExpiresAt = time.Unix(0, createdAt).UTC(), time.Unix(0, expiresAt).UTC()
+
+	return res, nil
+}
+
+func (s *sqliteSessionStore) Put(key string, sess session.Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (key, user_id, created_at, expires_at, second_factor) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET expires_at = excluded.expires_at`,
+		key, sess.UserId, sess.CreatedAt.UnixNano(), sess.ExpiresAt.UnixNano(), sess.SecondFactor)
+	return err
+}
+
+func (s *sqliteSessionStore) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteSessionStore) DeleteUser(userId string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userId)
+	return err
+}
+
+func (s *sqliteSessionStore) DeleteOthers(userId, key string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ? AND key <> ?`, userId, key)
+	return err
+}
+
+func (s *sqliteSessionStore) DeleteExpired(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,941 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"users/internal/audit"
+	"users/internal/search"
+	entity "users/internal/user/domain"
+	"users/internal/user/infrastructure/dto"
+	slogger "users/pkg/logger"
+
+	"github.com/google/uuid"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// migrations are applied in order at startup, each one exactly once. Only
+// append to the list: the index of a migration is its schema version.
+var migrations = []string{
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL UNIQUE,
+		email      TEXT NOT NULL UNIQUE,
+		admin      INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE credentials (
+		user_id  TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		password TEXT NOT NULL
+	);`,
+	`CREATE INDEX users_created_at ON users (created_at, id);
+	CREATE INDEX users_admin ON users (admin, created_at, id);
+	CREATE INDEX users_email_domain ON users (lower(substr(email, instr(email, '@') + 1)));`,
+	// the keys are filled in by backfillIdentities, see identityKeys
+	`ALTER TABLE users ADD COLUMN username_key TEXT;
+	ALTER TABLE users ADD COLUMN email_key TEXT;
+	CREATE UNIQUE INDEX users_username_key ON users (username_key);
+	CREATE UNIQUE INDEX users_email_key ON users (email_key);`,
+	`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+	// no foreign key, the history outlives the user; the current version of
+	// the existing users is its first one, its change time is only known for
+	// never updated users
+	`CREATE TABLE user_history (
+		user_id    TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		username   TEXT NOT NULL,
+		email      TEXT NOT NULL,
+		admin      INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		changed_at INTEGER NOT NULL,
+		deleted    INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, version)
+	);
+	INSERT INTO user_history (user_id, version, username, email, admin, created_at, changed_at)
+	SELECT id, version, username, email, admin, created_at,
+		CASE WHEN version <= 1 THEN created_at ELSE CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) END
+	FROM users;`,
+	// users in the trash give up their identity keys, so the raw username and
+	// email can't be unique anymore: the table is rebuilt without the
+	// constraints, credentials first as they reference it
+	`CREATE TABLE credentials_old AS SELECT * FROM credentials;
+	DROP TABLE credentials;
+	CREATE TABLE users_new (
+		id           TEXT PRIMARY KEY,
+		username     TEXT NOT NULL,
+		email        TEXT NOT NULL,
+		admin        INTEGER NOT NULL DEFAULT 0,
+		created_at   INTEGER NOT NULL,
+		username_key TEXT,
+		email_key    TEXT,
+		version      INTEGER NOT NULL DEFAULT 1,
+		deleted_at   INTEGER
+	);
+	INSERT INTO users_new (id, username, email, admin, created_at, username_key, email_key, version)
+	SELECT id, username, email, admin, created_at, username_key, email_key, version FROM users;
+	DROP TABLE users;
+	ALTER TABLE users_new RENAME TO users;
+	CREATE TABLE credentials (
+		user_id  TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		password TEXT NOT NULL
+	);
+	INSERT INTO credentials SELECT user_id, password FROM credentials_old;
+	DROP TABLE credentials_old;
+	CREATE INDEX users_created_at ON users (created_at, id);
+	CREATE INDEX users_admin ON users (admin, created_at, id);
+	CREATE INDEX users_email_domain ON users (lower(substr(email, instr(email, '@') + 1)));
+	CREATE UNIQUE INDEX users_username_key ON users (username_key);
+	CREATE UNIQUE INDEX users_email_key ON users (email_key);
+	CREATE INDEX users_deleted_at ON users (deleted_at, id) WHERE deleted_at IS NOT NULL;`,
+	// see sqliteAuditLog, entries are only ever inserted
+	`CREATE TABLE audit_log (
+		seq       INTEGER PRIMARY KEY,
+		time      INTEGER NOT NULL,
+		actor     TEXT NOT NULL,
+		action    TEXT NOT NULL,
+		target    TEXT NOT NULL,
+		changes   TEXT NOT NULL,
+		ip        TEXT NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash      TEXT NOT NULL
+	);`,
+	// see session.Key, sessions go with their user
+	`CREATE TABLE sessions (
+		key        TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_expires_at ON sessions (expires_at);`,
+	// see token.Key, tokens go with their user
+	`CREATE TABLE refresh_tokens (
+		key        TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		family     TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		used       INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+	CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);`,
+	// see rbac.Store, the builtin roles aren't stored
+	`CREATE TABLE roles (
+		name        TEXT PRIMARY KEY,
+		permissions TEXT NOT NULL
+	);
+	CREATE TABLE user_roles (
+		user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role    TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+		PRIMARY KEY (user_id, role)
+	);
+	CREATE INDEX user_roles_role ON user_roles (role);`,
+	// see totp.Store, the recovery codes are JSON
+	`CREATE TABLE totp (
+		user_id        TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		secret         TEXT NOT NULL,
+		confirmed      INTEGER NOT NULL DEFAULT 0,
+		last_step      INTEGER NOT NULL DEFAULT 0,
+		recovery_codes TEXT NOT NULL,
+		created_at     INTEGER NOT NULL
+	);
+	ALTER TABLE sessions ADD COLUMN second_factor INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE refresh_tokens ADD COLUMN second_factor INTEGER NOT NULL DEFAULT 0;`,
+	// see apikey.Store, the keys are only stored hashed and the scopes are JSON
+	`CREATE TABLE api_keys (
+		id            TEXT PRIMARY KEY,
+		user_id       TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name          TEXT NOT NULL,
+		hint          TEXT NOT NULL,
+		hash          TEXT NOT NULL UNIQUE,
+		scopes        TEXT NOT NULL,
+		second_factor INTEGER NOT NULL DEFAULT 0,
+		created_at    INTEGER NOT NULL,
+		expires_at    INTEGER NOT NULL,
+		last_used_at  INTEGER
+	);
+	CREATE INDEX api_keys_user_id ON api_keys (user_id);`,
+	// see dto.AuthPermission, the flag goes with the password
+	`ALTER TABLE credentials ADD COLUMN must_change_password INTEGER NOT NULL DEFAULT 0;`,
+	// see reset.Key, tokens go with their user
+	`CREATE TABLE password_resets (
+		key        TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX password_resets_user_id ON password_resets (user_id);
+	CREATE INDEX password_resets_expires_at ON password_resets (expires_at);`,
+	// see token.RefreshStore, a revocation of the access tokens per user
+	`CREATE TABLE access_revocations (
+		user_id    TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		not_before INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX access_revocations_expires_at ON access_revocations (expires_at);`,
+}
+
+// sqliteColumns maps the sortable fields to their columns.
+var sqliteColumns = map[string]string{
+	"id":         "id",
+	"username":   "username",
+	"email":      "email",
+	"admin":      "admin",
+	"created_at": "created_at",
+}
+
+type SQLiteRepo struct {
+	db       *sql.DB
+	audit    *sqliteAuditLog
+	sessions *sqliteSessionStore
+	refresh  *sqliteRefreshStore
+	roles    *sqliteRoleStore
+	totp     *sqliteTOTPStore
+	keys     *sqliteAPIKeyStore
+	resets   *sqliteResetStore
+
+	searchMu sync.Mutex
+	search   *search.Index // usernames and emails by id
+}
+
+// NewSQLiteRepository opens the database file at path, creating it if needed,
+// and brings its schema up to date.
+func NewSQLiteRepository(path string) (*SQLiteRepo, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate %s: %w", path, err)
+	}
+
+	s := &SQLiteRepo{db: db, audit: &sqliteAuditLog{db: db}, sessions: &sqliteSessionStore{db: db}, refresh: &sqliteRefreshStore{db: db}, roles: &sqliteRoleStore{db: db}, totp: &sqliteTOTPStore{db: db}, keys: &sqliteAPIKeyStore{db: db}, resets: &sqliteResetStore{db: db}, search: search.NewIndex()}
+	if err := s.backfillIdentities(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.loadSearchIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SQLiteRepo) loadSearchIndex() error {
+	rows, err := s.db.Query(`SELECT id, username, email FROM users WHERE deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, username, email string
+		if err := rows.Scan(&id, &username, &email); err != nil {
+			return err
+		}
+		s.search.Put(id, username, email)
+	}
+
+	return rows.Err()
+}
+
+// backfillIdentities fills in the identity keys of the users stored before
+// they existed. Users colliding with another one couldn't log in, so nothing
+// is filled in and the error lists them: they have to be renamed by hand.
+func (s *SQLiteRepo) backfillIdentities() error {
+	rows, err := s.db.Query(`SELECT id, username, email FROM users WHERE (username_key IS NULL OR email_key IS NULL) AND deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	var users []dto.ListUser
+	for rows.Next() {
+		var user dto.ListUser
+		if err := rows.Scan(&user.Id, &user.Username, &user.Email); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(users) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var collisions []string
+	for _, user := range users {
+		for column, key := range map[string]string{"username_key": UsernameKey(user.Username), "email_key": emailKey(user.Email)} {
+			_, err := tx.Exec(fmt.Sprintf(`UPDATE users SET %s = ? WHERE id = ?`, column), key, user.Id)
+			if isUniqueViolation(err) {
+				collisions = append(collisions, fmt.Sprintf("%s (%s)", user.Id, strings.TrimSuffix(column, "_key")))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("%w: %s", ErrIdentityCollision, strings.Join(collisions, ", "))
+	}
+
+	return tx.Commit()
+}
+
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			return fmt.Errorf("version %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			return err
+		}
+		slogger.Logger.Info("applied migration", "version", i+1)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteRepo) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteRepo) CreateUser(user dto.CreateUser, record *audit.Entry) (string, error) {
+	id := uuid.New().String()
+
+	if err := user.HashPassword(); err != nil {
+		return "", err
+	}
+
+	if err := s.insertUser(user.ToStorageUser(id), record); err != nil {
+		return "", err
+	}
+	s.reindex(id)
+
+	return id, nil
+}
+
+func (s *SQLiteRepo) insertUser(user entity.User, record *audit.Entry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO users (id, username, email, admin, created_at, username_key, email_key, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.Id, user.Username, user.Email, *user.Admin, user.CreatedAt.UnixNano(), UsernameKey(user.Username), emailKey(user.Email), user.Version)
+	if err != nil {
+		return conflictError(tx, err, user.Id, user.Username)
+	}
+
+	_, err = tx.Exec(`INSERT INTO credentials (user_id, password, must_change_password) VALUES (?, ?, ?)`, user.Id, user.Password, user.MustChangePassword)
+	if err != nil {
+		return err
+	}
+
+	if err := insertVersion(tx, user.Id, dto.ToUserVersion(user, user.CreatedAt, false)); err != nil {
+		return err
+	}
+	if err := recordChange(tx, record, entity.User{}, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqliteCursor points at the last listed user by its value of the sort
+// column and its id.
+type sqliteCursor struct {
+	Sort  string `json:"f"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	Id    string `json:"i"`
+}
+
+func (s *SQLiteRepo) GetUserList(query dto.ListQuery) (dto.UserPage, error) {
+	if query.Sort == "" {
+		query.Sort = "created_at"
+	}
+	column, ok := sqliteColumns[query.Sort]
+	if !ok {
+		return dto.UserPage{}, fmt.Errorf("unknown sort field %q", query.Sort)
+	}
+
+	where, args := sqliteFilter(query.Filter)
+
+	order, cmp := "ASC", ">"
+	if query.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	if query.Cursor != "" {
+		var cursor sqliteCursor
+		if err := decodeCursor(query.Cursor, &cursor); err != nil {
+			return dto.UserPage{}, err
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return dto.UserPage{}, ErrInvalidCursor
+		}
+		value, err := sqliteArg(query.Sort, cursor.Value)
+		if err != nil {
+			return dto.UserPage{}, ErrInvalidCursor
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (?, ?)", column, cmp))
+		args = append(args, value, cursor.Id)
+	}
+
+	// one extra row tells whether there is a next page
+	limit := -1
+	if query.Limit != 0 {
+		limit = query.Limit + 1
+	}
+
+	q := `SELECT id, username, email, admin, created_at, version FROM users`
+	if len(where) > 0 {
+		q += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	q += fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT ? OFFSET ?`, column, order, order)
+	args = append(args, limit, query.Offset)
+
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return dto.UserPage{}, err
+	}
+	defer rows.Close()
+
+	res := dto.UserPage{Users: []dto.ListUser{}}
+	var last dto.ListUser
+
+	for rows.Next() {
+		if query.Limit != 0 && len(res.Users) == query.Limit {
+			res.NextCursor = encodeCursor(sqliteCursor{Sort: query.Sort, Desc: query.Desc, Value: sqliteValue(query.Sort, last), Id: last.Id})
+			break
+		}
+
+		var (
+			user      dto.ListUser
+			createdAt int64
+		)
+		if err := rows.Scan(&user.Id, &user.Username, &user.Email, &user.Admin, &createdAt, &user.Version); err != nil {
+			return dto.UserPage{}, err
+		}
+		user.CreatedAt = time.Unix(0, createdAt).UTC()
+
+		res.Users = append(res.Users, user)
+		last = user
+	}
+
+	return res, rows.Err()
+}
+
+// sqliteFilter translates the filter into WHERE conditions, all of them
+// covered by an index, on top of leaving the trash out.
+func sqliteFilter(f dto.UserFilter) (where []string, args []any) {
+	where = append(where, "deleted_at IS NULL")
+
+	if f.UsernamePrefix != "" {
+		// no valid UTF-8 string has a 0xff byte, so this is the upper bound of
+		// the strings with the prefix
+		prefix := UsernameKey(f.UsernamePrefix)
+		where = append(where, "username_key >= ? AND username_key < ?")
+		args = append(args, prefix, prefix+"\xff")
+	}
+	if f.EmailDomain != "" {
+		where = append(where, "lower(substr(email, instr(email, '@') + 1)) = ?")
+		args = append(args, strings.ToLower(f.EmailDomain))
+	}
+	if f.Admin != nil {
+		where = append(where, "admin = ?")
+		args = append(args, *f.Admin)
+	}
+	if !f.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.CreatedFrom.UnixNano())
+	}
+	if !f.CreatedTo.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.CreatedTo.UnixNano())
+	}
+
+	return where, args
+}
+
+// sqliteValue formats the value of the sort column for user. sqliteArg parses
+// it back into the type of the column.
+func sqliteValue(field string, user dto.ListUser) string {
+	switch field {
+	case "username":
+		return user.Username
+	case "email":
+		return user.Email
+	case "admin":
+		return strconv.FormatBool(user.Admin)
+	case "created_at":
+		return strconv.FormatInt(user.CreatedAt.UnixNano(), 10)
+	}
+	return user.Id
+}
+
+func sqliteArg(field, value string) (any, error) {
+	switch field {
+	case "admin":
+		return strconv.ParseBool(value)
+	case "created_at":
+		return strconv.ParseInt(value, 10, 64)
+	}
+	return value, nil
+}
+
+func (s *SQLiteRepo) UpdateUser(uuid string, user dto.UpdateUser, version *uint64, record *audit.Entry) error {
+	if user.Password != "" {
+		if err := user.HashPassword(); err != nil {
+			return err
+		}
+	}
+	defer s.reindex(uuid)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userToUpdate, err := getUserVersion(tx, uuid, version)
+	if err != nil {
+		return err
+	}
+
+	old := userToUpdate
+	user.MakeUpdatedUser(&userToUpdate)
+	if err := saveUser(tx, userToUpdate); err != nil {
+		return err
+	}
+	if err := recordChange(tx, record, old, userToUpdate); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteRepo) RehashPassword(uuid, oldHash, newHash string) error {
+	_, err := s.db.Exec(`UPDATE credentials SET password = ? WHERE user_id = ? AND password = ?`, newHash, uuid, oldHash)
+	return err
+}
+
+func (s *SQLiteRepo) DeleteUser(uuid string, version *uint64, record *audit.Entry) error {
+	defer s.reindex(uuid)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := getUserVersion(tx, uuid, version)
+	if err != nil {
+		return err
+	}
+
+	// the credentials stay, logins only ever look at live users
+	old := user
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+	if err := saveUser(tx, user); err != nil {
+		return err
+	}
+	if err := recordChange(tx, record, old, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteRepo) ListDeletedUsers() ([]dto.ListUser, error) {
+	rows, err := s.db.Query(`SELECT id, username, email, admin, created_at, version, deleted_at FROM users
+		WHERE deleted_at IS NOT NULL ORDER BY deleted_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []dto.ListUser{}
+	for rows.Next() {
+		var (
+			user                 dto.ListUser
+			createdAt, deletedAt int64
+		)
+		if err := rows.Scan(&user.Id, &user.Username, &user.Email, &user.Admin, &createdAt, &user.Version, &deletedAt); err != nil {
+			return nil, err
+		}
+		user.CreatedAt = time.Unix(0, createdAt).UTC()
+		deleted := time.Unix(0, deletedAt).UTC()
+		user.DeletedAt = &deleted
+
+		res = append(res, user)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *SQLiteRepo) UndeleteUser(uuid string, ifMatch *uint64, record *audit.Entry) error {
+	defer s.reindex(uuid)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := getUser(tx, uuid)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && user.DeletedAt == nil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if ifMatch != nil && *ifMatch != user.Version {
+		return ErrVersionMismatch
+	}
+
+	old := user
+	user.DeletedAt = nil
+	if err := saveUser(tx, user); err != nil {
+		return err
+	}
+	if err := recordChange(tx, record, old, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDeleted removes the users put in the trash before the time for good,
+// their history is kept.
+func (s *SQLiteRepo) PurgeDeleted(before time.Time) (int, error) {
+	// credentials are removed by ON DELETE CASCADE
+	res, err := s.db.Exec(`DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLiteRepo) GetUserHistory(uuid string) ([]dto.UserVersion, error) {
+	rows, err := s.db.Query(`SELECT version, username, email, admin, created_at, changed_at, deleted FROM user_history WHERE user_id = ? ORDER BY version`, uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []dto.UserVersion{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return res, nil
+}
+
+func (s *SQLiteRepo) GetUserAsOf(uuid string, at time.Time) (dto.ListUser, error) {
+	row := s.db.QueryRow(`SELECT version, username, email, admin, created_at, changed_at, deleted FROM user_history
+		WHERE user_id = ? AND changed_at <= ? ORDER BY version DESC LIMIT 1`, uuid, at.UnixNano())
+
+	v, err := scanVersion(row)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && v.Deleted {
+		return dto.ListUser{}, ErrNotFound
+	}
+	if err != nil {
+		return dto.ListUser{}, err
+	}
+
+	return v.ListUser(uuid), nil
+}
+
+func (s *SQLiteRepo) RestoreUser(uuid string, version uint64, ifMatch *uint64, record *audit.Entry) error {
+	defer s.reindex(uuid)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := getUserVersion(tx, uuid, ifMatch)
+	if err != nil {
+		return err
+	}
+
+	row := tx.QueryRow(`SELECT version, username, email, admin, created_at, changed_at, deleted FROM user_history WHERE user_id = ? AND version = ?`, uuid, version)
+	v, err := scanVersion(row)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && v.Deleted {
+		return ErrVersionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	old := user
+	user.Username, user.Email, user.Admin = v.Username, v.Email, &v.Admin
+	if err := saveUser(tx, user); err != nil {
+		return err
+	}
+	if err := recordChange(tx, record, old, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getUserVersion reads a live user in tx, failing with ErrVersionMismatch
+// unless version is nil or the current one.
+func getUserVersion(tx *sql.Tx, uuid string, version *uint64) (entity.User, error) {
+	user, err := getUser(tx, uuid)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && user.DeletedAt != nil {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+	if version != nil && *version != user.Version {
+		return user, ErrVersionMismatch
+	}
+
+	return user, nil
+}
+
+// saveUser stores the changed user as its next version and records it in the
+// history. Setting DeletedAt moves the user to the trash, which releases its
+// identity keys.
+func saveUser(tx *sql.Tx, user entity.User) error {
+	user.Version++
+
+	var (
+		usernameKeyArg any = UsernameKey(user.Username)
+		emailKeyArg    any = emailKey(user.Email)
+		deletedAt      *int64
+		changedAt      = time.Now().UTC()
+	)
+	if user.DeletedAt != nil {
+		at := user.DeletedAt.UnixNano()
+		deletedAt, changedAt = &at, *user.DeletedAt
+		usernameKeyArg, emailKeyArg = nil, nil
+	}
+
+	_, err := tx.Exec(`UPDATE users SET username = ?, email = ?, admin = ?, username_key = ?, email_key = ?, version = ?, deleted_at = ? WHERE id = ?`,
+		user.Username, user.Email, *user.Admin, usernameKeyArg, emailKeyArg, user.Version, deletedAt, user.Id)
+	if err != nil {
+		return conflictError(tx, err, user.Id, user.Username)
+	}
+
+	_, err = tx.Exec(`UPDATE credentials SET password = ?, must_change_password = ? WHERE user_id = ?`, user.Password, user.MustChangePassword, user.Id)
+	if err != nil {
+		return err
+	}
+
+	return insertVersion(tx, user.Id, dto.ToUserVersion(user, changedAt, user.DeletedAt != nil))
+}
+
+func insertVersion(tx *sql.Tx, id string, v dto.UserVersion) error {
+	_, err := tx.Exec(`INSERT INTO user_history (user_id, version, username, email, admin, created_at, changed_at, deleted) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, v.Version, v.Username, v.Email, v.Admin, v.CreatedAt.UnixNano(), v.ChangedAt.UnixNano(), v.Deleted)
+	return err
+}
+
+func scanVersion(row interface{ Scan(dest ...any) error }) (dto.UserVersion, error) {
+	var (
+		v                    dto.UserVersion
+		createdAt, changedAt int64
+	)
+
+	err := row.Scan(&v.Version, &v.Username, &v.Email, &v.Admin, &createdAt, &changedAt, &v.Deleted)
+	v.CreatedAt = time.Unix(0, createdAt).UTC()
+	v.ChangedAt = time.Unix(0, changedAt).UTC()
+
+	return v, err
+}
+
+func (s *SQLiteRepo) SearchUsers(query string, limit int) ([]dto.ListUser, error) {
+	res := []dto.ListUser{}
+
+	for _, hit := range s.search.Search(query, limit) {
+		if user := s.GetUserById(hit.Id); user.Id != "" {
+			res = append(res, user)
+		}
+	}
+
+	return res, nil
+}
+
+// reindex brings the search index up to date with the stored profile. It's
+// serialized, so the last call always indexes the latest committed state.
+func (s *SQLiteRepo) reindex(uuid string) {
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+
+	var username, email string
+	err := s.db.QueryRow(`SELECT username, email FROM users WHERE id = ? AND deleted_at IS NULL`, uuid).Scan(&username, &email)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		s.search.Remove(uuid)
+	case err != nil:
+		slogger.Logger.Error("error while indexing user", "id", uuid, "err", err)
+	default:
+		s.search.Put(uuid, username, email)
+	}
+}
+
+func (s *SQLiteRepo) IfUserExist(uuid string) bool {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL)`, uuid).Scan(&exists)
+	if err != nil {
+		slogger.Logger.Error("error while checking user", "id", uuid, "err", err)
+	}
+	return exists
+}
+
+func (s *SQLiteRepo) GetUserById(uuid string) dto.ListUser {
+	var user dto.ListUser
+	var createdAt int64
+	err := s.db.QueryRow(`SELECT id, username, email, admin, created_at, version FROM users WHERE id = ? AND deleted_at IS NULL`, uuid).
+		Scan(&user.Id, &user.Username, &user.Email, &user.Admin, &createdAt, &user.Version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slogger.Logger.Error("error while getting user", "id", uuid, "err", err)
+	}
+	user.CreatedAt = time.Unix(0, createdAt).UTC()
+	return user
+}
+
+func (s *SQLiteRepo) GetUserByEmail(email string) (dto.ListUser, bool) {
+	var user dto.ListUser
+	var createdAt int64
+	err := s.db.QueryRow(`SELECT id, username, email, admin, created_at, version FROM users WHERE email_key = ? AND deleted_at IS NULL`, emailKey(email)).
+		Scan(&user.Id, &user.Username, &user.Email, &user.Admin, &createdAt, &user.Version)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slogger.Logger.Error("error while getting user", "email", email, "err", err)
+		}
+		return dto.ListUser{}, false
+	}
+	user.CreatedAt = time.Unix(0, createdAt).UTC()
+	return user, true
+}
+
+// GetCredentialsByUsername finds the credentials by the identity of the
+// username, so "Admin" logs in as "admin".
+func (s *SQLiteRepo) GetCredentialsByUsername(username string) (dto.AuthPermission, bool) {
+	var (
+		authCredentials dto.AuthPermission
+		admin           bool
+	)
+
+	err := s.db.QueryRow(`SELECT u.id, c.password, u.admin, c.must_change_password FROM credentials c JOIN users u ON u.id = c.user_id WHERE u.username_key = ? AND u.deleted_at IS NULL`, UsernameKey(username)).
+		Scan(&authCredentials.Id, &authCredentials.Password, &admin, &authCredentials.MustChangePassword)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slogger.Logger.Error("error while getting credentials", "username", username, "err", err)
+		}
+		return authCredentials, false
+	}
+	authCredentials.Admin = &admin
+
+	return authCredentials, true
+}
+
+func (s *SQLiteRepo) HasUsers() (bool, error) {
+	var found bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users)`).Scan(&found)
+	return found, err
+}
+
+// getUser reads the user in tx whether it's in the trash or not.
+func getUser(tx *sql.Tx, uuid string) (entity.User, error) {
+	var (
+		user      entity.User
+		admin     bool
+		deletedAt sql.NullInt64
+	)
+
+	err := tx.QueryRow(`SELECT u.id, u.username, u.email, u.admin, u.version, u.deleted_at, c.password, c.must_change_password FROM users u JOIN credentials c ON c.user_id = u.id WHERE u.id = ?`, uuid).
+		Scan(&user.Id, &user.Username, &user.Email, &admin, &user.Version, &deletedAt, &user.Password, &user.MustChangePassword)
+	user.Admin = &admin
+	if deletedAt.Valid {
+		at := time.Unix(0, deletedAt.Int64).UTC()
+		user.DeletedAt = &at
+	}
+
+	return user, err
+}
+
+// conflictError turns the violation of a unique index by the user with the
+// id into a ConflictError naming the field. Other errors are returned as is.
+// The error doesn't tell which index it is, so the username is looked up, the
+// statement alone being rolled back.
+func conflictError(q queryRower, err error, id, username string) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+
+	var taken bool
+	if err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username_key = ? AND id <> ?)`, UsernameKey(username), id).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return &ConflictError{Field: "username"}
+	}
+	return &ConflictError{Field: "email"}
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
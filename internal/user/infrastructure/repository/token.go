@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"users/internal/token"
+)
+
+func (u *UserRepo) RefreshTokens() token.RefreshStore {
+	return u.refresh
+}
+
+func (s *SQLiteRepo) RefreshTokens() token.RefreshStore {
+	return s.refresh
+}
+
+// sqliteRefreshStore keeps the refresh tokens in the refresh_tokens table.
+type sqliteRefreshStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteRefreshStore) Put(key string, t token.RefreshToken) error {
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (key, user_id, family, expires_at, used, second_factor) VALUES (?, ?, ?, ?, ?, ?)`,
+		key, t.UserId, t.Family, t.ExpiresAt.UnixNano(), t.Used, t.SecondFactor)
+	return err
+}
+
+func (s *sqliteRefreshStore) Use(key string) (token.RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return token.RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	var (
+		t         token.RefreshToken
+		expiresAt int64
+	)
+	err = tx.QueryRow(`SELECT user_id, family, expires_at, used, second_factor FROM refresh_tokens WHERE key = ?`, key).
+		Scan(&t.UserId, &t.Family, &expiresAt, &t.Used, &t.SecondFactor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return token.RefreshToken{}, token.ErrInvalidToken
+	}
+	if err != nil {
+		return token.RefreshToken{}, err
+	}
+	t.ExpiresAt = time.Unix(0, expiresAt).UTC()
+
+	// the token is used by whoever gets to flip the flag
+	res, err := tx.Exec(`UPDATE refresh_tokens SET used = 1 WHERE key = ? AND used = 0`, key)
+	if err != nil {
+		return token.RefreshToken{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return token.RefreshToken{}, err
+	} else if n == 0 {
+		t.Used = true
+	}
+
+	return t, tx.Commit()
+}
+
+func (s *sqliteRefreshStore) RevokeFamily(family string) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET used = 1 WHERE family = ?`, family)
+	return err
+}
+
+func (s *sqliteRefreshStore) RevokeUser(userId string) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET used = 1 WHERE user_id = ?`, userId)
+	return err
+}
+
+func (s *sqliteRefreshStore) RevokeAccess(userId string, notBefore, expiresAt time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO access_revocations (user_id, not_before, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET not_before = excluded.not_before, expires_at = excluded.expires_at`,
+		userId, notBefore.UnixNano(), expiresAt.UnixNano())
+	return err
+}
+
+func (s *sqliteRefreshStore) AccessNotBefore(userId string) (time.Time, error) {
+	var notBefore int64
+	err := s.db.QueryRow(`SELECT not_before FROM access_revocations WHERE user_id = ?`, userId).Scan(&notBefore)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, notBefore).UTC(), nil
+}
+
+// DeleteExpired removes the revocations past the access tokens they revoke
+// too.
+func (s *sqliteRefreshStore) DeleteExpired(now time.Time) (int, error) {
+	n := 0
+	for _, table := range []string{"refresh_tokens", "access_revocations"} {
+		res, err := s.db.Exec(`DELETE FROM `+table+` WHERE expires_at <= ?`, now.UnixNano())
+		if err != nil {
+			return n, err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return n, err
+		}
+		n += int(deleted)
+	}
+	return n, nil
+}
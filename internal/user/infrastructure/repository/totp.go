@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+	"users/internal/totp"
+)
+
+func (u *UserRepo) TwoFactor() totp.Store {
+	return u.totp
+}
+
+func (s *SQLiteRepo) TwoFactor() totp.Store {
+	return s.totp
+}
+
+// sqliteTOTPStore keeps the enrollments in the totp table.
+type sqliteTOTPStore struct {
+	db *sql.DB
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func getEnrollment(q queryRower, userId string) (totp.Enrollment, error) {
+	var (
+		e             totp.Enrollment
+		recoveryCodes string
+		createdAt     int64
+	)
+
+	err := q.QueryRow(`SELECT secret, confirmed, last_step, recovery_codes, created_at FROM totp WHERE user_id = ?`, userId).
+		Scan(&e.Secret, &e.Confirmed, &e.LastStep, &recoveryCodes, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return totp.Enrollment{}, totp.ErrNotEnrolled
+	}
+	if err != nil {
+		return totp.Enrollment{}, err
+	}
+	e.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	err = json.Unmarshal([]byte(recoveryCodes), &e.RecoveryCodes)
+	return e, err
+}
+
+func (s *sqliteTOTPStore) Get(userId string) (totp.Enrollment, error) {
+	return getEnrollment(s.db, userId)
+}
+
+func (s *sqliteTOTPStore) Put(userId string, e totp.Enrollment) error {
+	recoveryCodes, _ := json.Marshal(e.RecoveryCodes)
+
+	_, err := s.db.Exec(`INSERT INTO totp (user_id, secret, confirmed, last_step, recovery_codes, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, confirmed = excluded.confirmed, last_step = excluded.last_step,
+		recovery_codes = excluded.recovery_codes, created_at = excluded.created_at`,
+		userId, e.Secret, e.Confirmed, e.LastStep, string(recoveryCodes), e.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *sqliteTOTPStore) Update(userId string, fn func(e *totp.Enrollment) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e, err := getEnrollment(tx, userId)
+	if err != nil {
+		return err
+	}
+	if err := fn(&e); err != nil {
+		return err
+	}
+
+	recoveryCodes, _ := json.Marshal(e.RecoveryCodes)
+	_, err = tx.Exec(`UPDATE totp SET secret = ?, confirmed = ?, last_step = ?, recovery_codes = ? WHERE user_id = ?`,
+		e.Secret, e.Confirmed, e.LastStep, string(recoveryCodes), userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteTOTPStore) Delete(userId string) error {
+	_, err := s.db.Exec(`DELETE FROM totp WHERE user_id = ?`, userId)
+	return err
+}
@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"encoding/json"
+	"time"
+	"users/internal/audit"
+	storage "users/internal/db"
+	"users/internal/user/infrastructure/dto"
+	"users/pkg/purge"
+)
+
+// ListDeletedUsers lists the trash, the next to be purged first.
+func (u *UserRepo) ListDeletedUsers() ([]dto.ListUser, error) {
+	res := []dto.ListUser{}
+
+	err := u.userdb.ScanIndex("deleted_at", storage.IndexRange{}, func(_ storage.IndexPos, _ string, v []byte) bool {
+		var user dto.ListUser
+		json.Unmarshal(v, &user)
+		res = append(res, user)
+		return true
+	})
+
+	return res, err
+}
+
+// UndeleteUser fails with a ConflictError when the identity of the user was
+// taken while it was in the trash.
+func (u *UserRepo) UndeleteUser(uuid string, ifMatch *uint64, record *audit.Entry) error {
+	defer u.reindex(uuid)
+
+	return u.update(func(tx userTx) error {
+		user, ok := tx.readUser(uuid)
+		if !ok || user.DeletedAt == nil {
+			return ErrNotFound
+		}
+		if ifMatch != nil && *ifMatch != user.Version {
+			return ErrVersionMismatch
+		}
+
+		old := user
+		user.DeletedAt = nil
+		user.Version++
+
+		if err := tx.saveUser(old, user); err != nil {
+			return err
+		}
+		return tx.record(record, old, user)
+	})
+}
+
+// userData is a store keeping data of the users besides their profiles,
+// which goes with them when they are purged.
+type userData interface {
+	Store() storage.Store
+	UserKeys(userId string) []string
+}
+
+// PurgeDeleted removes the users put in the trash before the time for good,
+// along with their roles, second factor, API keys, sessions and tokens, as
+// the sqlite rows cascade. Their history is kept. It returns how many users
+// were removed.
+func (u *UserRepo) PurgeDeleted(before time.Time) (int, error) {
+	var ids []string
+
+	r := storage.IndexRange{To: timeTerm(before)}
+	err := u.userdb.ScanIndex("deleted_at", r, func(_ storage.IndexPos, id string, _ []byte) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// the stores can't be scanned inside the transaction, so the keys are
+	// collected first; a user in the trash can't get new ones meanwhile
+	data := []userData{u.roles, u.totp, u.keys, u.sessions, u.refresh, u.resets}
+	var stores []storage.Store
+	keys := make([]map[string][]string, len(data))
+	for i, d := range data {
+		stores = append(stores, d.Store())
+		keys[i] = make(map[string][]string)
+		for _, id := range ids {
+			keys[i][id] = d.UserKeys(id)
+		}
+	}
+
+	var purged int
+	err = u.updateWith(stores, func(tx userTx, txs []storage.Tx) error {
+		purged = 0
+
+		for _, id := range ids {
+			// the user may have been taken out of the trash since the scan
+			user, ok := tx.readUser(id)
+			if !ok || user.DeletedAt == nil || !user.DeletedAt.Before(before) {
+				continue
+			}
+
+			tx.users.Delete(id)
+			for i := range data {
+				for _, key := range keys[i][id] {
+					txs[i].Delete(key)
+				}
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// PurgeEvery starts a background loop that purges the users kept in the trash
+// for longer than retention, every interval. The returned func stops it.
+func PurgeEvery(repo UserRepository, retention, interval time.Duration) (stop func()) {
+	return purge.Every(interval, "deleted users", func(now time.Time) (int, error) {
+		return repo.PurgeDeleted(now.Add(-retention))
+	})
+}
@@ -0,0 +1,41 @@
+package purge
+
+import (
+	"time"
+	slogger "users/pkg/logger"
+)
+
+// Every starts a background loop that calls fn with the current time every
+// interval, fn removes what is stale at that time and returns how many
+// things it removed. name says what they are in the logs. The returned func
+// stops the loop and waits for a running fn to return.
+func Every(interval time.Duration, name string, fn func(now time.Time) (int, error)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n, err := fn(time.Now())
+				if err != nil {
+					slogger.Logger.Error("error while purging "+name, "err", err)
+				} else if n > 0 {
+					slogger.Logger.Info("purged "+name, "count", n)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,143 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"users/internal/apikey"
+	"users/internal/rbac"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func serveWithAPIKey(h http.Handler, method, target, key string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, strings.NewReader(string(body)))
+	req.Header.Set("X-API-Key", key)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func createAPIKey(h http.Handler, username, password string, req dto.CreateAPIKey) (*http.Response, dto.CreatedAPIKey) {
+	b, _ := json.Marshal(req)
+	res := serveAsUser(h, http.MethodPost, "/user/me/keys", username, password, b)
+
+	var created dto.CreatedAPIKey
+	if res.StatusCode == http.StatusCreated {
+		json.NewDecoder(res.Body).Decode(&created)
+	}
+	return res, created
+}
+
+func listAPIKeys(t *testing.T, h http.Handler, username, password string) []apikey.Key {
+	res := serveAsUser(h, http.MethodGet, "/user/me/keys", username, password, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	b, _ := io.ReadAll(res.Body)
+	assert.Equal(t, strings.Contains(string(b), "hash"), false)
+
+	var keys []apikey.Key
+	json.Unmarshal(b, &keys)
+	return keys
+}
+
+// testAPIKeys is the API key scenario, see forEachBackend.
+func testAPIKeys(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	_, created := createUser(h, User{Username: "ci", Email: "ci@mail.ru", Password: "password"})
+
+	// the scopes must be known permissions of the user
+	res, _ := createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{rbac.UsersWrite}})
+	assert.Equal(t, res.StatusCode, 403)
+	res, _ = createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{"users:fly"}})
+	assert.Equal(t, res.StatusCode, 400)
+	res, _ = createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci"})
+	assert.Equal(t, res.StatusCode, 400)
+	past := time.Now().Add(-time.Minute)
+	res, _ = createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{rbac.UsersRead}, ExpiresAt: &past})
+	assert.Equal(t, res.StatusCode, 400)
+	tooLate := time.Now().Add(100 * 365 * 24 * time.Hour)
+	res, _ = createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{rbac.UsersRead}, ExpiresAt: &tooLate})
+	assert.Equal(t, res.StatusCode, 400)
+
+	res, key := createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{rbac.UsersRead}})
+	assert.Equal(t, res.StatusCode, 201)
+	assert.Equal(t, res.Header.Get("Cache-Control"), "no-store")
+	assert.Equal(t, strings.HasPrefix(key.Value, apikey.Prefix), true)
+	assert.Equal(t, strings.HasPrefix(key.Value, key.Hint), true)
+	assert.Equal(t, key.UserId, created.Id)
+	assert.Equal(t, key.ExpiresAt.After(time.Now().Add(24*time.Hour)), true)
+
+	keys := listAPIKeys(t, h, "ci", "password")
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Id, key.Id)
+	assert.Equal(t, keys[0].LastUsedAt == nil, true)
+
+	// either header works, and the use is recorded
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", key.Value, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithToken(h, http.MethodGet, "/user/"+created.Id, key.Value, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.NotEqual(t, listAPIKeys(t, h, "ci", "password")[0].LastUsedAt, nil)
+
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", key.Value+"x", nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveWithToken(h, http.MethodGet, "/user/", apikey.Prefix+"unknown", nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// keys can't manage the account, keys included
+	res = serveWithAPIKey(h, http.MethodGet, "/user/me/keys", key.Value, nil)
+	assert.Equal(t, res.StatusCode, 403)
+
+	// a key is limited to its scopes, whatever the permissions of its user
+	res, adminKey := createAPIKey(h, "admin", "admin", dto.CreateAPIKey{Name: "reader", Scopes: []rbac.Permission{rbac.UsersRead}})
+	assert.Equal(t, res.StatusCode, 201)
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", adminKey.Value, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithAPIKey(h, http.MethodDelete, "/user/"+created.Id, adminKey.Value, nil)
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, errorMessage(res), "api key not scoped for users:delete")
+
+	// expired keys don't work
+	value, expired, err := apikey.NewManager(repo.APIKeys()).Create(apikey.Key{UserId: created.Id, Name: "old", Scopes: []rbac.Permission{rbac.UsersRead}, ExpiresAt: past}, past.Add(-time.Hour))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(listAPIKeys(t, h, "ci", "password")), 2)
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", value, nil)
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, repo.APIKeys().Delete(created.Id, expired.Id), nil)
+
+	// revoked keys neither, and only their user may revoke them
+	res = serveAsAdmin(h, http.MethodDelete, "/user/me/keys/"+key.Id, nil)
+	assert.Equal(t, res.StatusCode, 404)
+	res = serveAsUser(h, http.MethodDelete, "/user/me/keys/"+key.Id, "ci", "password", nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsUser(h, http.MethodDelete, "/user/me/keys/"+key.Id, "ci", "password", nil)
+	assert.Equal(t, res.StatusCode, 404)
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", key.Value, nil)
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, actions(listAudit(t, h, "target="+created.Id))[1:], []string{"apikey_create", "apikey_revoke"})
+
+	// nor those of deleted users
+	res = serveAsAdmin(h, http.MethodDelete, "/user/me/keys/"+adminKey.Id, nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res, key = createAPIKey(h, "ci", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{rbac.UsersRead}})
+	assert.Equal(t, res.StatusCode, 201)
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", key.Value, nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestAPIKeys(t *testing.T) {
+	forEachBackend(t, testAPIKeys)
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"users/internal/audit"
+	storage "users/internal/db"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func listAudit(t *testing.T, h http.Handler, query string) []audit.Entry {
+	res := serveAsAdmin(h, http.MethodGet, "/audit?"+query, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var entries []audit.Entry
+	json.NewDecoder(res.Body).Decode(&entries)
+	return entries
+}
+
+func actions(entries []audit.Entry) []string {
+	res := []string{}
+	for _, e := range entries {
+		res = append(res, e.Action)
+	}
+	return res
+}
+
+// testAudit is the audit scenario, tamper changes the stored entry with the
+// given seq behind the log's back, see backend.tamperAudit.
+func testAudit(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository, tamper func(seq uint64)) {
+	_, created := createUser(h, User{Username: "audited", Email: "audited@mail.ru", Password: "password"})
+
+	b, _ := json.Marshal(map[string]string{"username": "audited2", "password": "password2"})
+	res := serveAsAdmin(h, http.MethodPatch, "/user/"+created.Id, b)
+	assert.Equal(t, res.StatusCode, 204)
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	serveAsAdmin(h, http.MethodPost, "/user/"+created.Id+"/restore", nil)
+
+	// failed mutations aren't recorded
+	res = serveIfMatch(h, http.MethodDelete, "/user/"+created.Id, `"1"`, nil)
+	assert.Equal(t, res.StatusCode, 412)
+
+	entries := listAudit(t, h, "target="+created.Id)
+	assert.Equal(t, actions(entries), []string{"create", "update", "delete", "undelete"})
+
+	assert.Equal(t, entries[0].Actor, "admin")
+	assert.Equal(t, entries[0].IP, "192.0.2.1")
+	assert.Equal(t, entries[0].Changes["username"], audit.Change{To: "audited"})
+	assert.Equal(t, entries[0].Changes["password"], audit.Change{To: audit.Redacted})
+	assert.Equal(t, entries[1].Changes, map[string]audit.Change{
+		"username": {From: "audited", To: "audited2"},
+		"password": {From: audit.Redacted, To: audit.Redacted},
+	})
+	assert.Equal(t, entries[2].Changes["email"], audit.Change{From: "audited@mail.ru"})
+	for i := 1; i < len(entries); i++ {
+		assert.Equal(t, entries[i].Seq > entries[i-1].Seq, true)
+	}
+
+	assert.Equal(t, actions(listAudit(t, h, "action=update&target="+created.Id)), []string{"update"})
+	assert.Equal(t, len(listAudit(t, h, "actor=nobody")), 0)
+	assert.Equal(t, actions(listAudit(t, h, fmt.Sprintf("target=%s&after=%d&limit=2", created.Id, entries[1].Seq))),
+		[]string{"delete", "undelete"})
+
+	res = serveAsAdmin(h, http.MethodGet, "/audit?limit=0", nil)
+	assert.Equal(t, res.StatusCode, 400)
+	res = serveAsAdmin(h, http.MethodGet, "/audit?after=-1", nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	n, err := audit.Verify(repo.AuditLog())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n >= len(entries), true)
+
+	tamper(entries[1].Seq)
+
+	_, err = audit.Verify(repo.AuditLog())
+	var tampered *audit.TamperError
+	assert.Equal(t, errors.As(err, &tampered), true)
+	assert.Equal(t, tampered.Seq, entries[1].Seq)
+}
+
+func TestAudit(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			dir := t.TempDir()
+			h, repo := b.handler(t, dir)
+
+			testAudit(t, h, repo, func(seq uint64) { b.tamperAudit(t, repo, dir, seq) })
+		})
+	}
+}
+
+func TestAuditRemovedEntry(t *testing.T) {
+	auditdb := storage.NewInMemoryStorage()
+	log := audit.NewStoreLog(auditdb)
+	for _, action := range []string{"create", "update", "delete"} {
+		if _, err := log.Append(audit.Entry{Actor: "admin", Action: action}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	auditdb.Delete(fmt.Sprintf("%020d", 2))
+
+	_, err := audit.Verify(log)
+	var tampered *audit.TamperError
+	assert.Equal(t, errors.As(err, &tampered), true)
+	assert.Equal(t, tampered.Seq, uint64(3))
+}
+
+func TestSQLiteAuditSameTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	h, repo := newSQLiteHandler(t, path)
+	defer repo.Close()
+
+	_, created := createUser(h, User{Username: "unaudited", Email: "unaudited@mail.ru", Password: "password"})
+
+	// a change that can't be recorded isn't made
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`ALTER TABLE audit_log RENAME TO audit_log_gone`); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(map[string]string{"username": "unaudited2"})
+	res := serveAsAdmin(h, http.MethodPatch, "/user/"+created.Id, b)
+	assert.Equal(t, res.StatusCode, 500)
+	res = serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	assert.Equal(t, res.StatusCode, 500)
+	assert.Equal(t, repo.GetUserById(created.Id).Username, "unaudited")
+}
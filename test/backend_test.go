@@ -0,0 +1,93 @@
+package test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"users/internal/audit"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/repository"
+)
+
+// backend is a storage engine the scenarios run against.
+type backend struct {
+	name string
+	// open returns a fresh, empty repository of the backend in dir, closed
+	// when the test ends.
+	open func(t *testing.T, dir string) repository.UserRepository
+	// tamperAudit changes the stored audit entry with the seq behind the back
+	// of the log of the repository open returned for dir.
+	tamperAudit func(t *testing.T, repo repository.UserRepository, dir string, seq uint64)
+}
+
+// backends are the storage engines every scenario runs against.
+var backends = []backend{
+	{
+		name: "memory",
+		open: func(t *testing.T, _ string) repository.UserRepository {
+			return newMemoryRepository()
+		},
+		tamperAudit: func(t *testing.T, repo repository.UserRepository, _ string, seq uint64) {
+			auditdb := repo.AuditLog().(*audit.StoreLog).Store()
+			key := fmt.Sprintf("%020d", seq)
+			v, _ := auditdb.Get(key)
+
+			var e audit.Entry
+			json.Unmarshal(v, &e)
+			e.Actor = "somebody"
+			v, _ = json.Marshal(e)
+			auditdb.Set(key, v)
+		},
+	},
+	{
+		name: "sqlite",
+		open: func(t *testing.T, dir string) repository.UserRepository {
+			repo, err := repository.NewSQLiteRepository(filepath.Join(dir, "users.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { repo.Close() })
+			return repo
+		},
+		tamperAudit: func(t *testing.T, _ repository.UserRepository, dir string, seq uint64) {
+			db, err := sql.Open("sqlite", filepath.Join(dir, "users.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if _, err := db.Exec(`UPDATE audit_log SET changes = '{}' WHERE seq = ?`, seq); err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+}
+
+func newMemoryRepository() repository.UserRepository {
+	return repository.NewBannerRepository(repository.NewMemoryStores(nil))
+}
+
+// handler returns a handler over a fresh repository of the backend in dir,
+// with the bootstrap users.
+func (b backend) handler(t *testing.T, dir string) (*delivery.UserHandler, repository.UserRepository) {
+	repo := b.open(t, dir)
+	if err := delivery.Bootstrap(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	return delivery.NewUserHandler(repo), repo
+}
+
+// forEachBackend runs the scenario as a subtest of every backend, against a
+// handler over a fresh repository with the bootstrap users.
+func forEachBackend(t *testing.T, scenario func(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository)) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			h, repo := b.handler(t, t.TempDir())
+			scenario(t, h, repo)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"users/config"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// testBootstrap is the bootstrap scenario, against an empty repository.
+func testBootstrap(t *testing.T, repo repository.UserRepository) {
+	saved := config.Cfg.Bootstrap
+	defer func() { config.Cfg.Bootstrap = saved }()
+
+	// weak passwords are refused outside dev mode, and nothing is created
+	config.Cfg.Bootstrap.DevMode = false
+	config.Cfg.Bootstrap.Users = []config.BootstrapUser{
+		{Username: "ci", Email: "ci@mail.ru", Password: "a long enough password"},
+		{Username: "root", Email: "root@mail.ru", Password: "root", Admin: true},
+	}
+	assert.NotEqual(t, delivery.Bootstrap(repo), nil)
+	found, err := repo.HasUsers()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, found, false)
+
+	secret := filepath.Join(t.TempDir(), "root-password")
+	os.WriteFile(secret, []byte("correct horse battery staple\n"), 0o600)
+	t.Setenv("TEST_CI_PASSWORD", "ci password from the env")
+	config.Cfg.Bootstrap.Users = []config.BootstrapUser{
+		{Username: "root", Email: "root@mail.ru", PasswordFile: secret, Admin: true, MustChangePassword: true},
+		{Username: "ci", Email: "ci@mail.ru", Password: "root", PasswordEnv: "TEST_CI_PASSWORD"},
+	}
+	assert.Equal(t, delivery.Bootstrap(repo), nil)
+
+	// only an empty store is seeded
+	config.Cfg.Bootstrap.Users = []config.BootstrapUser{{Username: "other", Email: "other@mail.ru", Password: "another password"}}
+	assert.Equal(t, delivery.Bootstrap(repo), nil)
+	_, ok := repo.GetCredentialsByUsername("other")
+	assert.Equal(t, ok, false)
+
+	h := delivery.NewUserHandler(repo)
+
+	res := serveAsUser(h, http.MethodGet, "/user/", "ci", "ci password from the env", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	// the temporary password only gives access to /user/me
+	res = serveAsUser(h, http.MethodGet, "/user/", "root", "correct horse battery staple", nil)
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, errorMessage(res), "password change required")
+	session := sessionCookie(login(h, "root", "correct horse battery staple"))
+	res = serveWithCookies(h, http.MethodGet, "/user/", nil, session)
+	assert.Equal(t, res.StatusCode, 403)
+	res = serveWithCookies(h, http.MethodGet, "/user/me", nil, session)
+	assert.Equal(t, res.StatusCode, 200)
+
+	b, _ := json.Marshal(dto.ChangePassword{CurrentPassword: "correct horse battery staple", NewPassword: "a brand new password"})
+	res = serveWithCookies(h, http.MethodPost, "/user/me/password", b, session)
+	assert.Equal(t, res.StatusCode, 204)
+
+	res = serveAsUser(h, http.MethodGet, "/user/", "root", "a brand new password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	credentials, _ := repo.GetCredentialsByUsername("root")
+	assert.Equal(t, credentials.MustChangePassword, false)
+	assert.Equal(t, *credentials.Admin, true)
+
+	// a password an admin sets for someone else stays temporary once it is
+	ci, _ := repo.GetCredentialsByUsername("ci")
+	temporary := true
+	b, _ = json.Marshal(dto.UpdateUser{Password: "reset by root", MustChangePassword: &temporary})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+ci.Id, "root", "a brand new password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	b, _ = json.Marshal(dto.UpdateUser{Password: "reset again by root"})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+ci.Id, "root", "a brand new password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsUser(h, http.MethodGet, "/user/", "ci", "reset again by root", nil)
+	assert.Equal(t, res.StatusCode, 403)
+
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "reset again by root", NewPassword: "chosen by ci"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/password", "ci", "reset again by root", b)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsUser(h, http.MethodGet, "/user/", "ci", "chosen by ci", nil)
+	assert.Equal(t, res.StatusCode, 200)
+}
+
+// TestShippedBootstrap checks the config in the repo doesn't seed a known
+// password, the tests turn dev mode on themselves in setup.
+func TestShippedBootstrap(t *testing.T) {
+	var cfg config.AppConfig
+	if err := cleanenv.ReadConfig("../config/config.yaml", &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, cfg.Bootstrap.DevMode, false)
+	for _, user := range cfg.Bootstrap.Users {
+		assert.Equal(t, user.Password, "")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	// forEachBackend would bootstrap the repositories already
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			testBootstrap(t, b.open(t, t.TempDir()))
+		})
+	}
+}
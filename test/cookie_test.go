@@ -0,0 +1,128 @@
+package test
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/cookies"
+	delivery "users/internal/user/infrastructure/delivery/http"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestEncryptedCookieRotation(t *testing.T) {
+	oldKey, newKey := strings.Repeat("ab", 32), strings.Repeat("cd", 16)
+
+	write := func(keyring *cookies.Keyring, name, value string) *http.Cookie {
+		w := httptest.NewRecorder()
+		cookie := http.Cookie{Name: name, Value: value}
+		err := cookies.WriteEncrypted(w, httptest.NewRequest(http.MethodGet, "/", nil), &cookie, keyring)
+		assert.Equal(t, err, nil)
+		return w.Result().Cookies()[0]
+	}
+	read := func(keyring *cookies.Keyring, name string, c *http.Cookie) (string, error) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(c)
+		return cookies.ReadEncrypted(req, name, keyring)
+	}
+
+	before, err := cookies.NewKeyring("k1", map[string]string{"k1": oldKey})
+	assert.Equal(t, err, nil)
+	cookie := write(before, "Session", "secret value")
+	assert.Equal(t, strings.Contains(cookie.Value, "secret"), false)
+
+	value, err := read(before, "Session", cookie)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "secret value")
+
+	// the cookie is bound to its name
+	renamed := *cookie
+	renamed.Name = "Other"
+	_, err = read(before, "Other", &renamed)
+	assert.Equal(t, err, cookies.ErrInvalidValue)
+
+	// after the rotation the old key still decrypts, the new one encrypts
+	during, err := cookies.NewKeyring("k2", map[string]string{"k1": oldKey, "k2": newKey})
+	assert.Equal(t, err, nil)
+	value, err = read(during, "Session", cookie)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "secret value")
+
+	rotated := write(during, "Session", "secret value")
+	_, err = read(before, "Session", rotated)
+	assert.Equal(t, err, cookies.ErrInvalidValue)
+
+	after, _ := cookies.NewKeyring("k2", map[string]string{"k2": newKey})
+	_, err = read(after, "Session", cookie)
+	assert.Equal(t, err, cookies.ErrInvalidValue)
+	value, err = read(after, "Session", rotated)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "secret value")
+
+	_, err = cookies.NewKeyring("k3", map[string]string{"k1": oldKey})
+	assert.NotEqual(t, err, nil)
+	_, err = cookies.NewKeyring("k1", map[string]string{"k1": "abcd"})
+	assert.NotEqual(t, err, nil)
+}
+
+// Sessions survive a key rotation as long as the old key is kept. The keys
+// are read once, each handler stands for a restart with the new config.
+func TestSessionKeyRotation(t *testing.T) {
+	saved := config.Cfg.Cookie
+	defer func() { config.Cfg.Cookie = saved }()
+
+	config.Cfg.Cookie.Primary = "old"
+	config.Cfg.Cookie.Keys = map[string]string{"old": strings.Repeat("ab", 32)}
+	adminSession := sessionCookie(login(delivery.NewUserHandler(repo), "admin", "admin"))
+
+	config.Cfg.Cookie.Primary = "new"
+	config.Cfg.Cookie.Keys = map[string]string{"old": strings.Repeat("ab", 32), "new": strings.Repeat("cd", 32)}
+	res := serveWithCookies(delivery.NewUserHandler(repo), http.MethodGet, "/audit", nil, adminSession)
+	assert.Equal(t, res.StatusCode, 200)
+
+	config.Cfg.Cookie.Keys = map[string]string{"new": strings.Repeat("cd", 32)}
+	res = serveWithCookies(delivery.NewUserHandler(repo), http.MethodGet, "/user/", nil, adminSession)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// the config isn't read again by a running handler
+	res = serveWithCookies(&handler, http.MethodGet, "/user/", nil, sessionCookie(login(&handler, "admin", "admin")))
+	assert.Equal(t, res.StatusCode, 200)
+
+	// cookies signed before the encryption are still accepted
+	id, _, err := handler.Sessions.Start(adminId(t), false, time.Now())
+	assert.Equal(t, err, nil)
+	w := httptest.NewRecorder()
+	legacy := http.Cookie{Name: "Session", Value: id}
+	cookies.WriteSigned(w, httptest.NewRequest(http.MethodGet, "/", nil), &legacy, secretKey(t))
+	res = serveWithCookies(&handler, http.MethodGet, "/user/", nil, w.Result().Cookies())
+	assert.Equal(t, res.StatusCode, 200)
+}
+
+// The config ships no cookie keys, only dev mode runs without them.
+func TestCookieKeysRequired(t *testing.T) {
+	cfg := config.Cfg
+	assert.Equal(t, cfg.Validate(), nil)
+
+	cfg.Cookie.Keys = nil
+	cfg.Bootstrap.DevMode = false
+	assert.NotEqual(t, cfg.Validate(), nil)
+	cfg.Bootstrap.DevMode = true
+	assert.Equal(t, cfg.Validate(), nil)
+}
+
+func adminId(t *testing.T) string {
+	credentials, ok := repo.GetCredentialsByUsername("admin")
+	assert.Equal(t, ok, true)
+	return credentials.Id
+}
+
+func secretKey(t *testing.T) []byte {
+	key, err := hex.DecodeString(config.Cfg.Token.Secret)
+	assert.Equal(t, err, nil)
+	return key
+}
@@ -8,13 +8,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"users/config"
 
 	"github.com/brianvoe/gofakeit/v7"
 
-	storage "users/internal/db"
-
 	delivery "users/internal/user/infrastructure/delivery/http"
 	"users/internal/user/infrastructure/dto"
 	"users/internal/user/infrastructure/repository"
@@ -26,8 +26,6 @@ import (
 
 var (
 	loginAdmin  string
-	userdb      storage.InMemoryStorage
-	authdb      storage.InMemoryStorage
 	handler     delivery.UserHandler
 	repo        repository.UserRepository
 	admin       Admin
@@ -64,13 +62,27 @@ func TestMain(m *testing.M) {
 }
 
 func setup() {
+	// the config ships no cookie keys, see TestCookieKeysRequired
+	os.Setenv("COOKIE_PRIMARY_KEY", "k1")
+	os.Setenv("COOKIE_KEYS", "k1:"+strings.Repeat("9f", 32))
 	config.LoadConfig()
+	// every request hashes the password, keep it cheap
+	config.Cfg.Password.Argon2.Time, config.Cfg.Password.Argon2.Memory = 1, 1024
+	// the test users have simple passwords, see TestPasswordRules for the rules
+	config.Cfg.Password.MinLength, config.Cfg.Password.MinClasses, config.Cfg.Password.MinEntropy = 0, 0, 0
+	config.Cfg.Password.ForbidPersonal, config.Cfg.Password.Blocklist = false, ""
+	// the test requests all come from the same address, see TestLockout
+	config.Cfg.Lockout.IPThreshold = 0
+	config.Cfg.PasswordReset.IPLimit = 0
+	// the tests log in as admin:admin, which only dev mode accepts
+	config.Cfg.Bootstrap.DevMode = true
+	os.Setenv("BOOTSTRAP_ADMIN_PASSWORD", "admin")
 	slogger.Logger = slogger.GetLogger()
 	loginAdmin = base64.StdEncoding.EncodeToString([]byte("admin:admin"))
-	userdb, authdb = storage.InMemoryStorage{Storage: make(map[string][]byte)}, storage.InMemoryStorage{Storage: make(map[string][]byte)}
-
-	repo = repository.NewBannerRepository(&userdb, &authdb)
-	repo.CreateAdmin()
+	repo = repository.NewBannerRepository(repository.NewMemoryStores(nil))
+	if err := delivery.Bootstrap(repo); err != nil {
+		panic(err)
+	}
 	handler = *delivery.NewUserHandler(repo)
 
 	admin = Admin{
@@ -94,7 +106,7 @@ func setup() {
 }
 
 func tearDown(id string) {
-	handler.Store.DeleteUser(id)
+	handler.Store.DeleteUser(id, nil, nil)
 }
 
 func CreateUser(data []byte) *http.Response {
@@ -183,6 +195,7 @@ func TestUpdateCreatedUser(t *testing.T) {
 	var user dto.ListUser
 	json.NewDecoder(res.Body).Decode(&user)
 	assert.Equal(t, user.Username, updatedUser.Username)
+	assert.Equal(t, user.CreatedAt.IsZero(), false)
 
 }
 
@@ -237,3 +250,116 @@ func BenchmarkGetUsers(b *testing.B) {
 		}
 	})
 }
+
+func TestConcurrentCreateSameUsername(t *testing.T) {
+	b, _ := json.Marshal(user)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := CreateUser(b)
+			if res.StatusCode == 201 {
+				json.NewDecoder(res.Body).Decode(&userid)
+			}
+			codes <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == 201 {
+			created++
+		}
+	}
+	assert.Equal(t, created, 1)
+
+	tearDown(userid.Id)
+}
+
+func TestLoginWithUpdatedPassword(t *testing.T) {
+	b, _ := json.Marshal(user)
+	res := CreateUser(b)
+	json.NewDecoder(res.Body).Decode(&userid)
+
+	b, _ = json.Marshal(dto.UpdateUser{Password: "brandnew"})
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/user/%s", userid.Id), bytes.NewBuffer(b))
+	req.SetBasicAuth("admin", "admin")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, w.Result().StatusCode, 204)
+
+	req = httptest.NewRequest(http.MethodGet, "/user/", nil)
+	req.SetBasicAuth(user.Username, "brandnew")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, w.Result().StatusCode, 200)
+
+	tearDown(userid.Id)
+}
+
+func TestListUsersWithCursor(t *testing.T) {
+	var ids []string
+	for i := 0; i < 5; i++ {
+		u := user
+		u.Username = fmt.Sprintf("paged-%d", i)
+		u.Email = fmt.Sprintf("paged-%d@world.ru", i)
+
+		b, _ := json.Marshal(u)
+		res := CreateUser(b)
+		json.NewDecoder(res.Body).Decode(&userid)
+		ids = append(ids, userid.Id)
+	}
+
+	var listed []string
+	cursor := ""
+	for {
+		req := httptest.NewRequest(http.MethodGet, "/user/?limit=2&cursor="+cursor, nil)
+		req.SetBasicAuth("admin", "admin")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, w.Result().StatusCode, 200)
+
+		// a plain array by default, the cursor comes in a header
+		var users []dto.ListUser
+		json.NewDecoder(w.Result().Body).Decode(&users)
+		for _, u := range users {
+			listed = append(listed, u.Id)
+		}
+
+		cursor = w.Result().Header.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+	}
+
+	// the admin goes first, then the users in creation order
+	assert.Equal(t, listed[len(listed)-5:], ids)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/?limit=2&envelope=true", nil)
+	req.SetBasicAuth("admin", "admin")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var page dto.UserPage
+	json.NewDecoder(w.Result().Body).Decode(&page)
+	assert.Equal(t, len(page.Users), 2)
+	assert.Equal(t, page.NextCursor, w.Result().Header.Get("X-Next-Cursor"))
+
+	req = httptest.NewRequest(http.MethodGet, "/user/?cursor=garbage", nil)
+	req.SetBasicAuth("admin", "admin")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, w.Result().StatusCode, 400)
+
+	for _, id := range ids {
+		tearDown(id)
+	}
+}
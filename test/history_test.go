@@ -0,0 +1,92 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func userHistory(t *testing.T, h http.Handler, id string) []dto.UserVersion {
+	res := serveAsAdmin(h, http.MethodGet, "/user/"+id+"/history", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var history []dto.UserVersion
+	json.NewDecoder(res.Body).Decode(&history)
+	return history
+}
+
+func getUserAsOf(h http.Handler, id string, at time.Time) (*http.Response, dto.ListUser) {
+	res := serveAsAdmin(h, http.MethodGet, "/user/"+id+"?as_of="+url.QueryEscape(at.Format(time.RFC3339Nano)), nil)
+
+	var user dto.ListUser
+	json.NewDecoder(res.Body).Decode(&user)
+	return res, user
+}
+
+// testHistory is the history scenario, see forEachBackend.
+func testHistory(t *testing.T, h *delivery.UserHandler, _ repository.UserRepository) {
+	_, created := createUser(h, User{Username: "historic", Email: "v1@mail.ru", Password: "password"})
+	afterCreate := time.Now()
+
+	b, _ := json.Marshal(UpdatedUser{Email: "v2@mail.ru"})
+	serveAsAdmin(h, http.MethodPatch, "/user/"+created.Id, b)
+	afterUpdate := time.Now()
+
+	history := userHistory(t, h, created.Id)
+	assert.Equal(t, len(history), 2)
+	assert.Equal(t, history[0].Version, uint64(1))
+	assert.Equal(t, history[0].Email, "v1@mail.ru")
+	assert.Equal(t, history[1].Email, "v2@mail.ru")
+
+	res, user := getUserAsOf(h, created.Id, afterCreate)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, user.Email, "v1@mail.ru")
+	assert.Equal(t, user.Version, uint64(1))
+
+	res, _ = getUserAsOf(h, created.Id, afterCreate.Add(-time.Hour))
+	assert.Equal(t, res.StatusCode, 404)
+
+	res = serveAsAdmin(h, http.MethodGet, "/user/"+created.Id+"?as_of=yesterday", nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	// restoring makes a new version out of the old one
+	res = serveAsAdmin(h, http.MethodPost, "/user/"+created.Id+"/restore", []byte(`{"version": 1}`))
+	assert.Equal(t, res.StatusCode, 204)
+
+	res = serveAsAdmin(h, http.MethodGet, "/user/"+created.Id, nil)
+	assert.Equal(t, res.Header.Get("ETag"), `"3"`)
+	json.NewDecoder(res.Body).Decode(&user)
+	assert.Equal(t, user.Email, "v1@mail.ru")
+
+	res = serveAsAdmin(h, http.MethodPost, "/user/"+created.Id+"/restore", []byte(`{"version": 7}`))
+	assert.Equal(t, res.StatusCode, 404)
+
+	res = serveIfMatch(h, http.MethodPost, "/user/"+created.Id+"/restore", `"2"`, []byte(`{"version": 2}`))
+	assert.Equal(t, res.StatusCode, 412)
+
+	// the history outlives the user
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+
+	history = userHistory(t, h, created.Id)
+	assert.Equal(t, len(history), 4)
+	assert.Equal(t, history[3].Deleted, true)
+
+	res, user = getUserAsOf(h, created.Id, afterUpdate)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, user.Email, "v2@mail.ru")
+
+	res, _ = getUserAsOf(h, created.Id, time.Now())
+	assert.Equal(t, res.StatusCode, 404)
+}
+
+func TestUserHistory(t *testing.T) {
+	forEachBackend(t, testHistory)
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func createUser(h http.Handler, u User) (*http.Response, dto.UserId) {
+	b, _ := json.Marshal(u)
+	res := serveAsAdmin(h, http.MethodPost, "/user/", b)
+
+	var created dto.UserId
+	if res.StatusCode == http.StatusCreated {
+		json.NewDecoder(res.Body).Decode(&created)
+	}
+	return res, created
+}
+
+// conflictMessage is the message of a 409 response, "" for any other status,
+// see errorMessage for the other errors.
+func conflictMessage(res *http.Response) string {
+	if res.StatusCode != http.StatusConflict {
+		return ""
+	}
+	return errorMessage(res)
+}
+
+// errorMessage is the message of an error response.
+func errorMessage(res *http.Response) string {
+	var body dto.ErrorResponse
+	json.NewDecoder(res.Body).Decode(&body)
+	return body.Message
+}
+
+// testIdentity is the identity scenario, see forEachBackend.
+func testIdentity(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	res, jose := createUser(h, User{Username: "José", Email: "Jose@Mail.ru", Password: "password"})
+	assert.Equal(t, res.StatusCode, 201)
+
+	// decomposed "é" in another case
+	res, _ = createUser(h, User{Username: "JOSE\u0301", Email: "other@mail.ru", Password: "password"})
+	assert.Equal(t, res.StatusCode, 409)
+	assert.Equal(t, conflictMessage(res), "username already exists")
+
+	res, _ = createUser(h, User{Username: "pepe", Email: "jose@MAIL.RU", Password: "password"})
+	assert.Equal(t, res.StatusCode, 409)
+	assert.Equal(t, conflictMessage(res), "email already exists")
+
+	_, ok := repo.GetCredentialsByUsername("josé")
+	assert.Equal(t, ok, true)
+
+	res, pepe := createUser(h, User{Username: "pepe", Email: "pepe@mail.ru", Password: "password"})
+	assert.Equal(t, res.StatusCode, 201)
+
+	// changing only the case of one's own username is fine
+	b, _ := json.Marshal(UpdatedUser{Username: "PEPE"})
+	res = serveAsAdmin(h, http.MethodPatch, "/user/"+pepe.Id, b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	b, _ = json.Marshal(UpdatedUser{Email: "JOSE@mail.ru"})
+	res = serveAsAdmin(h, http.MethodPatch, "/user/"+pepe.Id, b)
+	assert.Equal(t, res.StatusCode, 409)
+	assert.Equal(t, conflictMessage(res), "email already exists")
+
+	// a deleted user frees its identity
+	res = serveAsAdmin(h, http.MethodDelete, "/user/"+jose.Id, nil)
+	assert.Equal(t, res.StatusCode, 204)
+
+	b, _ = json.Marshal(UpdatedUser{Username: "josé", Email: "jose@mail.ru"})
+	res = serveAsAdmin(h, http.MethodPatch, "/user/"+pepe.Id, b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+pepe.Id, nil)
+}
+
+func TestUserIdentity(t *testing.T) {
+	forEachBackend(t, testIdentity)
+}
+
+func TestSQLiteIdentityCollision(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	repo, err := repository.NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	// users stored before the identities were normalized
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO users (id, username, email, created_at) VALUES
+		('11111111-1111-4111-8111-111111111111', 'Pepe', 'pepe@mail.ru', 1),
+		('22222222-2222-4222-8222-222222222222', 'pepe', 'other@mail.ru', 2)`)
+	assert.Equal(t, err, nil)
+	db.Close()
+
+	// they can't be told apart at login, so the startup fails
+	_, err = repository.NewSQLiteRepository(path)
+	assert.Equal(t, errors.Is(err, repository.ErrIdentityCollision), true)
+	assert.Equal(t, strings.Contains(err.Error(), "(username)"), true)
+}
@@ -0,0 +1,246 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/lockout"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestLockoutBackoff(t *testing.T) {
+	g := lockout.NewGuard(lockout.Policy{Threshold: 3, IPThreshold: 5, BaseDelay: time.Minute, MaxDelay: 5 * time.Minute, Window: 15 * time.Minute})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, g.Fail("Alice", "10.0.0.1", now), time.Duration(0))
+	assert.Equal(t, g.Fail("alice", "10.0.0.1", now), time.Duration(0))
+	assert.Equal(t, g.Locked("alice", "10.0.0.2", now), time.Duration(0))
+	assert.Equal(t, g.Fail("alice", "10.0.0.1", now), time.Minute)
+	assert.Equal(t, g.Locked("ALICE", "10.0.0.2", now.Add(20*time.Second)), 40*time.Second)
+
+	// every failure past the lockout doubles it, up to the max
+	now = now.Add(time.Minute)
+	assert.Equal(t, g.Locked("alice", "10.0.0.2", now), time.Duration(0))
+	assert.Equal(t, g.Fail("alice", "10.0.0.2", now), 2*time.Minute)
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, g.Fail("alice", "10.0.0.2", now), 4*time.Minute)
+	now = now.Add(4 * time.Minute)
+	assert.Equal(t, g.Fail("alice", "10.0.0.2", now), 5*time.Minute)
+
+	// the IP is locked out whatever the username
+	assert.Equal(t, g.Fail("bob", "10.0.0.1", now), time.Duration(0))
+	assert.Equal(t, g.Fail("carol", "10.0.0.1", now), time.Minute)
+	assert.Equal(t, g.Locked("dave", "10.0.0.1", now), time.Minute)
+
+	// a success forgets the username, not the IP
+	g.Succeed("bob")
+	lockouts := g.List(now)
+	assert.Equal(t, len(lockouts), 4)
+	assert.Equal(t, lockouts[0].Key, "ip:10.0.0.1")
+	assert.Equal(t, lockouts[0].Failures, 5)
+	assert.NotEqual(t, lockouts[0].LockedUntil, nil)
+	assert.Equal(t, lockouts[1].Key, "ip:10.0.0.2")
+	assert.Equal(t, lockouts[1].LockedUntil, (*time.Time)(nil))
+	assert.Equal(t, lockouts[2].Key, "user:alice")
+	assert.Equal(t, lockouts[3].Key, "user:carol")
+
+	// failures are forgotten a window after the last one
+	assert.Equal(t, g.Purge(now.Add(14*time.Minute)), 0)
+	assert.Equal(t, g.Purge(now.Add(15*time.Minute)), 4)
+	assert.Equal(t, len(g.List(now.Add(15*time.Minute))), 0)
+
+	assert.Equal(t, g.Fail("alice", "10.0.0.1", now.Add(16*time.Minute)), time.Duration(0))
+	assert.Equal(t, g.Clear("user:alice"), true)
+	assert.Equal(t, g.Clear("user:alice"), false)
+
+	off := lockout.NewGuard(lockout.Policy{})
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, off.Fail("alice", "10.0.0.1", now), time.Duration(0))
+	}
+}
+
+// The spellings a login accepts for an account share its failures, not only
+// the ones differing in case.
+func TestLockoutSpellings(t *testing.T) {
+	_, created := createUser(&handler, User{Username: "José", Email: "jose@mail.ru", Password: "password"})
+	defer tearDown(created.Id)
+	defer handler.Lockouts.Succeed("José")
+
+	// the decomposed é, then the upper case of the composed one
+	spellings := []string{"Jose\u0301", "JOSÉ"}
+	for i := range config.Cfg.Lockout.Threshold - 1 {
+		res := login(&handler, spellings[i%2], "wrong")
+		assert.Equal(t, res.StatusCode, 401)
+	}
+	res := login(&handler, spellings[1], "wrong")
+	assert.Equal(t, res.StatusCode, 429)
+	res = login(&handler, spellings[0], "password")
+	assert.Equal(t, res.StatusCode, 429)
+}
+
+func TestLockoutAttempts(t *testing.T) {
+	g := lockout.NewGuard(lockout.Policy{Threshold: 3, IPThreshold: 5, BaseDelay: time.Minute, MaxDelay: 5 * time.Minute, Window: 15 * time.Minute})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// attempts still running count as failures, so parallel guesses stop at
+	// the threshold
+	var attempts []*lockout.Attempt
+	for i := 0; i < 3; i++ {
+		a, retryAfter := g.Begin("alice", "10.0.0.1", now)
+		assert.Equal(t, retryAfter, time.Duration(0))
+		attempts = append(attempts, a)
+	}
+	a, retryAfter := g.Begin("alice", "10.0.0.2", now)
+	assert.Equal(t, a, (*lockout.Attempt)(nil))
+	assert.Equal(t, retryAfter, time.Minute)
+
+	assert.Equal(t, attempts[0].Fail(), time.Duration(0))
+	assert.Equal(t, attempts[2].Fail(), time.Minute)
+
+	// taking an attempt back undoes the lockout it started
+	attempts[1].Release()
+	attempts[1].Release()
+	assert.Equal(t, g.Locked("alice", "10.0.0.2", now), time.Duration(0))
+	lockouts := g.List(now)
+	assert.Equal(t, lockouts[1].Key, "user:alice")
+	assert.Equal(t, lockouts[1].Failures, 2)
+
+	// a success forgets the username, the IP keeps the other failures
+	a, _ = g.Begin("alice", "10.0.0.1", now)
+	a.Succeed()
+	a.Release()
+	lockouts = g.List(now)
+	assert.Equal(t, len(lockouts), 1)
+	assert.Equal(t, lockouts[0].Key, "ip:10.0.0.1")
+	assert.Equal(t, lockouts[0].Failures, 2)
+}
+
+func TestParallelLockout(t *testing.T) {
+	saved := handler.Lockouts
+	defer func() { handler.Lockouts = saved }()
+	handler.Lockouts = lockout.NewGuard(lockout.Policy{Threshold: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 15 * time.Minute})
+
+	_, created := createUser(&handler, User{Username: "guessed", Email: "guessed@mail.ru", Password: "password"})
+
+	statuses := make(chan int)
+	for i := 0; i < 20; i++ {
+		go func() {
+			statuses <- serveAsUser(&handler, http.MethodGet, "/user/me", "guessed", "wrong", nil).StatusCode
+		}()
+	}
+	counts := map[int]int{}
+	for i := 0; i < 20; i++ {
+		counts[<-statuses]++
+	}
+	assert.Equal(t, counts, map[int]int{401: 4, 429: 16})
+
+	handler.Lockouts = saved
+	serveAsAdmin(&handler, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func serveFrom(h http.Handler, remoteAddr, method, target, username, password string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	req.RemoteAddr = remoteAddr
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func listLockouts(t *testing.T, h http.Handler) []lockout.Lockout {
+	res := serveAsAdmin(h, http.MethodGet, "/auth/lockouts", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var lockouts []lockout.Lockout
+	json.NewDecoder(res.Body).Decode(&lockouts)
+	return lockouts
+}
+
+// testLockout is the lockout scenario, see forEachBackend.
+func testLockout(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	saved := h.Lockouts
+	defer func() { h.Lockouts = saved }()
+	h.Lockouts = lockout.NewGuard(lockout.Policy{Threshold: 3, IPThreshold: 6, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 15 * time.Minute})
+
+	const attacker = "203.0.113.7:4000"
+	_, created := createUser(h, User{Username: "target", Email: "target@mail.ru", Password: "password"})
+
+	res := serveFrom(h, attacker, http.MethodGet, "/user/me", "target", "wrong", nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveFrom(h, attacker, http.MethodGet, "/user/me", "target", "wrong", nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveFrom(h, attacker, http.MethodGet, "/user/me", "target", "wrong", nil)
+	assert.Equal(t, res.StatusCode, 429)
+	assert.Equal(t, res.Header.Get("Retry-After"), "60")
+
+	// the right password doesn't get through either, wherever it comes from
+	res = serveAsUser(h, http.MethodGet, "/user/me", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 429)
+	assert.Equal(t, res.Header.Get("Retry-After") != "", true)
+	res = login(h, "target", "password")
+	assert.Equal(t, res.StatusCode, 429)
+	b, _ := json.Marshal(dto.TokenRequest{GrantType: "password", Username: "target", Password: "password"})
+	res = serveAsUser(h, http.MethodPost, "/auth/token", "", "", b)
+	assert.Equal(t, res.StatusCode, 429)
+
+	lockouts := listLockouts(t, h)
+	assert.Equal(t, len(lockouts), 2)
+	assert.Equal(t, lockouts[0].Key, "ip:203.0.113.7")
+	assert.Equal(t, lockouts[0].LockedUntil, (*time.Time)(nil))
+	assert.Equal(t, lockouts[1].Key, "user:target")
+	assert.Equal(t, lockouts[1].Failures, 3)
+	assert.NotEqual(t, lockouts[1].LockedUntil, nil)
+
+	res = serveFrom(h, attacker, http.MethodGet, "/auth/lockouts", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 429)
+
+	res = serveAsAdmin(h, http.MethodDelete, "/auth/lockouts/user:Target", nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsAdmin(h, http.MethodDelete, "/auth/lockouts/user:target", nil)
+	assert.Equal(t, res.StatusCode, 404)
+	assert.Equal(t, len(listAudit(t, h, "action=lockout_clear&target=user:target")), 1)
+
+	res = serveAsUser(h, http.MethodGet, "/user/me", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	// spraying many usernames from one IP locks the IP out
+	for _, username := range []string{"a", "b", "c"} {
+		res = serveFrom(h, attacker, http.MethodGet, "/user/me", username, "wrong", nil)
+		assert.NotEqual(t, res.StatusCode, 200)
+	}
+	assert.Equal(t, res.StatusCode, 429)
+	res = serveFrom(h, attacker, http.MethodGet, "/user/me", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 429)
+	res = serveAsUser(h, http.MethodGet, "/user/me", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	res = serveAsAdmin(h, http.MethodDelete, "/auth/lockouts/ip:203.0.113.7", nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveFrom(h, attacker, http.MethodGet, "/user/me", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	// plain users may not see the lockouts
+	res = serveAsUser(h, http.MethodGet, "/auth/lockouts", "target", "password", nil)
+	assert.Equal(t, res.StatusCode, 403)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestLockout(t *testing.T) {
+	forEachBackend(t, testLockout)
+}
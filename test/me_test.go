@@ -0,0 +1,197 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/audit"
+	"users/internal/mail"
+	"users/internal/rbac"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func getMe(t *testing.T, h http.Handler, username, password string) (*http.Response, dto.ListUser) {
+	res := serveAsUser(h, http.MethodGet, "/user/me", username, password, nil)
+
+	var me dto.ListUser
+	if res.StatusCode == http.StatusOK {
+		json.NewDecoder(res.Body).Decode(&me)
+	}
+	return res, me
+}
+
+// testSelfService is the self-service scenario, see forEachBackend.
+func testSelfService(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	saved := h.Mailer
+	defer func() { h.Wait(); h.Mailer = saved }()
+	outbox := mail.NewOutbox()
+	h.Mailer = outbox
+
+	_, created := createUser(h, User{Username: "selfie", Email: "selfie@mail.ru", Password: "password"})
+
+	res, me := getMe(t, h, "selfie", "password")
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, me.Id, created.Id)
+	assert.Equal(t, me.Username, "selfie")
+	assert.Equal(t, res.Header.Get("ETag"), `"1"`)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/me", nil))
+	assert.Equal(t, w.Code, 401)
+
+	// only the username and email are for the user to change
+	for _, body := range []map[string]any{{"admin": true}, {"password": "newpassword"}, {"email": "not an email"}} {
+		b, _ := json.Marshal(body)
+		res = serveAsUser(h, http.MethodPatch, "/user/me", "selfie", "password", b)
+		assert.Equal(t, res.StatusCode, 400)
+	}
+	b, _ := json.Marshal(map[string]bool{"admin": true})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+created.Id, "selfie", "password", b)
+	assert.Equal(t, res.StatusCode, 403)
+	_, me = getMe(t, h, "selfie", "password")
+	assert.Equal(t, me.Admin, false)
+	assert.Equal(t, me.Version, uint64(1))
+
+	// changing the email takes the current password, and the old address is
+	// told
+	for _, profile := range []dto.UpdateProfile{{Email: "selfie@new.ru"}, {Email: "selfie@new.ru", CurrentPassword: "wrong"}} {
+		b, _ = json.Marshal(profile)
+		res = serveAsUser(h, http.MethodPatch, "/user/me", "selfie", "password", b)
+		assert.Equal(t, res.StatusCode, 403)
+	}
+	b, _ = json.Marshal(dto.UpdateProfile{Email: "Selfie@Mail.ru"})
+	res = serveAsUser(h, http.MethodPatch, "/user/me", "selfie", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	b, _ = json.Marshal(dto.UpdateProfile{Email: "selfie@new.ru", CurrentPassword: "password"})
+	res = serveAsUser(h, http.MethodPatch, "/user/me", "selfie", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	_, me = getMe(t, h, "selfie", "password")
+	assert.Equal(t, me.Email, "selfie@new.ru")
+	h.Wait()
+	assert.Equal(t, len(outbox.Messages()), 1)
+	assert.Equal(t, outbox.Messages()[0].To, "Selfie@Mail.ru")
+	assert.Equal(t, strings.Contains(outbox.Messages()[0].Body, "selfie@new.ru"), true)
+
+	b, _ = json.Marshal(dto.UpdateProfile{Username: "admin"})
+	res = serveAsUser(h, http.MethodPatch, "/user/me", "selfie", "password", b)
+	assert.Equal(t, res.StatusCode, 409)
+
+	// changing the password takes the current one
+	for _, change := range []dto.ChangePassword{
+		{CurrentPassword: "password"},
+		{CurrentPassword: "password", NewPassword: "password"},
+	} {
+		b, _ := json.Marshal(change)
+		res = serveAsUser(h, http.MethodPost, "/user/me/password", "selfie", "password", b)
+		assert.Equal(t, res.StatusCode, 400)
+	}
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "wrong", NewPassword: "newpassword"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/password", "selfie", "password", b)
+	assert.Equal(t, res.StatusCode, 403)
+
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "password", NewPassword: "newpassword"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/password", "selfie", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	res, _ = getMe(t, h, "selfie", "password")
+	assert.Equal(t, res.StatusCode, 401)
+	res, me = getMe(t, h, "selfie", "newpassword")
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, me.Email, "selfie@new.ru")
+
+	entries := listAudit(t, h, "action=update&target="+created.Id)
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, entries[0].Actor, "selfie")
+	assert.Equal(t, entries[2].Changes["password"].To, audit.Redacted)
+
+	// stale versions are refused as for PATCH /user/{id}
+	req := httptest.NewRequest(http.MethodPatch, "/user/me", bytes.NewBufferString(`{"username": "selfie2"}`))
+	req.SetBasicAuth("selfie", "newpassword")
+	req.Header.Set("If-Match", `"1"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 412)
+
+	// admins stay admins
+	_, boss := createUser(h, User{Username: "boss", Email: "boss@mail.ru", Password: "password", Admin: true})
+	b, _ = json.Marshal(dto.UpdateProfile{Email: "boss@new.ru", CurrentPassword: "password"})
+	res = serveAsUser(h, http.MethodPatch, "/user/me", "boss", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "password", NewPassword: "newpassword"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/password", "boss", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	_, me = getMe(t, h, "boss", "newpassword")
+	assert.Equal(t, me.Admin, true)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	serveAsAdmin(h, http.MethodDelete, "/user/"+boss.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestSelfService(t *testing.T) {
+	forEachBackend(t, testSelfService)
+}
+
+// testChangePasswordAccess is the scenario of what a password change does to
+// the other ways in, see forEachBackend.
+func testChangePasswordAccess(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	_, created := createUser(h, User{Username: "changer", Email: "changer@mail.ru", Password: "password"})
+
+	current := sessionCookie(login(h, "changer", "password"))
+	other := sessionCookie(login(h, "changer", "password"))
+	_, pair := requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "changer", Password: "password"})
+	access := backdate(t, h.Tokens, pair.AccessToken, 1)
+	res := serveWithToken(h, http.MethodGet, "/user/me", access, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res, key := createAPIKey(h, "changer", "password", dto.CreateAPIKey{Name: "ci", Scopes: []rbac.Permission{rbac.UsersRead}})
+	assert.Equal(t, res.StatusCode, 201)
+
+	// wrong current passwords count as failed logins
+	b, _ := json.Marshal(dto.ChangePassword{CurrentPassword: "wrong", NewPassword: "newpassword"})
+	for range config.Cfg.Lockout.Threshold - 1 {
+		res = serveWithCookies(h, http.MethodPost, "/user/me/password", b, current)
+		assert.Equal(t, res.StatusCode, 403)
+	}
+	res = serveWithCookies(h, http.MethodPost, "/user/me/password", b, current)
+	assert.Equal(t, res.StatusCode, 429)
+	assert.NotEqual(t, res.Header.Get("Retry-After"), "")
+	h.Lockouts.Succeed("changer")
+
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "password", NewPassword: "newpassword"})
+	res = serveWithCookies(h, http.MethodPost, "/user/me/password", b, current)
+	assert.Equal(t, res.StatusCode, 204)
+
+	// only the session the password was changed in is left
+	res = serveWithCookies(h, http.MethodGet, "/user/me", nil, current)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithCookies(h, http.MethodGet, "/user/me", nil, other)
+	assert.Equal(t, res.StatusCode, 401)
+	res, _ = refreshTokens(h, pair.RefreshToken)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveWithToken(h, http.MethodGet, "/user/me", access, nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveWithAPIKey(h, http.MethodGet, "/user/me", key.Value, nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// the access tokens issued since are accepted
+	_, pair = requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "changer", Password: "newpassword"})
+	res = serveWithToken(h, http.MethodGet, "/user/me", pair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestChangePasswordAccess(t *testing.T) {
+	forEachBackend(t, testChangePasswordAccess)
+}
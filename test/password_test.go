@@ -0,0 +1,223 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/password"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestPasswordHash(t *testing.T) {
+	policy := password.Policy{Argon2: password.Argon2Params{Time: 1, Memory: 1024}}
+
+	hash, err := password.Hash("secret", policy)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), true)
+
+	ok, err := password.Verify("secret", hash)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, _ = password.Verify("Secret", hash)
+	assert.Equal(t, ok, false)
+
+	other, _ := password.Hash("secret", policy)
+	assert.NotEqual(t, other, hash)
+
+	assert.Equal(t, password.NeedsRehash(hash, policy), false)
+	assert.Equal(t, password.NeedsRehash(hash, password.Policy{Argon2: password.Argon2Params{Time: 2, Memory: 1024}}), true)
+	assert.Equal(t, password.NeedsRehash(hash, password.Policy{Algorithm: password.Bcrypt, BcryptCost: 4}), true)
+
+	// bcrypt hashes, the legacy ones included
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	ok, err = password.Verify("secret", string(legacy))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, password.NeedsRehash(string(legacy), policy), true)
+	assert.Equal(t, password.NeedsRehash(string(legacy), password.Policy{Algorithm: password.Bcrypt, BcryptCost: 4}), false)
+
+	hash, err = password.Hash("secret", password.Policy{Algorithm: password.Bcrypt, BcryptCost: 5})
+	assert.Equal(t, err, nil)
+	cost, _ := bcrypt.Cost([]byte(hash))
+	assert.Equal(t, cost, 5)
+
+	_, err = password.Verify("secret", "plain")
+	assert.Equal(t, err, password.ErrUnknownHash)
+	_, err = password.Verify("secret", "$argon2id$v=19$m=1024,t=1,p=1$broken")
+	assert.Equal(t, err, password.ErrUnknownHash)
+	_, err = password.Hash("secret", password.Policy{Algorithm: "md5"})
+	assert.NotEqual(t, err, nil)
+}
+
+// testRehash is the rehash scenario, see forEachBackend.
+func testRehash(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	saved := config.Cfg.Password
+	defer func() { config.Cfg.Password = saved }()
+
+	// a user from before argon2id
+	config.Cfg.Password.Algorithm, config.Cfg.Password.BcryptCost = password.Bcrypt, 4
+	_, created := createUser(h, User{Username: "legacy", Email: "legacy@mail.ru", Password: "password"})
+	credentials, _ := repo.GetCredentialsByUsername("legacy")
+	assert.Equal(t, strings.HasPrefix(credentials.Password, "$2a$04$"), true)
+	config.Cfg.Password = saved
+
+	res := serveAsUser(h, http.MethodGet, "/user/me", "legacy", "wrong", nil)
+	assert.Equal(t, res.StatusCode, 401)
+	credentials, _ = repo.GetCredentialsByUsername("legacy")
+	assert.Equal(t, strings.HasPrefix(credentials.Password, "$2a$04$"), true)
+
+	res = serveAsUser(h, http.MethodGet, "/user/me", "legacy", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	credentials, _ = repo.GetCredentialsByUsername("legacy")
+	assert.Equal(t, strings.HasPrefix(credentials.Password, "$argon2id$"), true)
+	assert.Equal(t, repo.GetUserById(created.Id).Version, uint64(1))
+
+	rehashed := credentials.Password
+	res = serveAsUser(h, http.MethodGet, "/user/me", "legacy", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	credentials, _ = repo.GetCredentialsByUsername("legacy")
+	assert.Equal(t, credentials.Password, rehashed)
+
+	// a stale hash doesn't override a newer one
+	err := repo.RehashPassword(created.Id, "stale", "other")
+	assert.Equal(t, err, nil)
+	credentials, _ = repo.GetCredentialsByUsername("legacy")
+	assert.Equal(t, credentials.Password, rehashed)
+
+	// the policy itself may change
+	config.Cfg.Password.Algorithm, config.Cfg.Password.BcryptCost = password.Bcrypt, 5
+	res = login(h, "legacy", "password")
+	assert.Equal(t, res.StatusCode, 200)
+	credentials, _ = repo.GetCredentialsByUsername("legacy")
+	assert.Equal(t, strings.HasPrefix(credentials.Password, "$2a$05$"), true)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestRehash(t *testing.T) {
+	forEachBackend(t, testRehash)
+}
+
+func strictRules(t *testing.T) password.Rules {
+	blocklist, err := password.LoadBlocklist("../config/breached-passwords.txt")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, blocklist.Len() > 50, true)
+
+	return password.Rules{MinLength: 10, MaxLength: 128, MinClasses: 3, MinEntropy: 50, ForbidPersonal: true, Blocklist: blocklist}
+}
+
+func TestPasswordRules(t *testing.T) {
+	rules := strictRules(t)
+
+	assert.Equal(t, len(rules.Check("correct-Horse-7-battery")), 0)
+	assert.Equal(t, len(rules.Check("Ünïcødé-pässwörd-42")), 0)
+
+	assert.Equal(t, rules.Check("a"), []string{
+		"must be at least 10 characters long",
+		"must mix at least 3 of lowercase letters, uppercase letters, digits and symbols",
+		"is too easy to guess",
+	})
+	assert.Equal(t, rules.Check("aaaaaaaaaaAA11!!"), []string{"is too easy to guess"})
+	assert.Equal(t, rules.Check("abcdefghijKLM0123"), []string{"is too easy to guess"})
+	assert.Equal(t, rules.Check("Password123")[0], "is too easy to guess")
+	assert.Equal(t, rules.Check("P@SSW0RD"), []string{
+		"must be at least 10 characters long",
+		"is too easy to guess",
+		"is a known breached password",
+	})
+	assert.Equal(t, rules.Check(strings.Repeat("aB3$", 33)), []string{"must be at most 128 characters long"})
+
+	assert.Equal(t, rules.Check("my-Jsmith-pass-99", "JSmith", "john@mail.ru"), []string{"must not contain the username or email"})
+	assert.Equal(t, rules.Check("my-John-pass-99", "jsmith", "john@mail.ru"), []string{"must not contain the username or email"})
+	assert.Equal(t, len(rules.Check("my-Jo-pass-99", "jo", "jo@mail.ru")), 0)
+
+	assert.Equal(t, password.Entropy(""), 0.0)
+	assert.Equal(t, password.Entropy("aaaa") < password.Entropy("azqy"), true)
+
+	_, err := password.LoadBlocklist("missing.txt")
+	assert.NotEqual(t, err, nil)
+}
+
+func invalidFields(res *http.Response) map[string][]string {
+	var body dto.ErrorResponse
+	json.NewDecoder(res.Body).Decode(&body)
+	return body.Fields
+}
+
+// testNewPasswordRules is the password rules scenario, see forEachBackend.
+func testNewPasswordRules(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	saved := h.Passwords
+	defer func() { h.Passwords = saved }()
+	h.Passwords = strictRules(t)
+
+	res, _ := createUser(h, User{Username: "ruled", Email: "ruled@mail.ru", Password: "password"})
+	assert.Equal(t, res.StatusCode, 400)
+	problems := invalidFields(res)["password"]
+	assert.Equal(t, problems[len(problems)-1], "is a known breached password")
+
+	// symbols are welcome
+	res, created := createUser(h, User{Username: "ruled", Email: "ruled@mail.ru", Password: "Tr0ub4dor&3-horse"})
+	assert.Equal(t, res.StatusCode, 201)
+
+	b, _ := json.Marshal(map[string]string{"password": "Ruled-Tr0ub4dor&3"})
+	res = serveAsAdmin(h, http.MethodPatch, "/user/"+created.Id, b)
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, invalidFields(res)["password"], []string{"must not contain the username or email"})
+
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "Tr0ub4dor&3-horse", NewPassword: "qwerty123"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/password", "ruled", "Tr0ub4dor&3-horse", b)
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, len(invalidFields(res)["new_password"]) > 0, true)
+
+	b, _ = json.Marshal(dto.ChangePassword{CurrentPassword: "Tr0ub4dor&3-horse", NewPassword: "c0rrect#Horse!battery"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/password", "ruled", "Tr0ub4dor&3-horse", b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestNewPasswordRules(t *testing.T) {
+	forEachBackend(t, testNewPasswordRules)
+}
+
+func TestPasswordConfigValidation(t *testing.T) {
+	cfg := config.Cfg
+	assert.Equal(t, cfg.Validate(), nil)
+
+	// argon2 takes a byte, a larger value must not be cut down
+	cfg.Password.Argon2.Threads = 256
+	assert.NotEqual(t, cfg.Validate(), nil)
+	cfg.Password.Argon2.Threads = 0
+	assert.NotEqual(t, cfg.Validate(), nil)
+	cfg.Password.Argon2.Threads = 255
+	assert.Equal(t, cfg.Validate(), nil)
+
+	cfg.Password.MaxConcurrent = -1
+	assert.NotEqual(t, cfg.Validate(), nil)
+}
+
+func TestConcurrentPasswordChecks(t *testing.T) {
+	hash, err := dto.HashPassword("password")
+	assert.Equal(t, err, nil)
+
+	// more checks than hashing slots all get their turn
+	results := make(chan bool)
+	for i := 0; i < 4*runtime.NumCPU(); i++ {
+		go func() { results <- dto.CheckPassword("password", hash) }()
+	}
+	for i := 0; i < 4*runtime.NumCPU(); i++ {
+		assert.Equal(t, <-results, true)
+	}
+}
@@ -0,0 +1,218 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/mail"
+	"users/internal/rbac"
+	"users/internal/reset"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+var resetTokenLine = regexp.MustCompile(`(?m)^[A-Za-z0-9_-]{43}$`)
+
+// requestPasswordReset requests a reset and waits for the mail, if any.
+func requestPasswordReset(h *delivery.UserHandler, email string) *http.Response {
+	b, _ := json.Marshal(dto.PasswordReset{Email: email})
+	res := serveAsUser(h, http.MethodPost, "/auth/password-reset", "", "", b)
+	h.Wait()
+	return res
+}
+
+func confirmPasswordResetAndWait(h *delivery.UserHandler, token, password string) *http.Response {
+	res := confirmPasswordReset(h, token, password)
+	h.Wait()
+	return res
+}
+
+// failingMailer fails every mail.
+type failingMailer struct{}
+
+func (failingMailer) Send(mail.Message) error {
+	return errors.New("mail server down")
+}
+
+func confirmPasswordReset(h http.Handler, token, password string) *http.Response {
+	b, _ := json.Marshal(dto.ConfirmPasswordReset{Token: token, NewPassword: password})
+	return serveAsUser(h, http.MethodPost, "/auth/password-reset/confirm", "", "", b)
+}
+
+// lastResetToken returns the token of the last mail of the outbox.
+func lastResetToken(t *testing.T, outbox *mail.Outbox) string {
+	messages := outbox.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no mail sent")
+	}
+
+	token := resetTokenLine.FindString(messages[len(messages)-1].Body)
+	assert.NotEqual(t, token, "")
+	return token
+}
+
+// testPasswordReset is the password reset scenario, see forEachBackend.
+func testPasswordReset(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	saved, savedRules := h.Mailer, h.Passwords
+	defer func() { h.Wait(); h.Mailer, h.Passwords = saved, savedRules }()
+	outbox := mail.NewOutbox()
+	h.Mailer = outbox
+
+	_, created := createUser(h, User{Username: "forgetful", Email: "forgetful@mail.ru", Password: "password"})
+
+	// the user is logged in in every way, the reset logs it out
+	session := sessionCookie(login(h, "forgetful", "password"))
+	res, pair := requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "forgetful", Password: "password"})
+	assert.Equal(t, res.StatusCode, 200)
+	res, key := createAPIKey(h, "forgetful", "password", dto.CreateAPIKey{Name: "script", Scopes: []rbac.Permission{rbac.UsersRead}})
+	assert.Equal(t, res.StatusCode, 201)
+
+	// unknown emails get the same answer, without a mail
+	res = requestPasswordReset(h, "nobody@mail.ru")
+	assert.Equal(t, res.StatusCode, 202)
+	assert.Equal(t, len(outbox.Messages()), 0)
+	res = requestPasswordReset(h, "not an email")
+	assert.Equal(t, res.StatusCode, 400)
+
+	res = requestPasswordReset(h, "Forgetful@mail.ru")
+	assert.Equal(t, res.StatusCode, 202)
+	assert.Equal(t, len(outbox.Messages()), 1)
+	assert.Equal(t, outbox.Messages()[0].To, "forgetful@mail.ru")
+	first := lastResetToken(t, outbox)
+
+	// a new request replaces the earlier token
+	requestPasswordReset(h, "forgetful@mail.ru")
+	second := lastResetToken(t, outbox)
+	assert.NotEqual(t, first, second)
+	res = confirmPasswordReset(h, first, "a forgotten password")
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, errorMessage(res), reset.ErrInvalidToken.Error())
+
+	// only the hash of the token is stored
+	_, err := repo.PasswordResets().Get(second)
+	assert.Equal(t, err, reset.ErrInvalidToken)
+	_, err = repo.PasswordResets().Get(reset.Key(second))
+	assert.Equal(t, err, nil)
+
+	// a password breaking the rules leaves the token usable
+	h.Passwords = strictRules(t)
+	res = confirmPasswordReset(h, second, "qwerty123")
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, len(invalidFields(res)["new_password"]) > 0, true)
+	h.Passwords = savedRules
+
+	res = confirmPasswordResetAndWait(h, second, "a forgotten password")
+	assert.Equal(t, res.StatusCode, 204)
+	assert.Equal(t, outbox.Messages()[len(outbox.Messages())-1].Subject, "Your password was changed")
+
+	res = serveWithCookies(h, http.MethodGet, "/user/me", nil, session)
+	assert.Equal(t, res.StatusCode, 401)
+	res, _ = refreshTokens(h, pair.RefreshToken)
+	assert.NotEqual(t, res.StatusCode, 200)
+	res = serveWithAPIKey(h, http.MethodGet, "/user/", key.Value, nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	res = confirmPasswordReset(h, second, "yet another password")
+	assert.Equal(t, res.StatusCode, 400)
+
+	res = serveAsUser(h, http.MethodGet, "/user/me", "forgetful", "password", nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveAsUser(h, http.MethodGet, "/user/me", "forgetful", "a forgotten password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	entries := listAudit(t, h, "action=password_reset&target="+created.Id)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Actor, "forgetful")
+
+	// a mail that can't be sent doesn't show either
+	h.Mailer = failingMailer{}
+	res = requestPasswordReset(h, "forgetful@mail.ru")
+	assert.Equal(t, res.StatusCode, 202)
+	h.Mailer = outbox
+
+	// the tokens expire
+	resets := reset.NewManager(repo.PasswordResets(), time.Minute)
+	issued := time.Now()
+	value, _, err := resets.Issue(created.Id, issued)
+	assert.Equal(t, err, nil)
+	_, err = resets.Check(value, issued.Add(time.Minute))
+	assert.Equal(t, err, reset.ErrInvalidToken)
+	n, err := repo.PasswordResets().DeleteExpired(issued.Add(time.Minute))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestPasswordReset(t *testing.T) {
+	forEachBackend(t, testPasswordReset)
+}
+
+func TestPasswordResetLimits(t *testing.T) {
+	saved := config.Cfg.PasswordReset
+	defer func() { config.Cfg.PasswordReset = saved }()
+	config.Cfg.PasswordReset.EmailLimit, config.Cfg.PasswordReset.IPLimit = 2, 3
+	config.Cfg.PasswordReset.LimitWindow = time.Hour
+
+	h := delivery.NewUserHandler(repo)
+	outbox := mail.NewOutbox()
+	h.Mailer = outbox
+	_, created := createUser(h, User{Username: "limited", Email: "limited@mail.ru", Password: "password"})
+	defer tearDown(created.Id)
+
+	// past its limit an email gets the same answer, without a mail
+	for range 3 {
+		res := requestPasswordReset(h, "Limited@mail.ru")
+		assert.Equal(t, res.StatusCode, 202)
+	}
+	assert.Equal(t, len(outbox.Messages()), 2)
+
+	// past its limit an IP is told to wait, whatever the email
+	res := requestPasswordReset(h, "nobody@mail.ru")
+	assert.Equal(t, res.StatusCode, 429)
+	assert.NotEqual(t, res.Header.Get("Retry-After"), "")
+	assert.Equal(t, errorMessage(res), "too many reset requests, retry later")
+
+	limits := reset.NewLimiter(reset.Limits{PerEmail: 1, PerIP: 1, Window: time.Minute})
+	now := time.Now()
+	send, retryAfter := limits.Allow("a@mail.ru", "192.0.2.1", now)
+	assert.Equal(t, send, true)
+	assert.Equal(t, retryAfter, time.Duration(0))
+	_, retryAfter = limits.Allow("b@mail.ru", "192.0.2.1", now.Add(time.Second))
+	assert.Equal(t, retryAfter, time.Minute-time.Second)
+	send, _ = limits.Allow("a@mail.ru", "192.0.2.2", now.Add(time.Second))
+	assert.Equal(t, send, false)
+	send, _ = limits.Allow("a@mail.ru", "192.0.2.1", now.Add(time.Minute))
+	assert.Equal(t, send, true)
+	assert.Equal(t, limits.Purge(now.Add(2*time.Minute)), 3)
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox := mail.NewFileOutbox(dir, "users@localhost")
+
+	err := outbox.Send(mail.Message{To: "a@mail.ru", Subject: "Привет", Body: "line one\nline two\n"})
+	assert.Equal(t, err, nil)
+	err = outbox.Send(mail.Message{To: "a@mail.ru\r\nBcc: b@mail.ru", Subject: "hi", Body: "hi"})
+	assert.Equal(t, err, mail.ErrInvalidHeader)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.Equal(t, len(files), 1)
+
+	b, _ := os.ReadFile(files[0])
+	assert.Equal(t, strings.Contains(string(b), "From: users@localhost\r\nTo: a@mail.ru\r\n"), true)
+	assert.Equal(t, strings.Contains(string(b), "Subject: =?utf-8?q?"), true)
+	assert.Equal(t, strings.HasSuffix(string(b), "\r\n\r\nline one\r\nline two\r\n"), true)
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func listUsers(t *testing.T, h http.Handler, query string) dto.UserPage {
+	res := serveAsAdmin(h, http.MethodGet, "/user/?envelope=true&"+query, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var page dto.UserPage
+	json.NewDecoder(res.Body).Decode(&page)
+	return page
+}
+
+func usernames(page dto.UserPage) []string {
+	names := []string{}
+	for _, u := range page.Users {
+		names = append(names, u.Username)
+	}
+	return names
+}
+
+// testFilterAndSort is the listing scenario, see forEachBackend.
+func testFilterAndSort(t *testing.T, h *delivery.UserHandler, _ repository.UserRepository) {
+	start := time.Now().UTC()
+
+	var ids []string
+	for i, name := range []string{"carol", "alice", "bob", "alfred"} {
+		u := User{
+			Username: name,
+			Email:    fmt.Sprintf("%s@%s", name, []string{"corp.io", "Mail.ru"}[i%2]),
+			Password: "password",
+			Admin:    i == 3,
+		}
+		b, _ := json.Marshal(u)
+		res := serveAsAdmin(h, http.MethodPost, "/user/", b)
+
+		var created dto.UserId
+		json.NewDecoder(res.Body).Decode(&created)
+		ids = append(ids, created.Id)
+	}
+
+	page := listUsers(t, h, "username_prefix=al&sort=username")
+	assert.Equal(t, usernames(page), []string{"alfred", "alice"})
+
+	// the prefix is folded like the usernames are on lookups
+	page = listUsers(t, h, "username_prefix=AL&sort=username")
+	assert.Equal(t, usernames(page), []string{"alfred", "alice"})
+
+	page = listUsers(t, h, "email_domain=mail.ru&sort=-username")
+	assert.Equal(t, usernames(page), []string{"alice", "alfred"})
+
+	page = listUsers(t, h, "email_domain=mail.ru&admin=false")
+	assert.Equal(t, usernames(page), []string{"alice"})
+
+	page = listUsers(t, h, "created_from="+start.Format(time.RFC3339Nano)+"&sort=-created_at")
+	assert.Equal(t, usernames(page), []string{"alfred", "bob", "alice", "carol"})
+
+	// paging through a sorted and filtered list
+	page = listUsers(t, h, "created_from="+start.Format(time.RFC3339Nano)+"&sort=username&limit=3")
+	assert.Equal(t, usernames(page), []string{"alfred", "alice", "bob"})
+	page = listUsers(t, h, "created_from="+start.Format(time.RFC3339Nano)+"&sort=username&limit=3&cursor="+page.NextCursor)
+	assert.Equal(t, usernames(page), []string{"carol"})
+	assert.Equal(t, page.NextCursor, "")
+
+	// paging through a sorted list without filters, other users may be there
+	var listed []string
+	page = listUsers(t, h, "sort=-email&limit=2")
+	cursor := page.NextCursor
+	for {
+		for _, name := range usernames(page) {
+			if slices.Contains([]string{"carol", "alice", "bob", "alfred"}, name) {
+				listed = append(listed, name)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		page = listUsers(t, h, "sort=-email&limit=2&cursor="+page.NextCursor)
+	}
+	assert.Equal(t, listed, []string{"carol", "bob", "alice", "alfred"})
+
+	// a cursor is bound to its sort order
+	res := serveAsAdmin(h, http.MethodGet, "/user/?sort=email&cursor="+cursor, nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	res = serveAsAdmin(h, http.MethodGet, "/user/?sort=password", nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	for _, id := range ids {
+		serveAsAdmin(h, http.MethodDelete, "/user/"+id, nil)
+	}
+}
+
+func TestListUsersFilterAndSort(t *testing.T) {
+	forEachBackend(t, testFilterAndSort)
+}
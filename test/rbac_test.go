@@ -0,0 +1,190 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"users/internal/rbac"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func serveAsUser(h http.Handler, method, target, username, password string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	req.SetBasicAuth(username, password)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func userPermissions(t *testing.T, h http.Handler, id string) dto.UserPermissions {
+	res := serveAsAdmin(h, http.MethodGet, "/user/"+id+"/roles", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var permissions dto.UserPermissions
+	json.NewDecoder(res.Body).Decode(&permissions)
+	return permissions
+}
+
+// testRBAC is the role scenario, see forEachBackend.
+func testRBAC(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	_, auditor := createUser(h, User{Username: "auditor", Email: "auditor@mail.ru", Password: "password"})
+	_, victim := createUser(h, User{Username: "bystander", Email: "bystander@mail.ru", Password: "password"})
+
+	// plain users only read
+	res := serveAsUser(h, http.MethodGet, "/user/", "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveAsUser(h, http.MethodGet, "/audit", "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 403)
+	res = serveAsUser(h, http.MethodGet, "/roles", "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 403)
+
+	permissions := userPermissions(t, h, auditor.Id)
+	assert.Equal(t, permissions.Roles, []string{"user"})
+	assert.Equal(t, permissions.Permissions, []rbac.Permission{rbac.UsersRead})
+
+	// roles
+	b, _ := json.Marshal(dto.Role{Name: "auditors", Permissions: []rbac.Permission{rbac.AuditRead, rbac.UsersRead, rbac.AuditRead}})
+	res = serveAsAdmin(h, http.MethodPost, "/roles", b)
+	assert.Equal(t, res.StatusCode, 201)
+	var created rbac.Role
+	json.NewDecoder(res.Body).Decode(&created)
+	assert.Equal(t, created.Permissions, []rbac.Permission{rbac.AuditRead, rbac.UsersRead})
+
+	res = serveAsAdmin(h, http.MethodPost, "/roles", b)
+	assert.Equal(t, res.StatusCode, 409)
+
+	for _, role := range []dto.Role{
+		{Name: "admin", Permissions: []rbac.Permission{rbac.UsersRead}},
+		{Name: "bad name", Permissions: []rbac.Permission{rbac.UsersRead}},
+		{Name: "unknown", Permissions: []rbac.Permission{"users:fly"}},
+		{Name: "empty"},
+	} {
+		b, _ := json.Marshal(role)
+		res = serveAsAdmin(h, http.MethodPost, "/roles", b)
+		assert.Equal(t, res.StatusCode, 400)
+	}
+
+	res = serveAsAdmin(h, http.MethodGet, "/roles", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	var roles []rbac.Role
+	json.NewDecoder(res.Body).Decode(&roles)
+	assert.Equal(t, len(roles), 3)
+	assert.Equal(t, roles[0].Builtin, true)
+	assert.Equal(t, roles[2].Name, "auditors")
+
+	// assignments
+	b, _ = json.Marshal(dto.UserRoles{Roles: []string{"auditors"}})
+	res = serveAsAdmin(h, http.MethodPut, "/user/"+auditor.Id+"/roles", b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	res = serveAsUser(h, http.MethodGet, "/audit", "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveAsUser(h, http.MethodDelete, "/user/"+victim.Id, "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 403)
+
+	permissions = userPermissions(t, h, auditor.Id)
+	assert.Equal(t, permissions.Roles, []string{"user", "auditors"})
+	assert.Equal(t, permissions.Permissions, []rbac.Permission{rbac.AuditRead, rbac.UsersRead})
+
+	for _, assigned := range [][]string{{"admin"}, {"nobody"}} {
+		b, _ := json.Marshal(dto.UserRoles{Roles: assigned})
+		res = serveAsAdmin(h, http.MethodPut, "/user/"+auditor.Id+"/roles", b)
+		assert.Equal(t, res.StatusCode, 400)
+	}
+	res = serveAsAdmin(h, http.MethodPut, "/user/00000000-0000-4000-8000-000000000000/roles", b)
+	assert.Equal(t, res.StatusCode, 404)
+
+	// changing a role changes what its users may do
+	b, _ = json.Marshal(dto.UpdateRole{Permissions: []rbac.Permission{rbac.UsersRead, rbac.UsersDelete}})
+	res = serveAsAdmin(h, http.MethodPut, "/roles/auditors", b)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsUser(h, http.MethodGet, "/audit", "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 403)
+	res = serveAsUser(h, http.MethodDelete, "/user/"+victim.Id, "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 204)
+
+	res = serveAsAdmin(h, http.MethodPut, "/roles/nobody", b)
+	assert.Equal(t, res.StatusCode, 404)
+
+	// users:write doesn't make an admin
+	b, _ = json.Marshal(dto.Role{Name: "writers", Permissions: []rbac.Permission{rbac.UsersRead, rbac.UsersWrite}})
+	serveAsAdmin(h, http.MethodPost, "/roles", b)
+	b, _ = json.Marshal(dto.UserRoles{Roles: []string{"writers", "auditors"}})
+	serveAsAdmin(h, http.MethodPut, "/user/"+auditor.Id+"/roles", b)
+
+	b, _ = json.Marshal(map[string]string{"email": "auditor@mail.com"})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+auditor.Id, "auditor", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	b, _ = json.Marshal(map[string]bool{"admin": true})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+auditor.Id, "auditor", "password", b)
+	assert.Equal(t, res.StatusCode, 403)
+	b, _ = json.Marshal(User{Username: "sidekick", Email: "sidekick@mail.ru", Password: "password", Admin: true})
+	res = serveAsUser(h, http.MethodPost, "/user/", "auditor", "password", b)
+	assert.Equal(t, res.StatusCode, 403)
+
+	// nor takes over an admin, or demotes it by leaving admin out
+	admin, _ := repo.GetCredentialsByUsername("admin")
+	for _, update := range []map[string]string{{"password": "a password of mine"}, {"email": "mine@mail.ru"}} {
+		b, _ = json.Marshal(update)
+		res = serveAsUser(h, http.MethodPatch, "/user/"+admin.Id, "auditor", "password", b)
+		assert.Equal(t, res.StatusCode, 403)
+	}
+	res = serveAsUser(h, http.MethodDelete, "/user/"+admin.Id, "auditor", "password", nil)
+	assert.Equal(t, res.StatusCode, 403)
+	b, _ = json.Marshal(map[string]string{"username": "admin2"})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+admin.Id, "auditor", "password", b)
+	assert.Equal(t, res.StatusCode, 204)
+	assert.Equal(t, repo.GetUserById(admin.Id).Admin, true)
+	b, _ = json.Marshal(map[string]string{"username": "admin"})
+	res = serveAsUser(h, http.MethodPatch, "/user/"+admin.Id, "admin2", "admin", b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	// deleting a role takes it from its users
+	res = serveAsAdmin(h, http.MethodDelete, "/roles/auditors", nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsAdmin(h, http.MethodDelete, "/roles/auditors", nil)
+	assert.Equal(t, res.StatusCode, 404)
+	res = serveAsAdmin(h, http.MethodDelete, "/roles/user", nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	assigned, err := repo.Roles().UserRoles(auditor.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, assigned, []string{"writers"})
+
+	entries := listAudit(t, h, "action=roles_assign&target="+auditor.Id)
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[1].Changes["roles"].To, "auditors,writers")
+	assert.Equal(t, len(listAudit(t, h, "action=role_delete&target=auditors")), 1)
+
+	serveAsAdmin(h, http.MethodDelete, "/roles/writers", nil)
+	serveAsAdmin(h, http.MethodDelete, "/user/"+auditor.Id, nil)
+	repo.PurgeDeleted(time.Now())
+
+	// purging a user drops its roles
+	_, purged := createUser(h, User{Username: "purged", Email: "purged@mail.ru", Password: "password"})
+	b, _ = json.Marshal(dto.Role{Name: "purgeables", Permissions: []rbac.Permission{rbac.UsersRead}})
+	serveAsAdmin(h, http.MethodPost, "/roles", b)
+	b, _ = json.Marshal(dto.UserRoles{Roles: []string{"purgeables"}})
+	res = serveAsAdmin(h, http.MethodPut, "/user/"+purged.Id+"/roles", b)
+	assert.Equal(t, res.StatusCode, 204)
+	serveAsAdmin(h, http.MethodDelete, "/user/"+purged.Id, nil)
+	repo.PurgeDeleted(time.Now())
+	assigned, err = repo.Roles().UserRoles(purged.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, assigned, []string{})
+	serveAsAdmin(h, http.MethodDelete, "/roles/purgeables", nil)
+}
+
+func TestRBAC(t *testing.T) {
+	forEachBackend(t, testRBAC)
+}
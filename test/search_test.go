@@ -0,0 +1,82 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"users/internal/search"
+	"users/internal/user/infrastructure/dto"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func hitIds(hits []search.Hit) []string {
+	ids := []string{}
+	for _, h := range hits {
+		ids = append(ids, h.Id)
+	}
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	x := search.NewIndex()
+	x.Put("1", "Alice Cooper", "alice@mail.ru")
+	x.Put("2", "Alfred", "alfred@corp.io")
+	x.Put("3", "Bob", "bob@corp.io")
+
+	// misspelled
+	assert.Equal(t, hitIds(x.Search("alcie", 10)), []string{"1"})
+	// partial, the exact substring goes first
+	assert.Equal(t, hitIds(x.Search("alf", 10))[0], "2")
+	// email domain
+	assert.Equal(t, hitIds(x.Search("corp.io", 10)), []string{"2", "3"})
+
+	x.Put("3", "Robert", "robert@corp.io")
+	assert.Equal(t, hitIds(x.Search("bob", 10)), []string{})
+
+	x.Remove("2")
+	assert.Equal(t, hitIds(x.Search("corp", 10)), []string{"3"})
+}
+
+func TestSearchUsers(t *testing.T) {
+	created := User{Username: "Maximilian Schwarz", Email: "max.schwarz@search.test", Password: "password"}
+	b, _ := json.Marshal(created)
+	res := CreateUser(b)
+	json.NewDecoder(res.Body).Decode(&userid)
+
+	find := func(q string) []dto.ListUser {
+		res := serveAsAdmin(&handler, http.MethodGet, "/user/search?q="+url.QueryEscape(q), nil)
+		assert.Equal(t, res.StatusCode, 200)
+
+		var users []dto.ListUser
+		json.NewDecoder(res.Body).Decode(&users)
+		return users
+	}
+
+	users := find("maximillian shwarz")
+	assert.Equal(t, len(users), 1)
+	assert.Equal(t, users[0].Id, userid.Id)
+
+	// the index follows updates and deletes
+	b, _ = json.Marshal(dto.UpdateUser{Username: "Moritz Weber"})
+	serveAsAdmin(&handler, http.MethodPatch, "/user/"+userid.Id, b)
+	assert.Equal(t, len(find("maximilian")), 0)
+	assert.Equal(t, len(find("moritz")), 1)
+
+	tearDown(userid.Id)
+	assert.Equal(t, len(find("moritz")), 0)
+
+	res = serveAsAdmin(&handler, http.MethodGet, "/user/search", nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	// the collection routes don't catch the other paths under /user/
+	b, _ = json.Marshal(User{Username: "searcher", Email: "searcher@search.test", Password: "password"})
+	res = serveAsAdmin(&handler, http.MethodPost, "/user/search", b)
+	assert.Equal(t, res.StatusCode, 404)
+	res = serveAsAdmin(&handler, http.MethodGet, "/user/nobody", nil)
+	assert.Equal(t, res.StatusCode, 404)
+	_, ok := repo.GetCredentialsByUsername("searcher")
+	assert.Equal(t, ok, false)
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"users/internal/session"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func serveWithCookies(h http.Handler, method, target string, body []byte, cookies []*http.Cookie) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func login(h http.Handler, username, password string) *http.Response {
+	b, _ := json.Marshal(dto.Login{Username: username, Password: password})
+	return serveWithCookies(h, http.MethodPost, "/auth/login", b, nil)
+}
+
+func sessionCookie(res *http.Response) []*http.Cookie {
+	for _, c := range res.Cookies() {
+		if c.Name == "Session" {
+			return []*http.Cookie{c}
+		}
+	}
+	return nil
+}
+
+// testSessions is the session scenario, see forEachBackend.
+func testSessions(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	res := login(h, "admin", "wrong")
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, len(sessionCookie(res)), 0)
+
+	res = serveWithCookies(h, http.MethodPost, "/auth/login", []byte(`{"username": "admin"}`), nil)
+	assert.Equal(t, res.StatusCode, 400)
+
+	res = login(h, "admin", "admin")
+	assert.Equal(t, res.StatusCode, 200)
+	var info dto.SessionInfo
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.Equal(t, info.UserId != "", true)
+	assert.Equal(t, info.ExpiresAt.After(time.Now()), true)
+
+	adminSession := sessionCookie(res)
+	assert.Equal(t, len(adminSession), 1)
+	assert.Equal(t, adminSession[0].HttpOnly, true)
+
+	// the session alone is enough, admin rights included
+	res = serveWithCookies(h, http.MethodGet, "/user/", nil, adminSession)
+	assert.Equal(t, res.StatusCode, 200)
+
+	b, _ := json.Marshal(User{Username: "sessioned", Email: "sessioned@mail.ru", Password: "password"})
+	res = serveWithCookies(h, http.MethodPost, "/user/", b, adminSession)
+	assert.Equal(t, res.StatusCode, 201)
+	var created dto.UserId
+	json.NewDecoder(res.Body).Decode(&created)
+
+	entries := listAudit(t, h, "target="+created.Id)
+	assert.Equal(t, entries[0].Actor, "admin")
+
+	// a user session doesn't give admin rights
+	res = login(h, "Sessioned", "password")
+	assert.Equal(t, res.StatusCode, 200)
+	userSession := sessionCookie(res)
+
+	res = serveWithCookies(h, http.MethodGet, "/user/"+created.Id, nil, userSession)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithCookies(h, http.MethodDelete, "/user/"+created.Id, nil, userSession)
+	assert.Equal(t, res.StatusCode, 403)
+
+	forged := *adminSession[0]
+	forged.Value = "x" + forged.Value[1:]
+	res = serveWithCookies(h, http.MethodGet, "/user/", nil, []*http.Cookie{&forged})
+	assert.Equal(t, res.StatusCode, 401)
+
+	// the sessions of a deleted user stop working
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	res = serveWithCookies(h, http.MethodGet, "/user/", nil, userSession)
+	assert.Equal(t, res.StatusCode, 401)
+
+	res = serveWithCookies(h, http.MethodPost, "/auth/logout", nil, adminSession)
+	assert.Equal(t, res.StatusCode, 204)
+	assert.Equal(t, sessionCookie(res)[0].MaxAge < 0, true)
+
+	res = serveWithCookies(h, http.MethodGet, "/user/", nil, adminSession)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// logging out twice is harmless
+	res = serveWithCookies(h, http.MethodPost, "/auth/logout", nil, adminSession)
+	assert.Equal(t, res.StatusCode, 204)
+
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestSessions(t *testing.T) {
+	forEachBackend(t, testSessions)
+}
+
+// testSessionExpiry is the expiry scenario, see forEachBackend.
+func testSessionExpiry(t *testing.T, _ *delivery.UserHandler, repo repository.UserRepository) {
+	credentials, _ := repo.GetCredentialsByUsername("admin")
+	store, userId := repo.Sessions(), credentials.Id
+
+	ttl := time.Hour
+	m := session.NewManager(store, ttl)
+	now := time.Now()
+
+	id, s, err := m.Start(userId, false, now)
+	assert.Equal(t, err, nil)
+
+	_, renewed, err := m.Check(id, now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, renewed, false)
+
+	// past half of the ttl the session is extended
+	now = now.Add(ttl * 3 / 4)
+	renewedSession, renewed, err := m.Check(id, now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, renewed, true)
+	assert.Equal(t, renewedSession.ExpiresAt, now.UTC().Add(ttl))
+	assert.Equal(t, renewedSession.ExpiresAt.After(s.ExpiresAt), true)
+
+	now = now.Add(ttl * 3 / 4)
+	_, _, err = m.Check(id, now)
+	assert.Equal(t, err, nil)
+
+	// the renewed session expires a whole ttl after its last use
+	_, _, err = m.Check(id, now.Add(ttl-time.Nanosecond))
+	assert.Equal(t, err, nil)
+	_, _, err = m.Check(id, now.Add(ttl).Add(ttl))
+	assert.Equal(t, errors.Is(err, session.ErrNotFound), true)
+
+	now = time.Now()
+	expired := session.Session{UserId: userId, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	assert.Equal(t, store.Put(session.Key("expired"), expired), nil)
+	live, _, _ := m.Start(userId, false, now)
+
+	n, err := store.DeleteExpired(now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+	_, _, err = m.Check(live, now)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, m.End(live), nil)
+	_, _, err = m.Check(live, now)
+	assert.Equal(t, errors.Is(err, session.ErrNotFound), true)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	forEachBackend(t, testSessionExpiry)
+}
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func newSQLiteHandler(t *testing.T, path string) (*delivery.UserHandler, *repository.SQLiteRepo) {
+	repo, err := repository.NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Bootstrap(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	return delivery.NewUserHandler(repo), repo
+}
+
+func serveAsAdmin(h http.Handler, method, target string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	req.SetBasicAuth("admin", "admin")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func TestSQLiteUserLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	h, repo := newSQLiteHandler(t, path)
+
+	b, _ := json.Marshal(user)
+	res := serveAsAdmin(h, http.MethodPost, "/user/", b)
+	assert.Equal(t, res.StatusCode, 201)
+
+	var created dto.UserId
+	json.NewDecoder(res.Body).Decode(&created)
+
+	// same email, another username
+	duplicate := user
+	duplicate.Username = "someone-else"
+	b, _ = json.Marshal(duplicate)
+	res = serveAsAdmin(h, http.MethodPost, "/user/", b)
+	assert.Equal(t, res.StatusCode, 409)
+
+	b, _ = json.Marshal(updatedUser)
+	res = serveAsAdmin(h, http.MethodPatch, fmt.Sprintf("/user/%s", created.Id), b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	// the data and the migrations survive a reopen
+	repo.Close()
+	h, repo = newSQLiteHandler(t, path)
+	defer repo.Close()
+
+	res = serveAsAdmin(h, http.MethodGet, fmt.Sprintf("/user/%s", created.Id), nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var got dto.ListUser
+	json.NewDecoder(res.Body).Decode(&got)
+	assert.Equal(t, got.Username, updatedUser.Username)
+	assert.Equal(t, got.Email, updatedUser.Email)
+
+	_, ok := repo.GetCredentialsByUsername(updatedUser.Username)
+	assert.Equal(t, ok, true)
+
+	res = serveAsAdmin(h, http.MethodDelete, fmt.Sprintf("/user/%s", created.Id), nil)
+	assert.Equal(t, res.StatusCode, 204)
+	assert.Equal(t, repo.IfUserExist(created.Id), false)
+}
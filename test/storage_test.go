@@ -0,0 +1,245 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storage "users/internal/db"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func openJournal(t *testing.T, dir string) (*storage.Journal, *storage.InMemoryStorage, *storage.InMemoryStorage) {
+	journal, err := storage.OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, auth := storage.NewInMemoryStorage(), storage.NewInMemoryStorage()
+	journal.Attach("userdb", users)
+	journal.Attach("authdb", auth)
+
+	return journal, users, auth
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, users, auth := openJournal(t, dir)
+	users.Set("1", []byte("first"))
+	users.Set("2", []byte("second"))
+	auth.Set("first", []byte("secret"))
+	users.Delete("2")
+
+	// no Close: the state has to be recovered from the log alone
+	_, users, auth = openJournal(t, dir)
+
+	v, ok := users.Get("1")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, string(v), "first")
+
+	_, ok = users.Get("2")
+	assert.Equal(t, ok, false)
+
+	v, _ = auth.Get("first")
+	assert.Equal(t, string(v), "secret")
+
+	journal.Close()
+}
+
+func TestJournalSnapshotAndTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, users, _ := openJournal(t, dir)
+	users.Set("1", []byte("first"))
+	journal.Snapshot()
+	users.Set("2", []byte("second"))
+
+	f, _ := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.WriteString(`{"ops":[{"store":"userdb","op":"set","key":"3"`)
+	f.Close()
+
+	journal, users, _ = openJournal(t, dir)
+
+	_, ok := users.Get("1")
+	assert.Equal(t, ok, true)
+	_, ok = users.Get("2")
+	assert.Equal(t, ok, true)
+	_, ok = users.Get("3")
+	assert.Equal(t, ok, false)
+
+	// the log is writable again after the torn line was cut off
+	users.Set("4", []byte("fourth"))
+	journal.Close()
+
+	_, users, _ = openJournal(t, dir)
+	_, ok = users.Get("4")
+	assert.Equal(t, ok, true)
+}
+
+func TestUpdateRollback(t *testing.T) {
+	var store storage.Store = storage.NewInMemoryStorage()
+	store.Set("1", []byte("first"))
+
+	err := store.Update(func(tx storage.Tx) error {
+		tx.Set("1", []byte("changed"))
+		tx.Delete("1")
+		tx.Set("2", []byte("second"))
+
+		_, ok := tx.Get("1")
+		assert.Equal(t, ok, false)
+
+		return errors.New("abort")
+	})
+	assert.NotEqual(t, err, nil)
+
+	v, _ := store.Get("1")
+	assert.Equal(t, string(v), "first")
+	_, ok := store.Get("2")
+	assert.Equal(t, ok, false)
+}
+
+func TestUpdatePanicReleasesLock(t *testing.T) {
+	var store storage.Store = storage.NewInMemoryStorage()
+
+	func() {
+		defer func() { recover() }()
+		store.Update(func(tx storage.Tx) error {
+			tx.Set("1", []byte("first"))
+			panic("boom")
+		})
+	}()
+
+	// the store is still writable and the panicking writes were discarded
+	err := store.Update(func(tx storage.Tx) error {
+		tx.Set("2", []byte("second"))
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	_, ok := store.Get("1")
+	assert.Equal(t, ok, false)
+}
+
+func TestUpdateAllAcrossJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, users, auth := openJournal(t, dir)
+	stores := []storage.Store{users, auth}
+
+	err := storage.UpdateAll(stores, func(txs []storage.Tx) error {
+		txs[0].Set("1", []byte("profile"))
+		txs[1].Set("first", []byte("credentials"))
+		return nil
+	})
+	assert.Equal(t, err, nil)
+
+	err = storage.UpdateAll(stores, func(txs []storage.Tx) error {
+		txs[0].Delete("1")
+		return errors.New("abort")
+	})
+	assert.NotEqual(t, err, nil)
+
+	// both writes went to the log as a single entry
+	b, _ := os.ReadFile(filepath.Join(dir, "wal.log"))
+	assert.Equal(t, bytes.Count(b, []byte("\n")), 1)
+
+	_, users, auth = openJournal(t, dir)
+	_, ok := users.Get("1")
+	assert.Equal(t, ok, true)
+	_, ok = auth.Get("first")
+	assert.Equal(t, ok, true)
+
+	journal.Close()
+}
+
+func TestUpdateAllPanicReleasesLocks(t *testing.T) {
+	users, auth := storage.NewInMemoryStorage(), storage.NewInMemoryStorage()
+	stores := []storage.Store{users, auth}
+
+	func() {
+		defer func() { recover() }()
+		storage.UpdateAll(stores, func(txs []storage.Tx) error {
+			txs[0].Set("1", []byte("profile"))
+			panic("boom")
+		})
+	}()
+
+	err := storage.UpdateAll(stores, func(txs []storage.Tx) error {
+		txs[1].Set("first", []byte("credentials"))
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	_, ok := users.Get("1")
+	assert.Equal(t, ok, false)
+}
+
+func TestInsertionOrderSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, users, _ := openJournal(t, dir)
+	for _, k := range []string{"c", "a", "b", "d"} {
+		users.Set(k, []byte(k))
+	}
+	users.Delete("a")
+	journal.Snapshot()
+	users.Set("a", []byte("a"))
+
+	_, users, _ = openJournal(t, dir)
+
+	var keys []string
+	var seqs []uint64
+	users.ScanFrom(0, func(seq uint64, key string, _ []byte) bool {
+		keys = append(keys, key)
+		seqs = append(seqs, seq)
+		return true
+	})
+	assert.Equal(t, keys, []string{"c", "b", "d", "a"})
+	assert.Equal(t, seqs, []uint64{1, 3, 4, 5})
+
+	// sequence numbers are not reused after a delete
+	users.Delete("a")
+	users.Set("e", []byte("e"))
+	users.ScanFrom(4, func(seq uint64, key string, _ []byte) bool {
+		assert.Equal(t, key, "e")
+		assert.Equal(t, seq, uint64(6))
+		return false
+	})
+
+	journal.Close()
+}
+
+func TestScanIndex(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	for _, v := range []string{"bob", "alice", "alfred", "carol", "al"} {
+		store.Set(v, []byte(v))
+	}
+	store.CreateIndex("name", func(_ string, value []byte) (string, bool) {
+		return string(value), true
+	})
+
+	scan := func(r storage.IndexRange) (keys []string) {
+		store.ScanIndex("name", r, func(_ storage.IndexPos, key string, _ []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	assert.Equal(t, scan(storage.IndexRange{Prefix: "al"}), []string{"al", "alfred", "alice"})
+	assert.Equal(t, scan(storage.IndexRange{Prefix: "al", Desc: true}), []string{"alice", "alfred", "al"})
+	assert.Equal(t, scan(storage.IndexRange{From: "b", To: "c"}), []string{"bob"})
+
+	// the index follows updates and deletes
+	store.Set("bob", []byte("zed"))
+	store.Delete("alice")
+
+	after := storage.IndexPos{Term: "alfred", Seq: 3}
+	assert.Equal(t, scan(storage.IndexRange{After: &after}), []string{"carol", "bob"})
+	assert.Equal(t, scan(storage.IndexRange{After: &after, Desc: true}), []string{"al"})
+
+	err := store.ScanIndex("missing", storage.IndexRange{}, nil)
+	assert.Equal(t, err, storage.ErrNoIndex)
+}
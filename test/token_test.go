@@ -0,0 +1,244 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/token"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func serveWithToken(h http.Handler, method, target, access string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+access)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func requestTokens(h http.Handler, req dto.TokenRequest) (*http.Response, token.Pair) {
+	b, _ := json.Marshal(req)
+	res := serveWithCookies(h, http.MethodPost, "/auth/token", b, nil)
+
+	var pair token.Pair
+	if res.StatusCode == http.StatusOK {
+		json.NewDecoder(res.Body).Decode(&pair)
+	}
+	return res, pair
+}
+
+func refreshTokens(h http.Handler, refresh string) (*http.Response, token.Pair) {
+	return requestTokens(h, dto.TokenRequest{GrantType: "refresh_token", RefreshToken: refresh})
+}
+
+// backdate re-signs the HS256 access token as issued by seconds earlier, as
+// if it was issued before a revocation in the same second.
+func backdate(t *testing.T, issuer *token.Issuer, access string, by int64) string {
+	parts := strings.Split(access, ".")
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Equal(t, err, nil)
+
+	var claims token.Claims
+	assert.Equal(t, json.Unmarshal(b, &claims), nil)
+	claims.IssuedAt -= by
+	b, _ = json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(b)
+
+	mac := hmac.New(sha256.New, issuer.Keys.HMAC)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	parts[2] = base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return strings.Join(parts, ".")
+}
+
+// testTokens is the token scenario, see forEachBackend.
+func testTokens(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	res, _ := requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "admin", Password: "wrong"})
+	assert.Equal(t, res.StatusCode, 401)
+	res, _ = requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "admin"})
+	assert.Equal(t, res.StatusCode, 400)
+	res, _ = requestTokens(h, dto.TokenRequest{GrantType: "client_credentials"})
+	assert.Equal(t, res.StatusCode, 400)
+
+	res, pair := requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "admin", Password: "admin"})
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, res.Header.Get("Cache-Control"), "no-store")
+	assert.Equal(t, pair.TokenType, "Bearer")
+	assert.Equal(t, pair.ExpiresIn > 0, true)
+	assert.Equal(t, len(strings.Split(pair.AccessToken, ".")), 3)
+
+	res = serveWithToken(h, http.MethodGet, "/user/", pair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithToken(h, http.MethodGet, "/audit", pair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	res = serveWithToken(h, http.MethodGet, "/user/", "garbage", nil)
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, res.Header.Get("WWW-Authenticate"), `Bearer error="invalid_token"`)
+
+	// another subject with the same signature
+	parts := strings.Split(pair.AccessToken, ".")
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	forged := bytes.Replace(claims, []byte(`"sub":"`), []byte(`"sub":"x`), 1)
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	res = serveWithToken(h, http.MethodGet, "/user/", strings.Join(parts, "."), nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// rotation
+	res, rotated := refreshTokens(h, pair.RefreshToken)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.NotEqual(t, rotated.RefreshToken, pair.RefreshToken)
+	res = serveWithToken(h, http.MethodGet, "/user/", rotated.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	// reusing a rotated token revokes the whole family
+	res, _ = refreshTokens(h, pair.RefreshToken)
+	assert.Equal(t, res.StatusCode, 401)
+	res, _ = refreshTokens(h, rotated.RefreshToken)
+	assert.Equal(t, res.StatusCode, 401)
+
+	res, _ = refreshTokens(h, "unknown")
+	assert.Equal(t, res.StatusCode, 401)
+
+	// revocation
+	_, pair = requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "admin", Password: "admin"})
+	b, _ := json.Marshal(dto.RevokeToken{RefreshToken: pair.RefreshToken})
+	res = serveWithCookies(h, http.MethodPost, "/auth/revoke", b, nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res, _ = refreshTokens(h, pair.RefreshToken)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// the tokens of a user are good for as long as the user exists, with the
+	// rights the user has at the time
+	_, created := createUser(h, User{Username: "tokened", Email: "tokened@mail.ru", Password: "password"})
+	_, userPair := requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "tokened", Password: "password"})
+	res = serveWithToken(h, http.MethodDelete, "/user/"+created.Id, userPair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 403)
+
+	res = serveWithToken(h, http.MethodDelete, "/user/"+created.Id, rotated.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 204)
+	entries := listAudit(t, h, "action=delete&target="+created.Id)
+	assert.Equal(t, entries[0].Actor, "admin")
+
+	res = serveWithToken(h, http.MethodGet, "/user/", userPair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res, _ = refreshTokens(h, userPair.RefreshToken)
+	assert.Equal(t, res.StatusCode, 401)
+
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestTokens(t *testing.T) {
+	forEachBackend(t, testTokens)
+}
+
+func TestEd25519Tokens(t *testing.T) {
+	h, repo := newSQLiteHandler(t, filepath.Join(t.TempDir(), "users.db"))
+	defer repo.Close()
+
+	hmacIssuer := h.Tokens
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+
+	signing, public, err := token.ParseEd25519Keys(seed, nil)
+	assert.Equal(t, err, nil)
+	h.Tokens = token.NewIssuer(hmacIssuer.Name, token.Keys{HMAC: hmacIssuer.Keys.HMAC, Signing: signing, Public: public},
+		time.Minute, time.Hour, repo.RefreshTokens())
+
+	res, pair := requestTokens(h, dto.TokenRequest{GrantType: "password", Username: "admin", Password: "admin"})
+	assert.Equal(t, res.StatusCode, 200)
+	header, _ := base64.RawURLEncoding.DecodeString(strings.Split(pair.AccessToken, ".")[0])
+	assert.Equal(t, strings.Contains(string(header), `"alg":"EdDSA"`), true)
+	assert.Equal(t, strings.Contains(string(header), token.KeyId(pub)), true)
+
+	res = serveWithToken(h, http.MethodGet, "/user/", pair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	// the public key alone verifies the token
+	_, public, _ = token.ParseEd25519Keys("", []string{base64.StdEncoding.EncodeToString(pub)})
+	verifier := token.NewIssuer(hmacIssuer.Name, token.Keys{Public: public}, time.Minute, time.Hour, nil)
+	_, err = verifier.Verify(pair.AccessToken)
+	assert.Equal(t, err, nil)
+
+	// HS256 tokens are refused, unless accepted while switching
+	_, hmacPair := requestTokens(delivery.NewUserHandler(repo), dto.TokenRequest{GrantType: "password", Username: "admin", Password: "admin"})
+	res = serveWithToken(h, http.MethodGet, "/user/", hmacPair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 401)
+	h.Tokens.Keys.AcceptHMAC = true
+	res = serveWithToken(h, http.MethodGet, "/user/", hmacPair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	h.Tokens.Keys.AcceptHMAC = false
+	_, err = verifier.Verify(hmacPair.AccessToken)
+	assert.Equal(t, err, token.ErrInvalidToken)
+
+	// tokens of unknown keys aren't accepted
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	otherSigning, otherPublic, _ := token.ParseEd25519Keys(base64.StdEncoding.EncodeToString(other.Seed()), nil)
+	otherIssuer := token.NewIssuer(hmacIssuer.Name, token.Keys{Signing: otherSigning, Public: otherPublic}, time.Minute, time.Hour, repo.RefreshTokens())
+	credentials, _ := repo.GetCredentialsByUsername("admin")
+	otherPair, err := otherIssuer.Issue(credentials.Id, false)
+	assert.Equal(t, err, nil)
+	_, err = h.Tokens.Verify(otherPair.AccessToken)
+	assert.Equal(t, err, token.ErrInvalidToken)
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	parts := strings.Split(pair.AccessToken, ".")
+	_, err = h.Tokens.Verify(none + "." + parts[1] + ".")
+	assert.Equal(t, err, token.ErrInvalidToken)
+
+	_, _, err = token.ParseEd25519Keys("short", nil)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestExpiredToken(t *testing.T) {
+	issuer := token.NewIssuer("users", token.Keys{HMAC: []byte("secret")}, 0, time.Hour, repo.RefreshTokens())
+	credentials, _ := repo.GetCredentialsByUsername("admin")
+
+	pair, err := issuer.Issue(credentials.Id, false)
+	assert.Equal(t, err, nil)
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.Equal(t, err, token.ErrInvalidToken)
+
+	other := token.NewIssuer("other", token.Keys{HMAC: []byte("secret")}, time.Minute, time.Hour, repo.RefreshTokens())
+	pair, _ = other.Issue(credentials.Id, false)
+	_, err = issuer.Verify(pair.AccessToken)
+	assert.Equal(t, err, token.ErrInvalidToken)
+}
+
+func TestTokenKeyIsNotCookieKey(t *testing.T) {
+	// a token signed with the cookie secret is refused
+	cookieIssuer := token.NewIssuer(config.Cfg.Token.Issuer, token.Keys{HMAC: secretKey(t)}, time.Minute, time.Hour, repo.RefreshTokens())
+	pair, err := cookieIssuer.Issue(adminId(t), false)
+	assert.Equal(t, err, nil)
+	_, err = handler.Tokens.Verify(pair.AccessToken)
+	assert.Equal(t, err, token.ErrInvalidToken)
+
+	// a configured key signs the tokens
+	saved := config.Cfg.Token.HMACKey
+	defer func() { config.Cfg.Token.HMACKey = saved }()
+	config.Cfg.Token.HMACKey = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	key, _ := hex.DecodeString(config.Cfg.Token.HMACKey)
+
+	pair, err = token.NewIssuer(config.Cfg.Token.Issuer, token.Keys{HMAC: key}, time.Minute, time.Hour, repo.RefreshTokens()).Issue(adminId(t), false)
+	assert.Equal(t, err, nil)
+	_, err = delivery.NewUserHandler(repo).Tokens.Verify(pair.AccessToken)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,222 @@
+package test
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"users/config"
+	"users/internal/totp"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	assert.Equal(t, totp.Code(secret, time.Unix(59, 0)), "287082")
+	assert.Equal(t, totp.Code(secret, time.Unix(1111111109, 0)), "081804")
+	assert.Equal(t, totp.Code(secret, time.Unix(1234567890, 0)), "005924")
+	assert.Equal(t, totp.Code(secret, time.Unix(2000000000, 0)), "279037")
+
+	uri := totp.URI("users", "John Doe", "JBSWY3DPEHPK3PXP")
+	assert.Equal(t, uri, "otpauth://totp/users:John%20Doe?algorithm=SHA1&digits=6&issuer=users&period=30&secret=JBSWY3DPEHPK3PXP")
+}
+
+func serveWithOTP(h http.Handler, method, target, username, password, otp string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	req.SetBasicAuth(username, password)
+	req.Header.Set("X-OTP", otp)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+func twoFactorStatus(t *testing.T, h http.Handler, cookies []*http.Cookie) dto.TwoFactorStatus {
+	res := serveWithCookies(h, http.MethodGet, "/user/me/2fa", nil, cookies)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var status dto.TwoFactorStatus
+	json.NewDecoder(res.Body).Decode(&status)
+	return status
+}
+
+// enrollTwoFactor enables the two-factor authentication of the user and
+// returns its secret and recovery codes.
+func enrollTwoFactor(t *testing.T, h http.Handler, username, password string) ([]byte, []string) {
+	res := serveAsUser(h, http.MethodPost, "/user/me/2fa", username, password, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	var enrollment dto.TwoFactorEnrollment
+	json.NewDecoder(res.Body).Decode(&enrollment)
+	assert.Equal(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/users:"+username+"?"), true)
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	assert.Equal(t, err, nil)
+
+	b, _ := json.Marshal(dto.OneTimeCode{Code: totp.Code(secret, time.Now())})
+	res = serveAsUser(h, http.MethodPost, "/user/me/2fa/confirm", username, password, b)
+	assert.Equal(t, res.StatusCode, 200)
+	var recovery dto.RecoveryCodes
+	json.NewDecoder(res.Body).Decode(&recovery)
+
+	return secret, recovery.RecoveryCodes
+}
+
+// testTwoFactor is the two-factor scenario, see forEachBackend.
+func testTwoFactor(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	saved := config.Cfg.TOTP
+	defer func() { config.Cfg.TOTP = saved }()
+
+	_, created := createUser(h, User{Username: "guarded", Email: "guarded@mail.ru", Password: "password", Admin: true})
+
+	res := serveAsUser(h, http.MethodGet, "/user/me/2fa", "guarded", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	var status dto.TwoFactorStatus
+	json.NewDecoder(res.Body).Decode(&status)
+	assert.Equal(t, status.Enabled, false)
+
+	// an enrollment only counts once confirmed
+	serveAsUser(h, http.MethodPost, "/user/me/2fa", "guarded", "password", nil)
+	b, _ := json.Marshal(dto.OneTimeCode{Code: "000000"})
+	res = serveAsUser(h, http.MethodPost, "/user/me/2fa/confirm", "guarded", "password", b)
+	assert.Equal(t, res.StatusCode, 403)
+	res = serveAsUser(h, http.MethodGet, "/user/", "guarded", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	secret, recovery := enrollTwoFactor(t, h, "guarded", "password")
+	assert.Equal(t, len(recovery), 10)
+	assert.Equal(t, len(listAudit(t, h, "action=2fa_enable&target="+created.Id)), 1)
+
+	res = serveAsUser(h, http.MethodPost, "/user/me/2fa", "guarded", "password", nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// the password alone isn't enough anymore, and a code is good once
+	res = serveWithOTP(h, http.MethodGet, "/user/", "guarded", "password", totp.Code(secret, time.Now().Add(-totp.Period)), nil)
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, errorMessage(res), "wrong one-time code")
+	next := totp.Code(secret, time.Now().Add(totp.Period))
+	res = serveWithOTP(h, http.MethodGet, "/user/", "guarded", "password", next, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithOTP(h, http.MethodGet, "/user/", "guarded", "wrong", next, nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	// Basic auth sends the code with every request, past the lockout
+	// threshold, without failing, and doesn't take recovery codes
+	for i := 0; i < 2*config.Cfg.Lockout.Threshold; i++ {
+		res = serveWithOTP(h, http.MethodGet, "/user/", "guarded", "password", next, nil)
+		assert.Equal(t, res.StatusCode, 200)
+	}
+	res = serveWithOTP(h, http.MethodGet, "/user/", "guarded", "password", recovery[0], nil)
+	assert.Equal(t, res.StatusCode, 401)
+	res = serveWithOTP(h, http.MethodGet, "/user/", "guarded", "password", next, nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	b, _ = json.Marshal(dto.Login{Username: "guarded", Password: "password"})
+	res = serveWithCookies(h, http.MethodPost, "/auth/login", b, nil)
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, errorMessage(res), "one-time code required")
+
+	// recovery codes are good once too
+	b, _ = json.Marshal(dto.Login{Username: "guarded", Password: "password", OTP: strings.ToUpper(recovery[0])})
+	res = serveWithCookies(h, http.MethodPost, "/auth/login", b, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	session := sessionCookie(res)
+	assert.Equal(t, twoFactorStatus(t, h, session).RecoveryCodes, 9)
+	res = serveWithCookies(h, http.MethodPost, "/auth/login", b, nil)
+	assert.Equal(t, res.StatusCode, 401)
+
+	b, _ = json.Marshal(dto.TokenRequest{GrantType: "password", Username: "guarded", Password: "password", OTP: recovery[1]})
+	res = serveAsUser(h, http.MethodPost, "/auth/token", "", "", b)
+	assert.Equal(t, res.StatusCode, 200)
+	var pair struct {
+		AccessToken string `json:"access_token"`
+	}
+	json.NewDecoder(res.Body).Decode(&pair)
+
+	// admins who didn't give a code are refused when the config says so
+	config.Cfg.TOTP.RequireForAdmins = true
+	res = serveWithCookies(h, http.MethodGet, "/user/", nil, session)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveWithToken(h, http.MethodGet, "/user/", pair.AccessToken, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveAsAdmin(h, http.MethodGet, "/user/", nil)
+	assert.Equal(t, res.StatusCode, 403)
+	res = serveAsAdmin(h, http.MethodGet, "/user/me/2fa", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	config.Cfg.TOTP = saved
+
+	// turning it off takes a code
+	b, _ = json.Marshal(dto.OneTimeCode{Code: "000000"})
+	res = serveWithCookies(h, http.MethodDelete, "/user/me/2fa", b, session)
+	assert.Equal(t, res.StatusCode, 403)
+	b, _ = json.Marshal(dto.OneTimeCode{Code: recovery[2]})
+	res = serveWithCookies(h, http.MethodDelete, "/user/me/2fa", b, session)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveWithCookies(h, http.MethodDelete, "/user/me/2fa", b, session)
+	assert.Equal(t, res.StatusCode, 404)
+	res = serveAsUser(h, http.MethodGet, "/user/", "guarded", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	// or an admin may reset it
+	enrollTwoFactor(t, h, "guarded", "password")
+	res = serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id+"/2fa", nil)
+	assert.Equal(t, res.StatusCode, 204)
+	res = serveAsUser(h, http.MethodGet, "/user/", "guarded", "password", nil)
+	assert.Equal(t, res.StatusCode, 200)
+	res = serveAsAdmin(h, http.MethodDelete, "/user/00000000-0000-4000-8000-000000000000/2fa", nil)
+	assert.Equal(t, res.StatusCode, 404)
+	assert.Equal(t, actions(listAudit(t, h, "target="+created.Id))[1:], []string{"2fa_enable", "2fa_disable", "2fa_enable", "2fa_reset"})
+
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	repo.PurgeDeleted(time.Now())
+}
+
+func TestTwoFactor(t *testing.T) {
+	forEachBackend(t, testTwoFactor)
+}
+
+// updateCounter counts the writes to the enrollments.
+type updateCounter struct {
+	totp.Store
+	updates int
+}
+
+func (c *updateCounter) Update(userId string, fn func(e *totp.Enrollment) error) error {
+	c.updates++
+	return c.Store.Update(userId, fn)
+}
+
+// A code sent with every request is only written down when its period is
+// later than the last one accepted.
+func TestVerifyRepeatedWrites(t *testing.T) {
+	store := &updateCounter{Store: newMemoryRepository().TwoFactor()}
+	m := totp.NewManager(store, "users")
+	now := time.Now()
+
+	secret := []byte("12345678901234567890")
+	step := now.Unix() / int64(totp.Period.Seconds())
+	e := totp.Enrollment{Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), Confirmed: true, LastStep: step - 1}
+	assert.Equal(t, store.Put("1", e), nil)
+
+	code := totp.Code(secret, now)
+	for range 3 {
+		assert.Equal(t, m.VerifyRepeated("1", code, now), nil)
+	}
+	assert.Equal(t, store.updates, 1)
+	e, _ = store.Get("1")
+	assert.Equal(t, e.LastStep, step)
+
+	assert.Equal(t, m.VerifyRepeated("1", "abcdef", now), totp.ErrInvalidCode)
+	assert.Equal(t, m.VerifyRepeated("2", code, now), totp.ErrNotEnrolled)
+	assert.Equal(t, store.updates, 1)
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"users/internal/apikey"
+	"users/internal/rbac"
+	"users/internal/reset"
+	"users/internal/session"
+	"users/internal/token"
+	"users/internal/totp"
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func listTrash(t *testing.T, h http.Handler) []dto.ListUser {
+	res := serveAsAdmin(h, http.MethodGet, "/user/trash", nil)
+	assert.Equal(t, res.StatusCode, 200)
+
+	var users []dto.ListUser
+	json.NewDecoder(res.Body).Decode(&users)
+	return users
+}
+
+func inTrash(users []dto.ListUser, id string) bool {
+	for _, u := range users {
+		if u.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// testTrash is the soft delete scenario, see forEachBackend. The purge empties
+// the whole trash, fine as every run gets a fresh repository.
+func testTrash(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	_, created := createUser(h, User{Username: "trashed", Email: "trashed@mail.ru", Password: "password"})
+
+	res := serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	assert.Equal(t, res.StatusCode, 204)
+
+	// hidden from everything but the trash
+	res = serveAsAdmin(h, http.MethodGet, "/user/"+created.Id, nil)
+	assert.Equal(t, res.StatusCode, 404)
+	assert.Equal(t, usernames(listUsers(t, h, "username_prefix=trashed")), []string{})
+	_, ok := repo.GetCredentialsByUsername("trashed")
+	assert.Equal(t, ok, false)
+
+	res = serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	assert.Equal(t, res.StatusCode, 404)
+
+	trash := listTrash(t, h)
+	assert.Equal(t, inTrash(trash, created.Id), true)
+	assert.Equal(t, trash[len(trash)-1].DeletedAt != nil, true)
+
+	res = serveAsAdmin(h, http.MethodPost, "/user/"+created.Id+"/restore", nil)
+	assert.Equal(t, res.StatusCode, 204)
+
+	res = serveAsAdmin(h, http.MethodGet, "/user/"+created.Id, nil)
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, res.Header.Get("ETag"), `"3"`)
+	_, ok = repo.GetCredentialsByUsername("trashed")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, inTrash(listTrash(t, h), created.Id), false)
+
+	// the identity is released in the trash and can be taken meanwhile
+	serveAsAdmin(h, http.MethodDelete, "/user/"+created.Id, nil)
+	res, taken := createUser(h, User{Username: "Trashed", Email: "other@mail.ru", Password: "password"})
+	assert.Equal(t, res.StatusCode, 201)
+
+	res = serveAsAdmin(h, http.MethodPost, "/user/"+created.Id+"/restore", nil)
+	assert.Equal(t, res.StatusCode, 409)
+
+	// only what was deleted before the retention period is purged
+	n, err := repo.PurgeDeleted(time.Now().Add(-time.Hour))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 0)
+
+	n, err = repo.PurgeDeleted(time.Now())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+	assert.Equal(t, inTrash(listTrash(t, h), created.Id), false)
+
+	res = serveAsAdmin(h, http.MethodPost, "/user/"+created.Id+"/restore", nil)
+	assert.Equal(t, res.StatusCode, 404)
+	res = serveAsAdmin(h, http.MethodGet, "/user/"+taken.Id, nil)
+	assert.Equal(t, res.StatusCode, 200)
+}
+
+func TestTrash(t *testing.T) {
+	forEachBackend(t, testTrash)
+}
+
+// testPurgeUserData is the scenario of purging a user along with everything
+// it has in the other stores, see forEachBackend.
+func testPurgeUserData(t *testing.T, h *delivery.UserHandler, repo repository.UserRepository) {
+	_, created := createUser(h, User{Username: "purged", Email: "purged@mail.ru", Password: "password"})
+	id := created.Id
+	expires := time.Now().Add(time.Hour)
+
+	assert.Equal(t, repo.Roles().CreateRole(rbac.Role{Name: "purged"}), nil)
+	assert.Equal(t, repo.Roles().SetUserRoles(id, []string{"purged"}), nil)
+	assert.Equal(t, repo.TwoFactor().Put(id, totp.Enrollment{Secret: "secret"}), nil)
+	assert.Equal(t, repo.APIKeys().Create(apikey.Key{Id: "key", UserId: id, Hash: "hash"}), nil)
+	assert.Equal(t, repo.Sessions().Put(session.Key("session"), session.Session{UserId: id, ExpiresAt: expires}), nil)
+	assert.Equal(t, repo.RefreshTokens().Put(token.Key("refresh"), token.RefreshToken{UserId: id, Family: "family", ExpiresAt: expires}), nil)
+	assert.Equal(t, repo.PasswordResets().Create(reset.Key("reset"), reset.Token{UserId: id, ExpiresAt: expires}), nil)
+
+	assert.Equal(t, repo.DeleteUser(id, nil, nil), nil)
+	n, err := repo.PurgeDeleted(time.Now())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+
+	roles, err := repo.Roles().UserRoles(id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, roles, []string{})
+	_, err = repo.TwoFactor().Get(id)
+	assert.Equal(t, err, totp.ErrNotEnrolled)
+	keys, err := repo.APIKeys().List(id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 0)
+	_, err = repo.APIKeys().GetByHash("hash")
+	assert.Equal(t, err, apikey.ErrNotFound)
+	_, err = repo.Sessions().Get(session.Key("session"))
+	assert.Equal(t, err, session.ErrNotFound)
+	_, err = repo.RefreshTokens().Use(token.Key("refresh"))
+	assert.Equal(t, err, token.ErrInvalidToken)
+	_, err = repo.PasswordResets().Get(reset.Key("reset"))
+	assert.Equal(t, err, reset.ErrInvalidToken)
+}
+
+func TestPurgeUserData(t *testing.T) {
+	forEachBackend(t, testPurgeUserData)
+}
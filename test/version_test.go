@@ -0,0 +1,66 @@
+package test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	delivery "users/internal/user/infrastructure/delivery/http"
+	"users/internal/user/infrastructure/dto"
+	"users/internal/user/infrastructure/repository"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func serveIfMatch(h http.Handler, method, target, ifMatch string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:admin")))
+	req.Header.Set("If-Match", ifMatch)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w.Result()
+}
+
+// testOptimisticConcurrency is the lost update scenario, see forEachBackend.
+func testOptimisticConcurrency(t *testing.T, h *delivery.UserHandler, _ repository.UserRepository) {
+	_, created := createUser(h, User{Username: "versioned", Email: "versioned@mail.ru", Password: "password"})
+
+	res := serveAsAdmin(h, http.MethodGet, "/user/"+created.Id, nil)
+	tag := res.Header.Get("ETag")
+	assert.Equal(t, tag, `"1"`)
+
+	var got dto.ListUser
+	json.NewDecoder(res.Body).Decode(&got)
+	assert.Equal(t, got.Version, uint64(1))
+
+	// two admins edit the same version, the second one has to reload
+	b, _ := json.Marshal(UpdatedUser{Email: "first@mail.ru"})
+	res = serveIfMatch(h, http.MethodPatch, "/user/"+created.Id, tag, b)
+	assert.Equal(t, res.StatusCode, 204)
+
+	b, _ = json.Marshal(UpdatedUser{Email: "second@mail.ru"})
+	res = serveIfMatch(h, http.MethodPatch, "/user/"+created.Id, tag, b)
+	assert.Equal(t, res.StatusCode, 412)
+
+	res = serveAsAdmin(h, http.MethodGet, "/user/"+created.Id, nil)
+	assert.Equal(t, res.Header.Get("ETag"), `"2"`)
+	json.NewDecoder(res.Body).Decode(&got)
+	assert.Equal(t, got.Email, "first@mail.ru")
+
+	res = serveIfMatch(h, http.MethodDelete, "/user/"+created.Id, `W/"2"`, nil)
+	assert.Equal(t, res.StatusCode, 412)
+	res = serveIfMatch(h, http.MethodDelete, "/user/"+created.Id, tag, nil)
+	assert.Equal(t, res.StatusCode, 412)
+
+	res = serveIfMatch(h, http.MethodDelete, "/user/"+created.Id, `"2"`, nil)
+	assert.Equal(t, res.StatusCode, 204)
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	forEachBackend(t, testOptimisticConcurrency)
+}